@@ -17,6 +17,7 @@ import (
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
 	_ "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
 	"github.com/flynn/flynn/discoverd/client"
+	hh "github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/pkg/random"
 	"github.com/flynn/flynn/pkg/shutdown"
 )
@@ -33,8 +34,17 @@ func main() {
 
 	flag.Parse()
 
+	// the leader is picked by the appliance rather than being the oldest
+	// instance
+	config := &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual}
+	if err := discoverd.DefaultClient.AddService(*serviceName, config); err != nil {
+		if je, ok := err.(hh.JSONError); !ok || je.Code != hh.ObjectExistsError {
+			shutdown.Fatal(err)
+		}
+	}
+
 	var err error
-	heartbeater, err = discoverd.AddServiceAndRegister(*serviceName, addr)
+	heartbeater, err = discoverd.Register(*serviceName, addr)
 	if err != nil {
 		shutdown.Fatal(err)
 	}
@@ -43,8 +53,17 @@ func main() {
 	var leaderProc *exec.Cmd
 	var done <-chan struct{}
 
+	service := discoverd.NewService(*serviceName)
+	if _, err := service.Leader(); discoverd.IsNotFound(err) {
+		if err := service.SetLeader(heartbeater.ID()); err != nil {
+			shutdown.Fatal(err)
+		}
+	} else if err != nil {
+		shutdown.Fatal(err)
+	}
+
 	leaders := make(chan *discoverd.Instance)
-	stream, err := discoverd.NewService(*serviceName).Leaders(leaders)
+	stream, err := service.Leaders(leaders)
 	if err != nil {
 		shutdown.Fatal(err)
 	}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/controller/client"
+)
+
+func init() {
+	register("maintenance", runMaintenance, `
+usage: flynn maintenance (on|off)
+
+Enable or disable maintenance mode for an app.
+
+While in maintenance mode, all HTTP requests to the app are answered with
+a 503 Service Unavailable response and the app's maintenance page, if one is
+configured on the route.`)
+}
+
+func runMaintenance(args *docopt.Args, client *controller.Client) error {
+	app, err := client.GetApp(mustApp())
+	if err != nil {
+		return err
+	}
+	app.Maintenance = args.Bool["on"]
+	if err := client.UpdateApp(app); err != nil {
+		return err
+	}
+	if app.Maintenance {
+		log.Printf("Maintenance mode enabled for %s.", app.Name)
+	} else {
+		log.Printf("Maintenance mode disabled for %s.", app.Name)
+	}
+	return nil
+}
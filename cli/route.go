@@ -17,8 +17,8 @@ import (
 func init() {
 	register("route", runRoute, `
 usage: flynn route
-       flynn route add http [-s <service>] [-c <tls-cert> -k <tls-key>] [--sticky] <domain>
-       flynn route add tcp [-s <service>]
+       flynn route add http [-s <service>] [-c <tls-cert> -k <tls-key>] [--sticky] [--force-tls] [--lb <algorithm>] [--hash-header <header>] <domain>
+       flynn route add tcp [-s <service>] [--lb <algorithm>]
        flynn route remove <id>
 
 Manage routes for application.
@@ -28,6 +28,10 @@ Options:
 	-c, --tls-cert <tls-cert>  path to PEM encoded certificate for TLS, - for stdin (http only)
 	-k, --tls-key <tls-key>    path to PEM encoded private key for TLS, - for stdin (http only)
 	--sticky                   enable cookie-based sticky routing (http only)
+	--force-tls                redirect plain HTTP requests to HTTPS, load balancers which terminate TLS
+	                           must be in the router's -trusted-proxies (http only)
+	--lb <algorithm>           load balancing algorithm: random, round-robin, least-conn or hash
+	--hash-header <header>     request header to hash on with --lb hash, defaults to client IP (http only)
 
 Commands:
 	With no arguments, shows a list of routes.
@@ -93,7 +97,10 @@ func runRouteAddTCP(args *docopt.Args, client *controller.Client) error {
 		service = mustApp() + "-web"
 	}
 
-	hr := &router.TCPRoute{Service: service}
+	hr := &router.TCPRoute{
+		Service:      service,
+		LoadBalancer: args.String["--lb"],
+	}
 	r := hr.ToRoute()
 	if err := client.CreateRoute(mustApp(), r); err != nil {
 		return err
@@ -143,6 +150,11 @@ func runRouteAddHTTP(args *docopt.Args, client *controller.Client) error {
 		TLSCert: string(tlsCert),
 		TLSKey:  string(tlsKey),
 		Sticky:  args.Bool["sticky"],
+
+		ForceTLS: args.Bool["--force-tls"],
+
+		LoadBalancer: args.String["--lb"],
+		HashHeader:   args.String["--hash-header"],
 	}
 	route := hr.ToRoute()
 	if err := client.CreateRoute(mustApp(), route); err != nil {
@@ -74,7 +74,7 @@ func (r *AppRepo) Add(data interface{}) error {
 func scanApp(s postgres.Scanner) (*ct.App, error) {
 	app := &ct.App{}
 	var meta hstore.Hstore
-	err := s.Scan(&app.ID, &app.Name, &app.Protected, &meta, &app.Strategy, &app.CreatedAt, &app.UpdatedAt)
+	err := s.Scan(&app.ID, &app.Name, &app.Protected, &app.Maintenance, &meta, &app.Strategy, &app.CreatedAt, &app.UpdatedAt)
 	if err == sql.ErrNoRows {
 		err = ErrNotFound
 	}
@@ -96,7 +96,7 @@ type rowQueryer interface {
 
 func selectApp(db rowQueryer, id string, update bool) (*ct.App, error) {
 	var row postgres.Scanner
-	query := "SELECT app_id, name, protected, meta, strategy, created_at, updated_at FROM apps WHERE deleted_at IS NULL AND "
+	query := "SELECT app_id, name, protected, maintenance, meta, strategy, created_at, updated_at FROM apps WHERE deleted_at IS NULL AND "
 	var suffix string
 	if update {
 		suffix = " FOR UPDATE"
@@ -149,6 +149,24 @@ func (r *AppRepo) Update(id string, data map[string]interface{}) (interface{}, e
 				}
 				app.Protected = protected
 			}
+		case "maintenance":
+			maintenance, ok := v.(bool)
+			if !ok {
+				tx.Rollback()
+				return nil, fmt.Errorf("controller: expected bool, got %T", v)
+			}
+			if app.Maintenance != maintenance {
+				if _, err := tx.Exec("UPDATE apps SET maintenance = $2, updated_at = now() WHERE app_id = $1", app.ID, maintenance); err != nil {
+					tx.Rollback()
+					return nil, err
+				}
+				if err := r.setMaintenance(app.ID, maintenance); err != nil {
+					tx.Rollback()
+					r.setMaintenance(app.ID, app.Maintenance)
+					return nil, err
+				}
+				app.Maintenance = maintenance
+			}
 		case "meta":
 			data, ok := v.(map[string]interface{})
 			if !ok {
@@ -177,6 +195,28 @@ func (r *AppRepo) Update(id string, data map[string]interface{}) (interface{}, e
 	return app, tx.Commit()
 }
 
+// setMaintenance sets the maintenance flag on all of the app's HTTP routes.
+func (r *AppRepo) setMaintenance(appID string, maintenance bool) error {
+	routes, err := r.router.ListRoutes(routeParentRef(appID))
+	if err != nil {
+		return err
+	}
+	for _, route := range routes {
+		if route.Type != "http" {
+			continue
+		}
+		hr := route.HTTPRoute()
+		if hr.Maintenance == maintenance {
+			continue
+		}
+		hr.Maintenance = maintenance
+		if err := r.router.SetRoute(hr.ToRoute()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (r *AppRepo) Remove(id string) error {
 	tx, err := r.db.Begin()
 	if err != nil {
@@ -210,7 +250,7 @@ func (r *AppRepo) Remove(id string) error {
 }
 
 func (r *AppRepo) List() (interface{}, error) {
-	rows, err := r.db.Query("SELECT app_id, name, protected, meta, strategy, created_at, updated_at FROM apps WHERE deleted_at IS NULL ORDER BY created_at DESC")
+	rows, err := r.db.Query("SELECT app_id, name, protected, maintenance, meta, strategy, created_at, updated_at FROM apps WHERE deleted_at IS NULL ORDER BY created_at DESC")
 	if err != nil {
 		return nil, err
 	}
@@ -16,6 +16,7 @@ import (
 	"github.com/flynn/flynn/controller/client"
 	tu "github.com/flynn/flynn/controller/testutils"
 	ct "github.com/flynn/flynn/controller/types"
+	hh "github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/pkg/postgres"
 	"github.com/flynn/flynn/pkg/random"
 	"github.com/flynn/flynn/pkg/testutils"
@@ -262,6 +263,33 @@ func (s *S) TestCreateRelease(c *C) {
 	}
 }
 
+func (s *S) TestCreateReleaseHealthCheck(c *C) {
+	release := s.createTestRelease(c, &ct.Release{
+		Processes: map[string]ct.ProcessType{
+			"web": {HealthCheck: &ct.HealthCheck{Type: "http", Path: "/status", Interval: 5}},
+		},
+	})
+	gotRelease, err := s.c.GetRelease(release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotRelease.Processes["web"].HealthCheck, DeepEquals, release.Processes["web"].HealthCheck)
+
+	// invalid health checks are rejected when the release is created
+	artifact := s.createTestArtifact(c, &ct.Artifact{})
+	for _, check := range []*ct.HealthCheck{
+		{Type: "htp"},
+		{Type: ""},
+		{Type: "tcp", Port: -1},
+		{Type: "tcp", Interval: -1},
+	} {
+		err := s.c.CreateRelease(&ct.Release{
+			ArtifactID: artifact.ID,
+			Processes:  map[string]ct.ProcessType{"web": {HealthCheck: check}},
+		})
+		c.Assert(err, NotNil, Commentf("check = %+v", check))
+		c.Assert(err.(hh.JSONError).Code, Equals, hh.ValidationError, Commentf("check = %+v", check))
+	}
+}
+
 func (s *S) TestCreateFormation(c *C) {
 	for i, useName := range []bool{false, true} {
 		release := s.createTestRelease(c, &ct.Release{})
@@ -17,7 +17,13 @@ func (c *controllerAPI) CreateRoute(ctx context.Context, w http.ResponseWriter,
 		return
 	}
 
-	route.ParentRef = routeParentRef(c.getApp(ctx).ID)
+	app := c.getApp(ctx)
+	route.ParentRef = routeParentRef(app.ID)
+	if route.Type == "http" && app.Maintenance {
+		hr := route.HTTPRoute()
+		hr.Maintenance = true
+		route = *hr.ToRoute()
+	}
 
 	if err := schema.Validate(route); err != nil {
 		respondWithError(w, err)
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"sort"
 	"sync"
 	"time"
@@ -9,6 +10,7 @@ import (
 	"github.com/flynn/flynn/controller/client"
 	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/pkg/stream"
 	routerc "github.com/flynn/flynn/router/client"
 	"github.com/flynn/flynn/router/types"
 )
@@ -54,7 +56,15 @@ func (r *fakeRouter) GetRoute(id string) (*router.Route, error) {
 	return route, nil
 }
 
-func (r *fakeRouter) SetRoute(*router.Route) error { return nil }
+func (r *fakeRouter) SetRoute(route *router.Route) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, exists := r.routes[route.ID]; !exists {
+		return routerc.ErrNotFound
+	}
+	r.routes[route.ID] = route
+	return nil
+}
 
 type sortedRoutes []*router.Route
 
@@ -77,6 +87,10 @@ func (r *fakeRouter) ListRoutes(parentRef string) ([]*router.Route, error) {
 	return routes, nil
 }
 
+func (r *fakeRouter) StreamEvents(output chan<- *router.Event) (stream.Stream, error) {
+	return nil, errors.New("fakeRouter: StreamEvents not implemented")
+}
+
 func (r *fakeRouter) Close() error { return nil }
 
 func (s *S) createTestRoute(c *C, appID string, in *router.Route) *router.Route {
@@ -120,3 +134,27 @@ func (s *S) TestListRoutes(c *C) {
 	c.Assert(routes[1].ID, Equals, route0.ID)
 	c.Assert(routes[0].ID, Equals, route1.ID)
 }
+
+func (s *S) TestAppMaintenance(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "maintenance-app"})
+	route := s.createTestRoute(c, app.ID, (&router.HTTPRoute{Service: "foo", Domain: "maintenance.example.com"}).ToRoute())
+	c.Assert(route.HTTPRoute().Maintenance, Equals, false)
+
+	app.Maintenance = true
+	c.Assert(s.c.UpdateApp(app), IsNil)
+	c.Assert(app.Maintenance, Equals, true)
+
+	gotRoute, err := s.c.GetRoute(app.ID, route.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotRoute.HTTPRoute().Maintenance, Equals, true)
+
+	// routes created while in maintenance mode have it set
+	route = s.createTestRoute(c, app.ID, (&router.HTTPRoute{Service: "foo", Domain: "maintenance2.example.com"}).ToRoute())
+	c.Assert(route.HTTPRoute().Maintenance, Equals, true)
+
+	app.Maintenance = false
+	c.Assert(s.c.UpdateApp(app), IsNil)
+	gotRoute, err = s.c.GetRoute(app.ID, route.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotRoute.HTTPRoute().Maintenance, Equals, false)
+}
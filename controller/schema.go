@@ -185,5 +185,8 @@ $$ LANGUAGE plpgsql`,
     CONSTRAINT que_jobs_pkey PRIMARY KEY (queue, priority, run_at, job_id))`,
 		`COMMENT ON TABLE que_jobs IS '3'`,
 	)
+	m.Add(3,
+		`ALTER TABLE apps ADD COLUMN maintenance bool NOT NULL DEFAULT false`,
+	)
 	return m.Migrate(db)
 }
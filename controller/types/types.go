@@ -15,13 +15,14 @@ type ExpandedFormation struct {
 }
 
 type App struct {
-	ID        string            `json:"id,omitempty"`
-	Name      string            `json:"name,omitempty"`
-	Protected bool              `json:"protected"`
-	Meta      map[string]string `json:"meta,omitempty"`
-	Strategy  string            `json:"strategy,omitempty"`
-	CreatedAt *time.Time        `json:"created_at,omitempty"`
-	UpdatedAt *time.Time        `json:"updated_at,omitempty"`
+	ID          string            `json:"id,omitempty"`
+	Name        string            `json:"name,omitempty"`
+	Protected   bool              `json:"protected"`
+	Maintenance bool              `json:"maintenance"`
+	Meta        map[string]string `json:"meta,omitempty"`
+	Strategy    string            `json:"strategy,omitempty"`
+	CreatedAt   *time.Time        `json:"created_at,omitempty"`
+	UpdatedAt   *time.Time        `json:"updated_at,omitempty"`
 }
 
 type Release struct {
@@ -40,6 +41,24 @@ type ProcessType struct {
 	Data        bool              `json:"data,omitempty"`
 	Omni        bool              `json:"omni,omitempty"` // omnipresent - present on all hosts
 	HostNetwork bool              `json:"host_network,omitempty"`
+	HealthCheck *HealthCheck      `json:"health_check,omitempty"`
+}
+
+// HealthCheck configures a check that must pass before a process is
+// registered in service discovery. Processes are unregistered if the check
+// starts failing, and registered again once it recovers.
+type HealthCheck struct {
+	// Type is either "tcp" or "http".
+	Type string `json:"type"`
+	// Port is the port to check, it defaults to the registered $PORT.
+	Port int `json:"port,omitempty"`
+	// Path is the path requested by HTTP checks, it defaults to "/".
+	Path string `json:"path,omitempty"`
+	// Interval is the number of seconds between checks.
+	Interval int `json:"interval,omitempty"`
+	// Threshold is the number of consecutive checks with the same result
+	// needed before the process is registered or unregistered.
+	Threshold int `json:"threshold,omitempty"`
 }
 
 type Port struct {
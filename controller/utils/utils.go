@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"strconv"
+
 	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/host/types"
 )
@@ -45,5 +47,21 @@ func JobConfig(f *ct.ExpandedFormation, name string) *host.Job {
 	if t.Data {
 		job.Config.Mounts = []host.Mount{{Location: "/data", Writeable: true}}
 	}
+	if c := t.HealthCheck; c != nil {
+		// these are read by sdutil exec, which registers the process
+		env["SD_CHECK_TYPE"] = c.Type
+		if c.Port > 0 {
+			env["SD_CHECK_PORT"] = strconv.Itoa(c.Port)
+		}
+		if c.Path != "" {
+			env["SD_CHECK_PATH"] = c.Path
+		}
+		if c.Interval > 0 {
+			env["SD_CHECK_INTERVAL"] = strconv.Itoa(c.Interval) + "s"
+		}
+		if c.Threshold > 0 {
+			env["SD_CHECK_THRESHOLD"] = strconv.Itoa(c.Threshold)
+		}
+	}
 	return job
 }
@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type S struct{}
+
+var _ = Suite(&S{})
+
+func formation(t ct.ProcessType) *ct.ExpandedFormation {
+	return &ct.ExpandedFormation{
+		App:      &ct.App{ID: "app-id", Name: "app"},
+		Release:  &ct.Release{ID: "release-id", Processes: map[string]ct.ProcessType{"web": t}},
+		Artifact: &ct.Artifact{Type: "docker", URI: "http://example.com"},
+	}
+}
+
+func (S) TestJobConfigHealthCheck(c *C) {
+	// process types without a health check don't get SD_CHECK_* variables
+	job := JobConfig(formation(ct.ProcessType{}), "web")
+	for k := range job.Config.Env {
+		c.Assert(strings.HasPrefix(k, "SD_CHECK_"), Equals, false, Commentf("key = %s", k))
+	}
+
+	job = JobConfig(formation(ct.ProcessType{HealthCheck: &ct.HealthCheck{Type: "tcp"}}), "web")
+	c.Assert(job.Config.Env["SD_CHECK_TYPE"], Equals, "tcp")
+	for _, k := range []string{"SD_CHECK_PORT", "SD_CHECK_PATH", "SD_CHECK_INTERVAL", "SD_CHECK_THRESHOLD"} {
+		_, ok := job.Config.Env[k]
+		c.Assert(ok, Equals, false, Commentf("key = %s", k))
+	}
+
+	job = JobConfig(formation(ct.ProcessType{HealthCheck: &ct.HealthCheck{
+		Type:      "http",
+		Port:      8080,
+		Path:      "/status",
+		Interval:  5,
+		Threshold: 3,
+	}}), "web")
+	c.Assert(job.Config.Env["SD_CHECK_TYPE"], Equals, "http")
+	c.Assert(job.Config.Env["SD_CHECK_PORT"], Equals, "8080")
+	c.Assert(job.Config.Env["SD_CHECK_PATH"], Equals, "/status")
+	c.Assert(job.Config.Env["SD_CHECK_INTERVAL"], Equals, "5s")
+	c.Assert(job.Config.Env["SD_CHECK_THRESHOLD"], Equals, "3")
+}
@@ -0,0 +1,306 @@
+package discoverd
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flynn/flynn/pkg/stream"
+)
+
+// BalanceMode is how a Balancer picks instances.
+type BalanceMode int
+
+const (
+	// BalanceRoundRobin picks each instance of the service in turn, skipping
+	// draining instances.
+	BalanceRoundRobin BalanceMode = iota
+
+	// BalanceLeader only picks the leader of the service.
+	BalanceLeader
+)
+
+var ErrNoInstances = errors.New("discoverd: no instances available")
+
+// Balancer picks instances of a service using a watch to keep track of the
+// instances, and connects to them with failover.
+type Balancer struct {
+	// next is first to keep it 64-bit aligned for atomic operations
+	next uint64
+
+	// Attempts is the number of instances Dial and RoundTrip try before
+	// failing, it defaults to 5.
+	Attempts int
+
+	// Backoff is the delay after the first failed attempt, it doubles after
+	// each failed attempt up to MaxBackoff. They default to 100ms and 2s.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// DialTimeout is the timeout for each connection attempt made by Dial, it
+	// defaults to 5s.
+	DialTimeout time.Duration
+
+	// Transport is used by RoundTrip to make requests, it defaults to
+	// http.DefaultTransport.
+	Transport http.RoundTripper
+
+	mode    BalanceMode
+	service Service
+
+	mtx       sync.RWMutex
+	instances []*Instance
+	leader    *Instance
+	stream    stream.Stream
+	stop      chan struct{}
+}
+
+// NewBalancer returns a Balancer for service, it returns once the current
+// instances of the service are known.
+func (c *Client) NewBalancer(service string, mode BalanceMode) (*Balancer, error) {
+	b := &Balancer{
+		mode:    mode,
+		service: c.Service(service),
+		stop:    make(chan struct{}),
+	}
+	current := make(chan error)
+	go b.watch(current)
+	if err := <-current; err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Close stops watching the service.
+func (b *Balancer) Close() error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	select {
+	case <-b.stop:
+		return nil
+	default:
+	}
+	close(b.stop)
+	if b.stream != nil {
+		b.stream.Close()
+	}
+	return nil
+}
+
+const balancerRetryInterval = time.Second
+
+// watch keeps the instances up to date until the balancer is closed. If the
+// watch fails, the last known instances are used until it is reconnected.
+func (b *Balancer) watch(current chan error) {
+	for {
+		events := make(chan *Event)
+		s, err := b.service.Watch(events)
+		if err == nil && b.setStream(s) {
+			if b.apply(events, current) {
+				current = nil
+			}
+			err = s.Err()
+		}
+		if current != nil {
+			// the initial watch failed
+			if err == nil {
+				err = errors.New("discoverd: watch closed before receiving the current instances")
+			}
+			current <- err
+			return
+		}
+		select {
+		case <-b.stop:
+			return
+		case <-time.After(balancerRetryInterval):
+		}
+	}
+}
+
+// setStream sets the watch stream so that it is closed by Close, it returns
+// false if the balancer has already been closed.
+func (b *Balancer) setStream(s stream.Stream) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	select {
+	case <-b.stop:
+		s.Close()
+		return false
+	default:
+	}
+	b.stream = s
+	return true
+}
+
+// apply updates the instances from watch events, the events before the
+// current event replace the known instances. It sends nil to current once the
+// current instances have been set if current is not nil, and returns whether
+// the current event was received.
+func (b *Balancer) apply(events chan *Event, current chan error) bool {
+	instances := make(map[string]*Instance)
+	var leader *Instance
+	synced := false
+	for e := range events {
+		switch e.Kind {
+		case EventKindUp, EventKindUpdate:
+			instances[e.Instance.ID] = e.Instance
+		case EventKindDown:
+			delete(instances, e.Instance.ID)
+		case EventKindLeader:
+			leader = e.Instance
+		case EventKindCurrent:
+			synced = true
+		}
+		if !synced {
+			continue
+		}
+		b.set(instances, leader)
+		if current != nil {
+			current <- nil
+			current = nil
+		}
+	}
+	return synced
+}
+
+func (b *Balancer) set(instances map[string]*Instance, leader *Instance) {
+	list := make([]*Instance, 0, len(instances))
+	for _, inst := range instances {
+		if !inst.Draining {
+			list = append(list, inst)
+		}
+	}
+	sort.Sort(instancesByIndex(list))
+	if leader != nil {
+		// the leader may have been updated or removed since it was elected
+		leader = instances[leader.ID]
+	}
+
+	b.mtx.Lock()
+	b.instances = list
+	b.leader = leader
+	b.mtx.Unlock()
+}
+
+type instancesByIndex []*Instance
+
+func (p instancesByIndex) Len() int           { return len(p) }
+func (p instancesByIndex) Less(i, j int) bool { return p[i].Index < p[j].Index }
+func (p instancesByIndex) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// Instances returns the instances that are picked from in round robin mode.
+func (b *Balancer) Instances() []*Instance {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	res := make([]*Instance, len(b.instances))
+	copy(res, b.instances)
+	return res
+}
+
+// Pick returns the next instance to use.
+func (b *Balancer) Pick() (*Instance, error) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	if b.mode == BalanceLeader {
+		if b.leader == nil {
+			return nil, ErrNoInstances
+		}
+		return b.leader, nil
+	}
+	if len(b.instances) == 0 {
+		return nil, ErrNoInstances
+	}
+	n := atomic.AddUint64(&b.next, 1) - 1
+	return b.instances[n%uint64(len(b.instances))], nil
+}
+
+// try calls f with picked instances until it succeeds or has been called
+// attempts times, backing off between attempts.
+func (b *Balancer) try(attempts int, f func(*Instance) error) error {
+	delay := b.Backoff
+	if delay == 0 {
+		delay = 100 * time.Millisecond
+	}
+	maxDelay := b.MaxBackoff
+	if maxDelay == 0 {
+		maxDelay = 2 * time.Second
+	}
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(delay)
+			if delay *= 2; delay > maxDelay {
+				delay = maxDelay
+			}
+		}
+		var inst *Instance
+		if inst, err = b.Pick(); err != nil {
+			continue
+		}
+		if err = f(inst); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (b *Balancer) attempts() int {
+	if b.Attempts > 0 {
+		return b.Attempts
+	}
+	return 5
+}
+
+// Dial connects to an instance of the service, failing over to other
+// instances if the connection fails. addr is ignored so that Dial can be used
+// as the dial function of an http.Transport or database driver.
+func (b *Balancer) Dial(network, addr string) (net.Conn, error) {
+	timeout := b.DialTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	var conn net.Conn
+	err := b.try(b.attempts(), func(inst *Instance) (err error) {
+		conn, err = net.DialTimeout(network, inst.Addr, timeout)
+		return
+	})
+	return conn, err
+}
+
+// RoundTrip implements http.RoundTripper by sending req to an instance of the
+// service, failing over to other instances if the request fails. Requests
+// with a body or with a method which is not idempotent are only attempted
+// once, as the body can't be sent again and a failed request may already
+// have been processed.
+func (b *Balancer) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := b.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	attempts := b.attempts()
+	if req.Body != nil || !isIdempotent(req.Method) {
+		attempts = 1
+	}
+	var res *http.Response
+	err := b.try(attempts, func(inst *Instance) (err error) {
+		r := *req
+		u := *req.URL
+		u.Host = inst.Addr
+		r.URL = &u
+		res, err = transport.RoundTrip(&r)
+		return
+	})
+	return res, err
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "", "GET", "HEAD", "OPTIONS", "PUT":
+		return true
+	}
+	return false
+}
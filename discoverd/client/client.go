@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -16,32 +17,51 @@ import (
 type Service interface {
 	Leader() (*Instance, error)
 	Instances() ([]*Instance, error)
+	InstancesWithMeta(meta map[string]string) ([]*Instance, error)
 	Addrs() ([]string, error)
 	Leaders(chan *Instance) (stream.Stream, error)
 	Watch(events chan *Event) (stream.Stream, error)
+	GetConfig() (*ServiceConfig, error)
+	SetConfig(config *ServiceConfig) error
+	SetLeader(id string) error
 }
 
 var ErrTimedOut = errors.New("discoverd: timed out waiting for instances")
 
 type Client struct {
 	c *httpclient.Client
+
+	// HeartbeatInterval is the interval between heartbeats of instances
+	// registered by the client. Zero, or an interval which is not less
+	// than the TTL of the instance, means half the TTL is used.
+	HeartbeatInterval time.Duration
 }
 
+// NewClient returns a client for the discoverd at $DISCOVERD, using the key in
+// $DISCOVERD_KEY if it is set.
 func NewClient() *Client {
 	url := os.Getenv("DISCOVERD")
 	if url == "" {
 		url = "http://127.0.0.1:1111"
 	}
-	return NewClientWithURL(url)
+	return NewClientWithKey(url, os.Getenv("DISCOVERD_KEY"))
 }
 
 func NewClientWithURL(url string) *Client {
+	return NewClientWithKey(url, "")
+}
+
+// NewClientWithKey returns a client which authenticates with key, which is
+// either a service key returned by AddServiceWithKey or the platform key
+// required to change reserved flynn-* services.
+func NewClientWithKey(url, key string) *Client {
 	if !strings.HasPrefix(url, "http") {
 		url = "http://" + url
 	}
 	return &Client{
 		c: &httpclient.Client{
 			URL:  url,
+			Key:  key,
 			HTTP: http.DefaultClient,
 		},
 	}
@@ -51,8 +71,21 @@ func (c *Client) Ping() error {
 	return c.c.Get("/ping", nil)
 }
 
-func (c *Client) AddService(name string) error {
-	return c.c.Put("/services/"+name, nil, nil)
+// AddService creates a service, config may be nil to use the defaults.
+func (c *Client) AddService(name string, config *ServiceConfig) error {
+	return c.c.Put("/services/"+name, config, nil)
+}
+
+// AddServiceWithKey creates a service which can only be changed by clients
+// with the key generated by the server, which is returned. The key should be
+// shared with the processes that register instances of the service, for
+// example in their environment as DISCOVERD_KEY.
+func (c *Client) AddServiceWithKey(name string, config *ServiceConfig) (string, error) {
+	var res ServiceKey
+	if err := c.c.Put("/services/"+name+"?generate_key=true", config, &res); err != nil {
+		return "", err
+	}
+	return res.Key, nil
 }
 
 func (c *Client) RemoveService(name string) error {
@@ -63,11 +96,30 @@ func (c *Client) Service(name string) Service {
 	return newService(c, name)
 }
 
+// Services returns the names of all services.
+func (c *Client) Services() ([]string, error) {
+	var res []string
+	return res, c.c.Get("/services", &res)
+}
+
+// WatchAll sends the events of all services to events, starting with the
+// current instances and leaders of each service.
+func (c *Client) WatchAll(events chan *Event) (stream.Stream, error) {
+	return c.c.Stream("GET", "/services", nil, events)
+}
+
 func IsNotFound(err error) bool {
 	je, ok := err.(hh.JSONError)
 	return ok && je.Code == hh.ObjectNotFoundError
 }
 
+// IsUnauthorized returns whether err is the result of changing a service
+// without its key.
+func IsUnauthorized(err error) bool {
+	je, ok := err.(hh.JSONError)
+	return ok && je.Code == hh.UnauthorizedError
+}
+
 func (c *Client) Instances(service string, timeout time.Duration) ([]*Instance, error) {
 	s := c.Service(service)
 	instances, err := s.Instances()
@@ -111,6 +163,40 @@ outer:
 	}
 }
 
+// WaitForInstance returns the first instance of service that is registered or
+// updated with all of the key/value pairs in meta. A zero timeout waits
+// indefinitely.
+func (c *Client) WaitForInstance(service string, meta map[string]string, timeout time.Duration) (*Instance, error) {
+	events := make(chan *Event)
+	stream, err := c.Service(service).Watch(events)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timeoutCh = time.After(timeout)
+	}
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				if err := stream.Err(); err != nil {
+					return nil, err
+				}
+				return nil, errors.New("discoverd: watch stream closed")
+			}
+			if event.Kind&(EventKindUp|EventKindUpdate) == 0 || !event.Instance.MatchesMeta(meta) {
+				continue
+			}
+			return event.Instance, nil
+		case <-timeoutCh:
+			return nil, ErrTimedOut
+		}
+	}
+}
+
 type service struct {
 	client *Client
 	name   string
@@ -128,11 +214,38 @@ func (s *service) Leader() (*Instance, error) {
 	return res, s.client.c.Get(fmt.Sprintf("/services/%s/leader", s.name), res)
 }
 
+// SetLeader makes the instance with the given ID the leader of a service using
+// LeaderTypeManual. The leader is stored for other leader types but only takes
+// effect once the service uses LeaderTypeManual.
+func (s *service) SetLeader(id string) error {
+	return s.client.c.Put(fmt.Sprintf("/services/%s/leader", s.name), &Instance{ID: id}, nil)
+}
+
+func (s *service) GetConfig() (*ServiceConfig, error) {
+	res := &ServiceConfig{}
+	return res, s.client.c.Get(fmt.Sprintf("/services/%s/config", s.name), res)
+}
+
+func (s *service) SetConfig(config *ServiceConfig) error {
+	return s.client.c.Put(fmt.Sprintf("/services/%s/config", s.name), config, nil)
+}
+
 func (s *service) Instances() ([]*Instance, error) {
 	var res []*Instance
 	return res, s.client.c.Get(fmt.Sprintf("/services/%s/instances", s.name), &res)
 }
 
+// InstancesWithMeta returns the instances which have all of the key/value
+// pairs in meta set in their metadata.
+func (s *service) InstancesWithMeta(meta map[string]string) ([]*Instance, error) {
+	q := make(url.Values, len(meta))
+	for k, v := range meta {
+		q.Set("meta."+k, v)
+	}
+	var res []*Instance
+	return res, s.client.c.Get(fmt.Sprintf("/services/%s/instances?%s", s.name, q.Encode()), &res)
+}
+
 func (s *service) Addrs() ([]string, error) {
 	instances, err := s.Instances()
 	if err != nil {
@@ -12,12 +12,16 @@ import (
 
 type Heartbeater interface {
 	SetMeta(map[string]string) error
+	// Drain marks the instance as draining so that it stops receiving new
+	// connections, it stays registered until Close is called.
+	Drain() error
 	Close() error
 	Addr() string
+	ID() string
 }
 
 func (c *Client) maybeAddService(service string) error {
-	if err := c.AddService(service); err != nil {
+	if err := c.AddService(service, nil); err != nil {
 		if je, ok := err.(hh.JSONError); !ok || je.Code != hh.ObjectExistsError {
 			return err
 		}
@@ -89,19 +93,48 @@ func (h *heartbeater) SetMeta(meta map[string]string) error {
 	return h.c.c.Put(fmt.Sprintf("/services/%s/instances/%s", h.service, h.inst.ID), h.inst, nil)
 }
 
+func (h *heartbeater) Drain() error {
+	h.Lock()
+	defer h.Unlock()
+	h.inst.Draining = true
+	return h.c.c.Put(fmt.Sprintf("/services/%s/instances/%s", h.service, h.inst.ID), h.inst, nil)
+}
+
 func (h *heartbeater) Addr() string {
 	return h.inst.Addr
 }
 
-const heartbeatInterval = 5 * time.Second
+func (h *heartbeater) ID() string {
+	return h.inst.ID
+}
+
+// defaultTTL is used to pick the heartbeat interval if the server does not
+// return the TTL of the instance.
+const defaultTTL = 10
+
+// heartbeatInterval returns the interval to heartbeat an instance with the
+// given TTL in seconds at.
+func (h *heartbeater) heartbeatInterval(ttl int) time.Duration {
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+	max := time.Duration(ttl) * time.Second
+	if i := h.c.HeartbeatInterval; i > 0 && i < max {
+		return i
+	}
+	return max / 2
+}
 
 func (h *heartbeater) run(firstErr chan<- error) {
 	h.inst.ID = h.inst.id()
 	path := fmt.Sprintf("/services/%s/instances/%s", h.service, h.inst.ID)
+	// the server responds with the effective TTL of the instance, which may
+	// come from the service config
+	var res Instance
 	register := func() error {
 		h.Lock()
 		defer h.Unlock()
-		return h.c.c.Put(path, h.inst, nil)
+		return h.c.c.Put(path, h.inst, &res)
 	}
 
 	err := register()
@@ -109,14 +142,22 @@ func (h *heartbeater) run(firstErr chan<- error) {
 	if err != nil {
 		return
 	}
-	ticker := time.NewTicker(heartbeatInterval)
+	interval := h.heartbeatInterval(res.TTL)
+	ticker := time.NewTicker(interval)
 	for {
 		select {
 		case <-ticker.C:
 			if err := register(); err != nil {
 				log.Printf("discoverd: heartbeat %s (%s) failed: %s", h.service, h.inst.Addr, err)
+				continue
+			}
+			if i := h.heartbeatInterval(res.TTL); i != interval {
+				interval = i
+				ticker.Stop()
+				ticker = time.NewTicker(interval)
 			}
 		case <-h.stop:
+			ticker.Stop()
 			h.c.c.Delete(path)
 			close(h.done)
 			return
@@ -73,6 +73,61 @@ func (e *Event) String() string {
 	return fmt.Sprintf("[%s] %s %#v", e.Service, e.Kind, e.Instance)
 }
 
+// ServiceConfig is the configuration of a service, set when the service is
+// added or with Service.SetConfig.
+type ServiceConfig struct {
+	// TTL is the number of seconds instances of the service stay registered
+	// without a heartbeat, unless the instance sets its own TTL. Heartbeats
+	// are sent every TTL/2 seconds unless Client.HeartbeatInterval is set.
+	// Zero means the default of 10 seconds.
+	TTL int `json:"ttl,omitempty"`
+
+	// LeaderType is how the leader of the service is elected, it defaults to
+	// LeaderTypeOldest.
+	LeaderType LeaderType `json:"leader_type,omitempty"`
+
+	// StickyLeader keeps the current leader while it is registered, even if
+	// an older instance is registered. It only applies to LeaderTypeOldest.
+	StickyLeader bool `json:"sticky_leader,omitempty"`
+
+	// KeyHash is the hex encoded SHA-256 hash of the key required to change
+	// the service and its instances. It is set by the server when the service
+	// is created with AddServiceWithKey, services created without a key can
+	// be changed by any client.
+	KeyHash string `json:"key_hash,omitempty"`
+}
+
+// ServiceKey is the response to creating a service with a generated key.
+type ServiceKey struct {
+	Key string `json:"key"`
+}
+
+func (c *ServiceConfig) Valid() error {
+	if c.TTL < 0 {
+		return ErrInvalidTTL
+	}
+	switch c.LeaderType {
+	case "", LeaderTypeOldest, LeaderTypeManual, LeaderTypeNone:
+	default:
+		return ErrInvalidLeaderType
+	}
+	return nil
+}
+
+type LeaderType string
+
+const (
+	// LeaderTypeOldest elects the oldest registered instance as leader.
+	LeaderTypeOldest LeaderType = "oldest"
+
+	// LeaderTypeManual elects the instance set with Service.SetLeader, the
+	// service has no leader while that instance is not registered.
+	LeaderTypeManual LeaderType = "manual"
+
+	// LeaderTypeNone disables leader election.
+	LeaderTypeNone LeaderType = "none"
+)
+
 // Instance is a single running instance of a service. It is immutable after it
 // has been initialized.
 type Instance struct {
@@ -91,6 +146,25 @@ type Instance struct {
 	// Meta is arbitrary metadata specified when registering the instance.
 	Meta map[string]string `json:"meta,omitempty"`
 
+	// Weight is the relative share of traffic the instance should receive
+	// compared to other instances with the same priority. It is used for
+	// ordering DNS answers and as the SRV weight. Zero means the default
+	// weight of 1.
+	Weight int `json:"weight,omitempty"`
+
+	// Priority is the SRV priority of the instance, lower values are
+	// preferred. Zero means the default priority of 1.
+	Priority int `json:"priority,omitempty"`
+
+	// TTL is the number of seconds the instance stays registered without a
+	// heartbeat. Zero means the service's TTL is used.
+	TTL int `json:"ttl,omitempty"`
+
+	// Draining is set by instances that are about to unregister. Draining
+	// instances are still registered, but are not returned from DNS lookups
+	// and do not receive new connections from routers.
+	Draining bool `json:"draining,omitempty"`
+
 	// Index is the logical epoch of the initial registration of the instance.
 	// It is guaranteed to be unique, greater than zero, not change as long as
 	// the instance does not expire, and sort with other indexes in the order of
@@ -106,9 +180,23 @@ type Instance struct {
 func (inst *Instance) Equal(other *Instance) bool {
 	return inst.Addr == other.Addr &&
 		inst.Proto == other.Proto &&
+		inst.Weight == other.Weight &&
+		inst.Priority == other.Priority &&
+		inst.Draining == other.Draining &&
 		mapEqual(inst.Meta, other.Meta)
 }
 
+// MatchesMeta returns true if the instance has all of the key/value pairs in
+// meta set in its metadata.
+func (inst *Instance) MatchesMeta(meta map[string]string) bool {
+	for k, v := range meta {
+		if iv, ok := inst.Meta[k]; !ok || iv != v {
+			return false
+		}
+	}
+	return true
+}
+
 func (inst *Instance) Valid() error {
 	if err := inst.validProto(); err != nil {
 		return err
@@ -116,6 +204,15 @@ func (inst *Instance) Valid() error {
 	if _, _, err := net.SplitHostPort(inst.Addr); err != nil {
 		return err
 	}
+	if inst.Weight < 0 || inst.Weight > maxSRVValue {
+		return ErrInvalidWeight
+	}
+	if inst.Priority < 0 || inst.Priority > maxSRVValue {
+		return ErrInvalidPriority
+	}
+	if inst.TTL < 0 {
+		return ErrInvalidTTL
+	}
 	if expected := inst.id(); inst.ID != expected {
 		return fmt.Errorf("discoverd: instance id is incorrect, expected %s", expected)
 	}
@@ -140,6 +237,13 @@ func (inst *Instance) splitHostPort() {
 
 var ErrUnsetProto = errors.New("discoverd: proto must be set")
 var ErrInvalidProto = errors.New("discoverd: proto must be lowercase alphanumeric")
+var ErrInvalidWeight = errors.New("discoverd: weight must be between 0 and 65535")
+var ErrInvalidPriority = errors.New("discoverd: priority must be between 0 and 65535")
+var ErrInvalidTTL = errors.New("discoverd: ttl must not be negative")
+var ErrInvalidLeaderType = errors.New("discoverd: leader type must be oldest, manual or none")
+
+// maxSRVValue is the largest weight or priority that fits in an SRV record
+const maxSRVValue = 65535
 
 func (inst *Instance) validProto() error {
 	if inst.Proto == "" {
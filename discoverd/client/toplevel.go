@@ -14,6 +14,10 @@ func GetInstances(service string, timeout time.Duration) ([]*Instance, error) {
 	return DefaultClient.Instances(service, timeout)
 }
 
+func WaitForInstance(service string, meta map[string]string, timeout time.Duration) (*Instance, error) {
+	return DefaultClient.WaitForInstance(service, meta, timeout)
+}
+
 func AddServiceAndRegister(service, addr string) (Heartbeater, error) {
 	return DefaultClient.AddServiceAndRegister(service, addr)
 }
@@ -21,3 +25,7 @@ func AddServiceAndRegister(service, addr string) (Heartbeater, error) {
 func Register(service, addr string) (Heartbeater, error) {
 	return DefaultClient.Register(service, addr)
 }
+
+func NewBalancer(service string, mode BalanceMode) (*Balancer, error) {
+	return DefaultClient.NewBalancer(service, mode)
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
@@ -19,40 +20,66 @@ func main() {
 
 	httpAddr := flag.String("http-addr", ":1111", "address to serve HTTP API from")
 	dnsAddr := flag.String("dns-addr", ":53", "address to service DNS from")
+	dnsCacheSize := flag.Int("dns-cache-size", 1024, "maximum number of recursive DNS responses to cache, zero disables caching")
 	resolvers := flag.String("recursors", "8.8.8.8,8.8.4.4", "upstream recursive DNS servers")
 	etcdAddrs := flag.String("etcd", "http://127.0.0.1:2379", "etcd servers (comma separated)")
+	backendType := flag.String("backend", "etcd", "storage backend (etcd or local)")
+	localPath := flag.String("local-db", "", "path to persist the local backend to, in-memory if empty")
+	peerAddrs := flag.String("peers", "", "peer discoverd servers to mirror services from (comma separated name=url pairs)")
+	peerServices := flag.String("peer-services", "", "services to mirror from each peer (comma separated)")
+	platformKey := flag.String("key", os.Getenv("DISCOVERD_KEY"), "key required to change platform services")
 	flag.Parse()
 
-	etcdClient := etcd.NewClient(strings.Split(*etcdAddrs, ","))
-
-	// Check to make sure that etcd is online and accepting connections
-	// etcd takes a while to come online, so we attempt a GET multiple times
-	err := attempt.Strategy{
-		Min:   5,
-		Total: 10 * time.Minute,
-		Delay: 200 * time.Millisecond,
-	}.Run(func() (err error) {
-		_, err = etcdClient.Get("/", false, false)
-		if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == 100 {
-			// Valid 404 from etcd (> v2.0)
-			err = nil
-		}
-		return
-	})
-	if err != nil {
-		log.Fatalf("Failed to connect to etcd at %v: %q", etcdAddrs, err)
+	if *platformKey == "" {
+		log.Print("No -key set, platform services can be changed by any client")
 	}
 
 	state := server.NewState()
-	backend := server.NewEtcdBackend(etcdClient, "/discoverd", state)
+	var backend server.Backend
+	switch *backendType {
+	case "etcd":
+		backend = newEtcdBackend(*etcdAddrs, state)
+	case "local":
+		var err error
+		backend, err = server.NewLocalBackend(*localPath, state)
+		if err != nil {
+			log.Fatalf("Failed to open local backend: %s", err)
+		}
+	default:
+		log.Fatalf("Unknown backend %q", *backendType)
+	}
 	if err := backend.StartSync(); err != nil {
-		log.Fatalf("Failed to perform initial etcd sync: %s", err)
+		log.Fatalf("Failed to perform initial %s sync: %s", *backendType, err)
+	}
+
+	var peers []*server.Peer
+	if *peerAddrs != "" {
+		if *peerServices == "" {
+			log.Fatal("Missing -peer-services for -peers")
+		}
+		for _, p := range strings.Split(*peerAddrs, ",") {
+			nameURL := strings.SplitN(p, "=", 2)
+			if len(nameURL) != 2 {
+				log.Fatalf("Invalid peer %q, expected name=url", p)
+			}
+			peer, err := server.NewPeer(nameURL[0], nameURL[1], strings.Split(*peerServices, ","))
+			if err != nil {
+				log.Fatalf("Invalid peer name %q: %s", nameURL[0], err)
+			}
+			peer.Start()
+			peers = append(peers, peer)
+		}
+	}
+	store, err := server.NewFederatedStore(server.NewBasicDatastore(state, backend), peers)
+	if err != nil {
+		log.Fatalf("Invalid peers: %s", err)
 	}
 
 	dns := server.DNSServer{
-		UDPAddr: *dnsAddr,
-		TCPAddr: *dnsAddr,
-		Store:   state,
+		UDPAddr:   *dnsAddr,
+		TCPAddr:   *dnsAddr,
+		Store:     store,
+		CacheSize: *dnsCacheSize,
 	}
 	if *resolvers != "" {
 		dns.Recursors = strings.Split(*resolvers, ",")
@@ -66,5 +93,29 @@ func main() {
 		log.Fatalf("Failed to start HTTP listener: %s", err)
 	}
 	log.Printf("discoverd listening for HTTP on %s and DNS on %s", *httpAddr, *dnsAddr)
-	http.Serve(l, server.NewHTTPHandler(server.NewBasicDatastore(state, backend)))
+	http.Serve(l, server.NewHTTPHandler(store, &dns, *platformKey))
+}
+
+func newEtcdBackend(addrs string, state *server.State) server.Backend {
+	etcdClient := etcd.NewClient(strings.Split(addrs, ","))
+
+	// Check to make sure that etcd is online and accepting connections
+	// etcd takes a while to come online, so we attempt a GET multiple times
+	err := attempt.Strategy{
+		Min:   5,
+		Total: 10 * time.Minute,
+		Delay: 200 * time.Millisecond,
+	}.Run(func() (err error) {
+		_, err = etcdClient.Get("/", false, false)
+		if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == 100 {
+			// Valid 404 from etcd (> v2.0)
+			err = nil
+		}
+		return
+	})
+	if err != nil {
+		log.Fatalf("Failed to connect to etcd at %v: %q", addrs, err)
+	}
+
+	return server.NewEtcdBackend(etcdClient, "/discoverd", state)
 }
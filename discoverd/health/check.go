@@ -1,12 +1,18 @@
 package health
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"net/http"
+	"os/exec"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -18,6 +24,9 @@ type Check interface {
 
 var _ Check = &TCPCheck{}
 var _ Check = &HTTPCheck{}
+var _ Check = &ExecCheck{}
+var _ Check = &TLSCheck{}
+var _ Check = &ScriptCheck{}
 
 type TCPCheck struct {
 	Addr    string
@@ -105,3 +114,199 @@ func (c *HTTPCheck) Check() error {
 	}
 	return nil
 }
+
+type ExecCheck struct {
+	// Args is the command and arguments to run, the check passes if it exits
+	// with status zero.
+	Args []string
+
+	Timeout time.Duration
+
+	// Exec runs Args and returns the exit status and output of the command.
+	// It is typically the Exec method of a containerinit Client so that the
+	// command runs inside a job's container. If unset, the command is run
+	// locally.
+	Exec func(args []string, timeout time.Duration) (int, []byte, error)
+}
+
+func (c *ExecCheck) Check() error {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	run := c.Exec
+	if run == nil {
+		run = localExec
+	}
+	status, output, err := run(c.Args, timeout)
+	if err != nil {
+		return err
+	}
+	if status != 0 {
+		return fmt.Errorf("healthcheck: command exited with status %d: %s", status, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+func localExec(args []string, timeout time.Duration) (int, []byte, error) {
+	if len(args) == 0 {
+		return -1, nil, fmt.Errorf("healthcheck: missing command")
+	}
+	var output bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Start(); err != nil {
+		return -1, nil, err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				return status.ExitStatus(), output.Bytes(), nil
+			}
+			return -1, output.Bytes(), err
+		} else if err != nil {
+			return -1, nil, err
+		}
+		return 0, output.Bytes(), nil
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		<-done
+		return -1, nil, fmt.Errorf("healthcheck: command timed out after %s", timeout)
+	}
+}
+
+type TLSCheck struct {
+	Addr string
+
+	// ServerName is used to verify the certificate and for the TLS SNI
+	// extension. It defaults to the host in Addr.
+	ServerName string
+
+	// RootCAs are used to verify the certificate chain, the system roots are
+	// used if it is nil.
+	RootCAs *x509.CertPool
+
+	// SkipVerify disables verification of the certificate chain, so that only
+	// the handshake is checked.
+	SkipVerify bool
+
+	// ExpiryWarning is how long before the certificate expires to start
+	// warning. It defaults to seven days.
+	ExpiryWarning time.Duration
+
+	// Warn is called when the certificate is close to expiring. The check
+	// still passes. It defaults to logging the warning.
+	Warn func(error)
+
+	Timeout time.Duration
+}
+
+const defaultExpiryWarning = 7 * 24 * time.Hour
+
+func (c *TLSCheck) Check() error {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	serverName := c.ServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(c.Addr)
+	}
+	rawConn, err := net.DialTimeout("tcp", c.Addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer rawConn.Close()
+	// the deadline also bounds the handshake, which the dial timeout doesn't
+	rawConn.SetDeadline(time.Now().Add(timeout))
+	conn := tls.Client(rawConn, &tls.Config{
+		ServerName:         serverName,
+		RootCAs:            c.RootCAs,
+		InsecureSkipVerify: c.SkipVerify,
+	})
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return fmt.Errorf("healthcheck: no peer certificates")
+	}
+	cert := certs[0]
+	if time.Now().After(cert.NotAfter) {
+		// only reachable when verification is skipped
+		return fmt.Errorf("healthcheck: certificate expired at %s", cert.NotAfter)
+	}
+	warning := c.ExpiryWarning
+	if warning == 0 {
+		warning = defaultExpiryWarning
+	}
+	if time.Now().Add(warning).After(cert.NotAfter) {
+		warn := c.Warn
+		if warn == nil {
+			warn = func(err error) { log.Println(err) }
+		}
+		warn(fmt.Errorf("healthcheck: certificate for %s expires at %s", serverName, cert.NotAfter))
+	}
+	return nil
+}
+
+// ScriptStep is one step of a ScriptCheck. Send is written as a line if set,
+// then if Expect is set, a line is read which must start with Expect.
+type ScriptStep struct {
+	Send   string
+	Expect string
+}
+
+// ScriptCheck speaks a simple line based protocol, for example sending PING
+// and expecting +PONG from Redis.
+type ScriptCheck struct {
+	Addr    string
+	Steps   []ScriptStep
+	Timeout time.Duration
+
+	// LineEnding is appended to sent lines, it defaults to "\r\n".
+	LineEnding string
+}
+
+func (c *ScriptCheck) Check() error {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	conn, err := net.DialTimeout("tcp", c.Addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	lineEnding := c.LineEnding
+	if lineEnding == "" {
+		lineEnding = "\r\n"
+	}
+	r := bufio.NewReader(conn)
+	for _, step := range c.Steps {
+		if step.Send != "" {
+			if _, err := io.WriteString(conn, step.Send+lineEnding); err != nil {
+				return err
+			}
+		}
+		if step.Expect == "" {
+			continue
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if !strings.HasPrefix(line, step.Expect) {
+			return fmt.Errorf("healthcheck: expected %q, got %q", step.Expect, line)
+		}
+	}
+	return nil
+}
@@ -1,6 +1,9 @@
 package health
 
 import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -9,6 +12,7 @@ import (
 	"time"
 
 	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/pkg/certgen"
 )
 
 // Hook gocheck up to the "go test" runner
@@ -146,3 +150,137 @@ func (CheckSuite) TestHTTPInvalidURL(c *C) {
 	c.Assert(err, NotNil)
 	c.Assert(strings.Contains(err.Error(), "invalid URL escape"), Equals, true, Commentf("err = %s", err))
 }
+
+func (CheckSuite) TestExec(c *C) {
+	err := (&ExecCheck{Args: []string{"true"}}).Check()
+	c.Assert(err, IsNil)
+
+	err = (&ExecCheck{Args: []string{"sh", "-c", "echo not ready; exit 3"}}).Check()
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Equals, "healthcheck: command exited with status 3: not ready")
+
+	err = (&ExecCheck{Args: []string{"sleep", "1"}, Timeout: 10 * time.Millisecond}).Check()
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), "timed out"), Equals, true, Commentf("err = %s", err))
+}
+
+func (CheckSuite) TestExecCustom(c *C) {
+	var args []string
+	err := (&ExecCheck{
+		Args: []string{"pg_isready"},
+		Exec: func(a []string, timeout time.Duration) (int, []byte, error) {
+			args = a
+			return 1, []byte("no response\n"), nil
+		},
+	}).Check()
+	c.Assert(args, DeepEquals, []string{"pg_isready"})
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Equals, "healthcheck: command exited with status 1: no response")
+}
+
+func (CheckSuite) TestTLS(c *C) {
+	ca, err := certgen.Generate(certgen.Params{IsCA: true})
+	c.Assert(err, IsNil)
+	cert, err := certgen.Generate(certgen.Params{Hosts: []string{"127.0.0.1"}, CA: ca})
+	c.Assert(err, IsNil)
+	keyPair, err := tls.X509KeyPair([]byte(cert.PEM), []byte(cert.KeyPEM))
+	c.Assert(err, IsNil)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{keyPair}})
+	c.Assert(err, IsNil)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM([]byte(ca.PEM))
+
+	var warnings []error
+	warn := func(err error) { warnings = append(warnings, err) }
+
+	// verified handshake with a long lived certificate
+	err = (&TLSCheck{Addr: l.Addr().String(), RootCAs: pool, Warn: warn}).Check()
+	c.Assert(err, IsNil)
+	c.Assert(warnings, HasLen, 0)
+
+	// certificates expiring within ExpiryWarning warn but pass
+	err = (&TLSCheck{
+		Addr:          l.Addr().String(),
+		RootCAs:       pool,
+		ExpiryWarning: 10 * 365 * 24 * time.Hour,
+		Warn:          warn,
+	}).Check()
+	c.Assert(err, IsNil)
+	c.Assert(warnings, HasLen, 1)
+	c.Assert(strings.Contains(warnings[0].Error(), "expires at"), Equals, true)
+
+	// unknown authority fails unless verification is skipped
+	err = (&TLSCheck{Addr: l.Addr().String(), Warn: warn}).Check()
+	c.Assert(err, NotNil)
+	err = (&TLSCheck{Addr: l.Addr().String(), SkipVerify: true, Warn: warn}).Check()
+	c.Assert(err, IsNil)
+}
+
+func (CheckSuite) TestTLSNotTLS(c *C) {
+	srv := httptest.NewServer(okHandler)
+	defer srv.Close()
+
+	err := (&TLSCheck{Addr: srv.Listener.Addr().String(), SkipVerify: true}).Check()
+	c.Assert(err, NotNil)
+}
+
+func (CheckSuite) TestScript(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == "PING\r\n" {
+						conn.Write([]byte("+PONG\r\n"))
+					} else {
+						conn.Write([]byte("-ERR unknown command\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+
+	err = (&ScriptCheck{
+		Addr:  l.Addr().String(),
+		Steps: []ScriptStep{{Send: "PING", Expect: "+PONG"}, {Send: "PING", Expect: "+PONG"}},
+	}).Check()
+	c.Assert(err, IsNil)
+
+	err = (&ScriptCheck{
+		Addr:  l.Addr().String(),
+		Steps: []ScriptStep{{Send: "INFO", Expect: "+PONG"}},
+	}).Check()
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Equals, `healthcheck: expected "+PONG", got "-ERR unknown command"`)
+
+	err = (&ScriptCheck{
+		Addr:    l.Addr().String(),
+		Steps:   []ScriptStep{{Expect: "+PONG"}},
+		Timeout: 50 * time.Millisecond,
+	}).Check()
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), "timeout"), Equals, true, Commentf("err = %s", err))
+}
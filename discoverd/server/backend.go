@@ -3,10 +3,15 @@ package server
 import "github.com/flynn/flynn/discoverd/client"
 
 type Backend interface {
-	AddService(service string) error
+	AddService(service string, config *discoverd.ServiceConfig) error
 	RemoveService(service string) error
 	AddInstance(service string, inst *discoverd.Instance) error
 	RemoveInstance(service, id string) error
+	SetServiceConfig(service string, config *discoverd.ServiceConfig) error
+	// ServiceConfig returns the stored config of service, or nil if it has
+	// no config. Unlike the State, it reflects writes as soon as they return.
+	ServiceConfig(service string) (*discoverd.ServiceConfig, error)
+	SetLeader(service, id string) error
 	StartSync() error
 	Close() error
 }
@@ -17,5 +22,23 @@ type SyncHandler interface {
 	AddInstance(service string, inst *discoverd.Instance)
 	RemoveInstance(service, id string)
 	SetService(service string, data []*discoverd.Instance)
+	SetServiceConfig(service string, config *discoverd.ServiceConfig)
+	SetManualLeader(service, id string)
 	ListServices() []string
 }
+
+// defaultTTL is the number of seconds instances stay registered without a
+// heartbeat if neither the instance or service set a TTL.
+const defaultTTL = 10
+
+// instanceTTL returns the TTL in seconds of inst, which is a member of a
+// service with config.
+func instanceTTL(inst *discoverd.Instance, config *discoverd.ServiceConfig) int {
+	if inst.TTL > 0 {
+		return inst.TTL
+	}
+	if config != nil && config.TTL > 0 {
+		return config.TTL
+	}
+	return defaultTTL
+}
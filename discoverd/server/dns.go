@@ -3,6 +3,7 @@ package server
 import (
 	"fmt"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -17,14 +18,24 @@ type DNSStore interface {
 	GetLeader(string) *discoverd.Instance
 }
 
+// peerStore is implemented by stores which serve services mirrored from
+// peers, they are looked up as <service>.<peer>.
+type peerStore interface {
+	IsPeer(string) bool
+}
+
 type DNSServer struct {
 	UDPAddr   string
 	TCPAddr   string
 	Store     DNSStore
 	Domain    string
 	Recursors []string
+	// CacheSize is the maximum number of recursor responses to cache, zero
+	// disables caching.
+	CacheSize int
 
 	servers []*dns.Server
+	cache   *dnsCache
 }
 
 const maxUDPRecords = 3
@@ -40,6 +51,9 @@ func (srv *DNSServer) ListenAndServe() error {
 	if err := srv.validateRecursors(); err != nil {
 		return err
 	}
+	if srv.CacheSize > 0 {
+		srv.cache = newDNSCache(srv.CacheSize)
+	}
 
 	api := dnsAPI{srv}
 	mux := dns.NewServeMux()
@@ -100,6 +114,9 @@ func (srv *DNSServer) validateRecursors() error {
 		_, _, err := net.SplitHostPort(r)
 		if e, ok := err.(*net.AddrError); ok && e.Err == "missing port in address" {
 			r = r + ":53"
+		} else if ip := net.ParseIP(r); ip != nil {
+			// bare IPv6 addresses fail SplitHostPort with "too many colons"
+			r = net.JoinHostPort(ip.String(), "53")
 		} else if err != nil {
 			return fmt.Errorf("discoverd: invalid recursor address %s: %s", r, err)
 		}
@@ -127,18 +144,37 @@ type dnsAPI struct {
 	*DNSServer
 }
 
+// Stats returns the statistics of the recursor cache.
+func (srv *DNSServer) Stats() DNSStats {
+	if srv.cache == nil {
+		return DNSStats{}
+	}
+	return srv.cache.Stats()
+}
+
 func (d dnsAPI) Recurse(w dns.ResponseWriter, req *dns.Msg) {
 	var client dns.Client
 
-	if isTCP(w.RemoteAddr()) {
+	tcp := isTCP(w.RemoteAddr())
+	if tcp {
 		client.Net = "tcp"
 	}
 
+	if d.cache != nil {
+		if res := d.cache.Get(req, tcp); res != nil {
+			w.WriteMsg(res)
+			return
+		}
+	}
+
 	for _, recursor := range d.Recursors {
 		res, _, err := client.Exchange(req, recursor)
 		if err != nil {
 			continue
 		}
+		if d.cache != nil {
+			d.cache.Set(req, res, tcp)
+		}
 		w.WriteMsg(res)
 		return
 	}
@@ -175,9 +211,18 @@ func (d dnsAPI) ServiceLookup(w dns.ResponseWriter, req *dns.Msg) {
 
 	nxdomain := func() { res.SetRcode(req, dns.RcodeNameError) }
 
+	// lookups of peer services have the peer name after the usual labels,
+	// e.g. leader.pg.peer-east
+	var peer string
+	if ps, ok := d.Store.(peerStore); ok && len(labels) > 1 && ps.IsPeer(labels[len(labels)-1]) {
+		peer = labels[len(labels)-1]
+		labels = labels[:len(labels)-1]
+	}
+
 	var service string
 	var proto string
 	var instanceID string
+	var metaKey, metaValue string
 	var leader bool
 	switch {
 	case len(labels) == 1:
@@ -191,6 +236,11 @@ func (d dnsAPI) ServiceLookup(w dns.ResponseWriter, req *dns.Msg) {
 		// address lookup for instance in RFC 2782 SRV record
 		service = labels[1]
 		instanceID = labels[0]
+	case len(labels) == 4 && labels[3] == "_m":
+		// metadata filtered lookup looks like up.true.postgres._m
+		metaKey = labels[0]
+		metaValue = labels[1]
+		service = labels[2]
 	case len(labels) == 2 && labels[0] == "leader":
 		// leader lookup
 		leader = true
@@ -199,6 +249,9 @@ func (d dnsAPI) ServiceLookup(w dns.ResponseWriter, req *dns.Msg) {
 		nxdomain()
 		return
 	}
+	if peer != "" {
+		service += "." + peer
+	}
 
 	var instances []*discoverd.Instance
 	if !leader {
@@ -228,6 +281,10 @@ func (d dnsAPI) ServiceLookup(w dns.ResponseWriter, req *dns.Msg) {
 		}
 
 		addr := parseAddr(resInst)
+		if addr == nil {
+			// the instance address is not an IP, so there is nothing to return
+			return
+		}
 		if qType != dns.TypeA && qType != dns.TypeAAAA && qType != dns.TypeANY && qType != dns.TypeSRV ||
 			addr.IPv4 == nil && qType == dns.TypeA ||
 			addr.IPv6 == nil && qType == dns.TypeAAAA {
@@ -261,7 +318,17 @@ func (d dnsAPI) ServiceLookup(w dns.ResponseWriter, req *dns.Msg) {
 		if proto != "" && inst.Proto != proto {
 			continue
 		}
+		if metaKey != "" && !matchesDNSMeta(inst, metaKey, metaValue) {
+			continue
+		}
+		if inst.Draining {
+			// draining instances should not get new connections
+			continue
+		}
 		addr := parseAddr(inst)
+		if addr == nil {
+			continue
+		}
 		if _, ok := added[addr.String]; ok {
 			continue
 		}
@@ -279,7 +346,7 @@ func (d dnsAPI) ServiceLookup(w dns.ResponseWriter, req *dns.Msg) {
 		// return empty response
 		return
 	}
-	shuffle(addrs)
+	weightedShuffle(addrs)
 
 	// Truncate the response if we're using UDP
 	if !tcp && len(addrs) > maxUDPRecords {
@@ -330,8 +397,8 @@ func (d dnsAPI) srvRecord(name, service string, addr *addrData, instTarget bool)
 			Rrtype: dns.TypeSRV,
 			Class:  dns.ClassINET,
 		},
-		Priority: 1,
-		Weight:   1,
+		Priority: addr.Priority,
+		Weight:   addr.Weight,
 		Port:     addr.Port,
 		Target:   name,
 	}
@@ -342,6 +409,10 @@ func (d dnsAPI) srvRecord(name, service string, addr *addrData, instTarget bool)
 }
 
 func (d dnsAPI) instanceDomain(service, id string) string {
+	if i := strings.LastIndex(service, "."); i != -1 {
+		// instances of peer services are in the peer namespace
+		return fmt.Sprintf("%s.%s._i.%s.%s", id, service[:i], service[i+1:], d.Domain)
+	}
 	return fmt.Sprintf("%s.%s._i.%s", id, service, d.Domain)
 }
 
@@ -367,35 +438,101 @@ func addrRecord(name string, addr *addrData) dns.RR {
 }
 
 type addrData struct {
-	IPv6   net.IP
-	IPv4   net.IP
-	String string
-	Port   uint16
-	ID     string
+	IPv6     net.IP
+	IPv4     net.IP
+	String   string
+	Port     uint16
+	ID       string
+	Weight   uint16
+	Priority uint16
 }
 
+// parseAddr parses the IP and port of inst, returning nil if the host is not
+// an IP address. IPv6 zones are dropped as they are meaningless to remote
+// resolvers, and IPv4-mapped IPv6 addresses are treated as IPv4.
 func parseAddr(inst *discoverd.Instance) *addrData {
-	res := &addrData{ID: inst.ID}
-	ip, port, _ := net.SplitHostPort(inst.Addr)
-	res.String = ip
+	host, port, err := net.SplitHostPort(inst.Addr)
+	if err != nil {
+		return nil
+	}
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
 	portInt, _ := strconv.Atoi(port)
-	res.Port = uint16(portInt)
-	ipBytes := net.ParseIP(ip)
-	res.IPv4 = ipBytes.To4()
-	if res.IPv4 == nil {
-		res.IPv6 = ipBytes
+	res := &addrData{
+		ID:       inst.ID,
+		String:   ip.String(),
+		Port:     uint16(portInt),
+		Weight:   1,
+		Priority: 1,
+	}
+	if inst.Weight > 0 {
+		res.Weight = uint16(inst.Weight)
+	}
+	if inst.Priority > 0 {
+		res.Priority = uint16(inst.Priority)
+	}
+	if res.IPv4 = ip.To4(); res.IPv4 == nil {
+		res.IPv6 = ip
 	}
 	return res
 }
 
-func shuffle(s []*addrData) []*addrData {
-	for i := len(s) - 1; i > 0; i-- {
-		j := random.Math.Intn(i + 1)
-		s[i], s[j] = s[j], s[i]
+// matchesDNSMeta returns true if inst has the metadata key set to value.
+// DNS names are case insensitive, so the comparison is as well.
+func matchesDNSMeta(inst *discoverd.Instance, key, value string) bool {
+	for k, v := range inst.Meta {
+		if strings.EqualFold(k, key) && strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// weightedShuffle sorts s by priority and then randomly orders the addresses
+// within each priority using the weighted selection described in RFC 2782, so
+// that truncated answers favour preferred and heavier instances.
+func weightedShuffle(s []*addrData) []*addrData {
+	sort.Stable(sortAddrsByPriority(s))
+	for start := 0; start < len(s); {
+		end := start + 1
+		for end < len(s) && s[end].Priority == s[start].Priority {
+			end++
+		}
+		shuffleByWeight(s[start:end])
+		start = end
 	}
 	return s
 }
 
+func shuffleByWeight(s []*addrData) {
+	var total int
+	for _, addr := range s {
+		total += int(addr.Weight)
+	}
+	for i := 0; i < len(s)-1; i++ {
+		n := random.Math.Intn(total)
+		for j := i; j < len(s); j++ {
+			if n < int(s[j].Weight) {
+				s[i], s[j] = s[j], s[i]
+				break
+			}
+			n -= int(s[j].Weight)
+		}
+		total -= int(s[i].Weight)
+	}
+}
+
+type sortAddrsByPriority []*addrData
+
+func (p sortAddrsByPriority) Len() int           { return len(p) }
+func (p sortAddrsByPriority) Less(i, j int) bool { return p[i].Priority < p[j].Priority }
+func (p sortAddrsByPriority) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
 func isTCP(addr net.Addr) bool {
 	_, ok := addr.(*net.TCPAddr)
 	return ok
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/miekg/dns"
+)
+
+// DNSStats are the statistics of the DNS recursor cache.
+type DNSStats struct {
+	CacheHits   uint64 `json:"cache_hits"`
+	CacheMisses uint64 `json:"cache_misses"`
+	CacheSize   int    `json:"cache_size"`
+}
+
+// dnsCache is a LRU cache of recursor responses. Responses are cached for
+// the lowest TTL of their records, and negative responses for the TTL of
+// their SOA record as described in RFC 2308.
+type dnsCache struct {
+	// hits and misses are first to keep them 64-bit aligned for atomic
+	// operations
+	hits   uint64
+	misses uint64
+
+	size int
+
+	mtx     sync.Mutex
+	entries map[dnsCacheKey]*list.Element
+	// lru is ordered by most recently used first
+	lru *list.List
+}
+
+type dnsCacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	// tcp responses are cached separately as they may be too large for UDP
+	tcp bool
+	// edns is set if the request has an OPT record, and udpSize is its UDP
+	// buffer size for UDP requests, so that responses are only sent to
+	// clients which can receive them
+	edns    bool
+	udpSize uint16
+	// responses to requests with the DNSSEC OK or checking disabled bits set
+	// may include DNSSEC records or unvalidated data
+	do bool
+	cd bool
+}
+
+type dnsCacheEntry struct {
+	key     dnsCacheKey
+	msg     *dns.Msg
+	added   time.Time
+	expires time.Time
+}
+
+func newDNSCache(size int) *dnsCache {
+	return &dnsCache{
+		size:    size,
+		entries: make(map[dnsCacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func cacheKey(req *dns.Msg, tcp bool) (dnsCacheKey, bool) {
+	if len(req.Question) != 1 {
+		return dnsCacheKey{}, false
+	}
+	q := req.Question[0]
+	key := dnsCacheKey{
+		name:   strings.ToLower(q.Name),
+		qtype:  q.Qtype,
+		qclass: q.Qclass,
+		tcp:    tcp,
+		cd:     req.CheckingDisabled,
+	}
+	if opt := req.IsEdns0(); opt != nil {
+		key.edns = true
+		key.do = opt.Do()
+		if !tcp {
+			key.udpSize = opt.UDPSize()
+		}
+	}
+	return key, true
+}
+
+// Get returns a cached response to req with the TTLs reduced by the time
+// since the response was cached, or nil if there is no cached response.
+func (c *dnsCache) Get(req *dns.Msg, tcp bool) *dns.Msg {
+	key, ok := cacheKey(req, tcp)
+	if !ok {
+		return nil
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil
+	}
+	entry := el.Value.(*dnsCacheEntry)
+	now := time.Now()
+	if !now.Before(entry.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		atomic.AddUint64(&c.misses, 1)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	atomic.AddUint64(&c.hits, 1)
+
+	res := entry.msg.Copy()
+	res.Id = req.Id
+	// the OPT record is not cached, so respond with one for the request
+	if opt := req.IsEdns0(); opt != nil {
+		res.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	elapsed := uint32(now.Sub(entry.added) / time.Second)
+	for _, rrs := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range rrs {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				// the OPT TTL field contains flags
+				continue
+			}
+			if h.Ttl > elapsed {
+				h.Ttl -= elapsed
+			} else {
+				// negative responses are cached for the SOA TTL which may
+				// be longer than the TTLs of other records
+				h.Ttl = 0
+			}
+		}
+	}
+	return res
+}
+
+// Set caches res if it is cacheable.
+func (c *dnsCache) Set(req, res *dns.Msg, tcp bool) {
+	key, ok := cacheKey(req, tcp)
+	if !ok || res.Truncated {
+		return
+	}
+	ttl, ok := cacheTTL(res)
+	if !ok || ttl == 0 {
+		return
+	}
+	msg := res.Copy()
+	extra := msg.Extra[:0]
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+	now := time.Now()
+	entry := &dnsCacheEntry{
+		key:     key,
+		msg:     msg,
+		added:   now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.entries, el.Value.(*dnsCacheEntry).key)
+	}
+}
+
+// cacheTTL returns the number of seconds res can be cached for, it returns
+// false if res can't be cached.
+func cacheTTL(res *dns.Msg) (uint32, bool) {
+	negative := res.Rcode == dns.RcodeNameError || res.Rcode == dns.RcodeSuccess && len(res.Answer) == 0
+	if negative {
+		// negative responses are cached for the lower of the SOA TTL and
+		// minimum TTL, they can't be cached without a SOA
+		for _, rr := range res.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				if soa.Minttl < soa.Hdr.Ttl {
+					return soa.Minttl, true
+				}
+				return soa.Hdr.Ttl, true
+			}
+		}
+		return 0, false
+	}
+	if res.Rcode != dns.RcodeSuccess {
+		return 0, false
+	}
+
+	var ttl uint32
+	first := true
+	for _, rrs := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range rrs {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				// the OPT TTL field contains flags
+				continue
+			}
+			if first || h.Ttl < ttl {
+				ttl = h.Ttl
+				first = false
+			}
+		}
+	}
+	return ttl, true
+}
+
+func (c *dnsCache) Stats() DNSStats {
+	c.mtx.Lock()
+	size := c.lru.Len()
+	c.mtx.Unlock()
+	return DNSStats{
+		CacheHits:   atomic.LoadUint64(&c.hits),
+		CacheMisses: atomic.LoadUint64(&c.misses),
+		CacheSize:   size,
+	}
+}
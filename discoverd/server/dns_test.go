@@ -3,6 +3,8 @@ package server
 import (
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -11,6 +13,7 @@ import (
 	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/miekg/dns"
 	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/httpclient"
 )
 
 type DNSSuite struct {
@@ -91,6 +94,26 @@ func (s *DNSSuite) TestRecursor(c *C) {
 	}
 }
 
+func (s *DNSSuite) TestValidateRecursors(c *C) {
+	for _, t := range []struct {
+		addr     string
+		expected string
+	}{
+		{"8.8.8.8", "8.8.8.8:53"},
+		{"8.8.8.8:5353", "8.8.8.8:5353"},
+		{"2001:4860:4860::8888", "[2001:4860:4860::8888]:53"},
+		{"[2001:4860:4860::8888]", "[2001:4860:4860::8888]:53"},
+		{"[2001:4860:4860::8888]:5353", "[2001:4860:4860::8888]:5353"},
+	} {
+		srv := &DNSServer{Recursors: []string{t.addr}}
+		c.Assert(srv.validateRecursors(), IsNil)
+		c.Assert(srv.Recursors, DeepEquals, []string{t.expected})
+	}
+
+	srv := &DNSServer{Recursors: []string{"2001:db8::1::1"}}
+	c.Assert(srv.validateRecursors(), NotNil)
+}
+
 func (s *DNSSuite) TestServiceLookup(c *C) {
 	type test struct {
 		name   string
@@ -119,6 +142,23 @@ func (s *DNSSuite) TestServiceLookup(c *C) {
 	copy(v6v4Addrs, simpleAddrs)
 	v6v4Data[0], v6v4Addrs[0] = fakeStaticInstance("tcp", "fe80::bae8:56ff:fe46:243c", 22)
 
+	v6Data := make([]*discoverd.Instance, 3)
+	v6Addrs := make([]testAddr, 3)
+	v6Data[0], v6Addrs[0] = fakeStaticInstance("tcp", "2001:db8::1", 80)
+	v6Data[1], v6Addrs[1] = fakeStaticInstance("tcp", "2001:db8::2", 81)
+	v6Data[2], v6Addrs[2] = fakeStaticInstance("tcp", "fe80::1%eth0", 82)
+
+	v6DupeData := make([]*discoverd.Instance, 3)
+	v6DupeAddrs := make([]testAddr, 3)
+	copy(v6DupeData, v6Data)
+	copy(v6DupeAddrs, v6Addrs)
+	v6DupeData[1], v6DupeAddrs[1] = fakeStaticInstance("tcp", "2001:db8:0:0::1", 85)
+
+	hostData := make([]*discoverd.Instance, 3)
+	copy(hostData, simpleData)
+	hostData[2] = &discoverd.Instance{ID: "host", Proto: "tcp", Addr: "example.com:80"}
+	hostAddrs := simpleAddrs[:2]
+
 	longData := make([]*discoverd.Instance, 5)
 	longAddrs := make([]testAddr, 5)
 	copy(longData, simpleData)
@@ -172,6 +212,30 @@ func (s *DNSSuite) TestServiceLookup(c *C) {
 		dns.TypeSOA:  nil,
 		dns.TypeTXT:  nil,
 	}
+	v6Qs := map[uint16][]testAddr{
+		dns.TypeA:    nil,
+		dns.TypeAAAA: v6Addrs,
+		dns.TypeANY:  v6Addrs,
+		dns.TypeSRV:  v6Addrs,
+		dns.TypeSOA:  nil,
+		dns.TypeTXT:  nil,
+	}
+	v6DupeQs := map[uint16][]testAddr{
+		dns.TypeA:    nil,
+		dns.TypeAAAA: v6DupeAddrs[1:],
+		dns.TypeANY:  v6DupeAddrs[1:],
+		dns.TypeSRV:  v6DupeAddrs,
+		dns.TypeSOA:  nil,
+		dns.TypeTXT:  nil,
+	}
+	hostQs := map[uint16][]testAddr{
+		dns.TypeA:    hostAddrs,
+		dns.TypeAAAA: nil,
+		dns.TypeANY:  hostAddrs,
+		dns.TypeSRV:  hostAddrs,
+		dns.TypeSOA:  nil,
+		dns.TypeTXT:  nil,
+	}
 	instanceQs := map[uint16][]testAddr{
 		dns.TypeA:    simpleAddrs[:1],
 		dns.TypeAAAA: nil,
@@ -303,6 +367,36 @@ func (s *DNSSuite) TestServiceLookup(c *C) {
 			data:   v6v4Data,
 			qs:     v6v4Qs,
 		},
+		{
+			name:   "service v6 only",
+			domain: "a.discoverd.",
+			data:   v6Data,
+			qs:     v6Qs,
+		},
+		{
+			name:   "2782 v6 only",
+			domain: "_a._tcp.discoverd.",
+			data:   v6Data,
+			qs:     v6Qs,
+		},
+		{
+			name:   "service v6 duplicate IPs",
+			domain: "a.discoverd.",
+			data:   v6DupeData,
+			qs:     v6DupeQs,
+		},
+		{
+			name:   "service non-IP address",
+			domain: "a.discoverd.",
+			data:   hostData,
+			qs:     hostQs,
+		},
+		{
+			name:   "non-IP instance",
+			domain: "host.a._i.discoverd.",
+			data:   hostData,
+			qs:     emptyAll,
+		},
 		{
 			name:   "instance",
 			domain: fmt.Sprintf("%s.a._i.discoverd.", simpleData[0].ID),
@@ -538,6 +632,191 @@ func (s *DNSSuite) TestServiceLookup(c *C) {
 	}
 }
 
+func (s *DNSSuite) TestMetaLookup(c *C) {
+	data := make([]*discoverd.Instance, 3)
+	addrs := make([]testAddr, 3)
+	for i := range data {
+		data[i], addrs[i] = fakeStaticInstance("tcp", fmt.Sprintf("192.168.0.%d", i+1), 80)
+	}
+	data[0].Meta = map[string]string{"up": "true"}
+	data[1].Meta = map[string]string{"up": "True", "role": "sync"}
+	data[2].Meta = map[string]string{"up": "false"}
+	s.state.SetService("a", data)
+
+	client := &dns.Client{Net: "tcp"}
+	lookup := func(name string, q uint16) *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion(name, q)
+		res, _, err := client.Exchange(req, s.srv.TCPAddr)
+		c.Assert(err, IsNil)
+		return res
+	}
+
+	// metadata values are matched case insensitively
+	res := lookup("up.true.a._m.discoverd.", dns.TypeA)
+	c.Assert(res.Rcode, Equals, dns.RcodeSuccess)
+	ips := make(map[string]struct{}, len(res.Answer))
+	for _, rr := range res.Answer {
+		ips[rr.(*dns.A).A.String()] = struct{}{}
+	}
+	c.Assert(ips, DeepEquals, map[string]struct{}{
+		addrs[0].IP.String(): {},
+		addrs[1].IP.String(): {},
+	})
+
+	// SRV targets point at the instance domains
+	res = lookup("role.sync.a._m.discoverd.", dns.TypeSRV)
+	c.Assert(res.Answer, HasLen, 1)
+	c.Assert(res.Answer[0].(*dns.SRV).Target, Equals, addrs[1].ID+".a._i.discoverd.")
+	c.Assert(res.Extra, HasLen, 1)
+
+	// no matches returns an empty answer
+	res = lookup("role.async.a._m.discoverd.", dns.TypeA)
+	c.Assert(res.Rcode, Equals, dns.RcodeSuccess)
+	c.Assert(res.Answer, HasLen, 0)
+
+	// unknown services are NXDOMAIN
+	res = lookup("up.true.b._m.discoverd.", dns.TypeA)
+	c.Assert(res.Rcode, Equals, dns.RcodeNameError)
+}
+
+func (s *DNSSuite) TestDrainingLookup(c *C) {
+	data := make([]*discoverd.Instance, 2)
+	addrs := make([]testAddr, 2)
+	for i := range data {
+		data[i], addrs[i] = fakeStaticInstance("tcp", fmt.Sprintf("192.168.0.%d", i+1), 80)
+	}
+	data[1].Draining = true
+	s.state.SetService("a", data)
+
+	client := &dns.Client{Net: "tcp"}
+	lookup := func(name string) *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion(name, dns.TypeA)
+		res, _, err := client.Exchange(req, s.srv.TCPAddr)
+		c.Assert(err, IsNil)
+		return res
+	}
+
+	// draining instances are not returned from service lookups
+	res := lookup("a.discoverd.")
+	c.Assert(res.Answer, HasLen, 1)
+	c.Assert(res.Answer[0].(*dns.A).A.String(), Equals, addrs[0].IP.String())
+
+	// but can still be looked up directly
+	res = lookup(data[1].ID + ".a._i.discoverd.")
+	c.Assert(res.Answer, HasLen, 1)
+	c.Assert(res.Answer[0].(*dns.A).A.String(), Equals, addrs[1].IP.String())
+}
+
+func (s *DNSSuite) TestPeerLookup(c *C) {
+	peer, err := NewPeer("peer-east", "127.0.0.1:0", nil)
+	c.Assert(err, IsNil)
+	s.srv.Store, err = NewFederatedStore(NewBasicDatastore(s.state, nil), []*Peer{peer})
+	c.Assert(err, IsNil)
+
+	data := make([]*discoverd.Instance, 2)
+	addrs := make([]testAddr, 2)
+	for i := range data {
+		data[i], addrs[i] = fakeStaticInstance("tcp", fmt.Sprintf("192.168.1.%d", i+1), 80)
+	}
+	peer.state.SetService("a.peer-east", data)
+	peer.state.SetServiceConfig("a.peer-east", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual})
+	peer.state.SetManualLeader("a.peer-east", data[1].ID)
+
+	client := &dns.Client{Net: "tcp"}
+	lookup := func(name string, q uint16) *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion(name, q)
+		res, _, err := client.Exchange(req, s.srv.TCPAddr)
+		c.Assert(err, IsNil)
+		return res
+	}
+
+	res := lookup("a.peer-east.discoverd.", dns.TypeA)
+	c.Assert(res.Rcode, Equals, dns.RcodeSuccess)
+	c.Assert(res.Answer, HasLen, 2)
+
+	res = lookup("leader.a.peer-east.discoverd.", dns.TypeA)
+	c.Assert(res.Answer, HasLen, 1)
+	c.Assert(res.Answer[0].(*dns.A).A.String(), Equals, addrs[1].IP.String())
+
+	// SRV targets are in the peer namespace
+	res = lookup("_a._tcp.peer-east.discoverd.", dns.TypeSRV)
+	c.Assert(res.Answer, HasLen, 2)
+	target := res.Answer[0].(*dns.SRV).Target
+	c.Assert(strings.HasSuffix(target, ".a._i.peer-east.discoverd."), Equals, true)
+	res = lookup(target, dns.TypeA)
+	c.Assert(res.Answer, HasLen, 1)
+
+	// local services are not affected by peer services with the same name
+	res = lookup("a.discoverd.", dns.TypeA)
+	c.Assert(res.Rcode, Equals, dns.RcodeSuccess)
+	c.Assert(res.Answer, HasLen, 0)
+
+	// unknown peers are NXDOMAIN
+	res = lookup("a.peer-west.discoverd.", dns.TypeA)
+	c.Assert(res.Rcode, Equals, dns.RcodeNameError)
+}
+
+func (s *DNSSuite) TestWeightedLookup(c *C) {
+	data := make([]*discoverd.Instance, 3)
+	for i := range data {
+		data[i], _ = fakeStaticInstance("tcp", fmt.Sprintf("192.168.0.%d", i+1), 80)
+	}
+	data[0].Weight = 10
+	data[1].Weight = 20
+	data[2].Priority = 2
+	s.state.SetService("a", data)
+
+	req := &dns.Msg{}
+	req.SetQuestion("a.discoverd.", dns.TypeSRV)
+	res, _, err := (&dns.Client{Net: "tcp"}).Exchange(req, s.srv.TCPAddr)
+	c.Assert(err, IsNil)
+	c.Assert(res.Answer, HasLen, 3)
+
+	srvs := make(map[string]*dns.SRV, len(res.Answer))
+	for i, rr := range res.Answer {
+		srv := rr.(*dns.SRV)
+		srvs[srv.Target] = srv
+		if i == len(res.Answer)-1 {
+			// the less preferred priority 2 instance is always last
+			c.Assert(srv.Target, Equals, data[2].ID+".a._i.discoverd.")
+		}
+	}
+	for _, t := range []struct {
+		inst     *discoverd.Instance
+		weight   uint16
+		priority uint16
+	}{
+		{data[0], 10, 1},
+		{data[1], 20, 1},
+		{data[2], 1, 2},
+	} {
+		srv, ok := srvs[t.inst.ID+".a._i.discoverd."]
+		c.Assert(ok, Equals, true)
+		c.Assert(srv.Weight, Equals, t.weight)
+		c.Assert(srv.Priority, Equals, t.priority)
+	}
+}
+
+func (DNSSuite) TestWeightedShuffle(c *C) {
+	// addresses are always ordered by priority, and heavier addresses are
+	// more likely to be first within a priority
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		addrs := weightedShuffle([]*addrData{
+			{ID: "a", Weight: 1, Priority: 2},
+			{ID: "b", Weight: 3, Priority: 1},
+			{ID: "c", Weight: 1, Priority: 1},
+		})
+		c.Assert(addrs[2].ID, Equals, "a")
+		counts[addrs[0].ID]++
+	}
+	// b should be first roughly 75% of the time
+	c.Assert(counts["b"] > 650 && counts["b"] < 850, Equals, true, Commentf("b was first %d times", counts["b"]))
+}
+
 func assertSOA(c *C, rrs []dns.RR) {
 	c.Assert(rrs, HasLen, 1)
 	c.Assert(rrs[0], FitsTypeOf, &dns.SOA{})
@@ -555,6 +834,10 @@ func fakeStaticInstance(proto, ip string, port uint16) (*discoverd.Instance, tes
 		Index: atomic.AddUint64(&dnsIndex, 1),
 	}
 	inst.ID = md5sum(inst.Proto + "-" + inst.Addr)
+	if i := strings.LastIndex(ip, "%"); i >= 0 {
+		// the zone is dropped from DNS records
+		ip = ip[:i]
+	}
 	netIP := net.ParseIP(ip)
 	return inst, testAddr{netIP, port, inst.ID}
 }
@@ -564,3 +847,180 @@ type testAddr struct {
 	Port uint16
 	ID   string
 }
+
+func (s *DNSSuite) TestRecursorCache(c *C) {
+	// fake upstream which counts queries
+	var queries int32
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	upstream := &dns.Server{
+		Net:        "udp",
+		PacketConn: l,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			atomic.AddInt32(&queries, 1)
+			res := &dns.Msg{}
+			res.SetReply(req)
+			hdr := func(t uint16, ttl uint32) dns.RR_Header {
+				return dns.RR_Header{Name: req.Question[0].Name, Rrtype: t, Class: dns.ClassINET, Ttl: ttl}
+			}
+			switch req.Question[0].Name {
+			case "a.example.com.", "b.example.com.", "c.example.com.":
+				res.Answer = []dns.RR{&dns.A{Hdr: hdr(dns.TypeA, 60), A: net.IPv4(10, 0, 0, 1)}}
+			case "zero.example.com.":
+				res.Answer = []dns.RR{&dns.A{Hdr: hdr(dns.TypeA, 0), A: net.IPv4(10, 0, 0, 1)}}
+			case "missing.example.com.":
+				res.SetRcode(req, dns.RcodeNameError)
+				res.Ns = []dns.RR{&dns.SOA{Hdr: hdr(dns.TypeSOA, 300), Ns: "ns.example.com.", Mbox: "m.example.com.", Minttl: 30}}
+			default:
+				res.SetRcode(req, dns.RcodeNameError)
+			}
+			w.WriteMsg(res)
+		}),
+	}
+	started := make(chan struct{})
+	upstream.NotifyStartedFunc = func() { close(started) }
+	go upstream.ActivateAndServe()
+	<-started
+	defer upstream.Shutdown()
+
+	s.srv.Close()
+	s.srv = &DNSServer{
+		UDPAddr:   "127.0.0.1:0",
+		Store:     s.state,
+		Recursors: []string{l.LocalAddr().String()},
+		CacheSize: 2,
+	}
+	c.Assert(s.srv.ListenAndServe(), IsNil)
+
+	client := &dns.Client{Net: "udp"}
+	lookup := func(name string) *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion(name, dns.TypeA)
+		res, _, err := client.Exchange(req, s.srv.UDPAddr)
+		c.Assert(err, IsNil)
+		c.Assert(res.Id, Equals, req.Id)
+		return res
+	}
+	assertQueries := func(n int32) {
+		c.Assert(atomic.LoadInt32(&queries), Equals, n)
+	}
+
+	// responses are cached
+	res := lookup("a.example.com.")
+	c.Assert(res.Answer, HasLen, 1)
+	assertQueries(1)
+	res = lookup("A.example.com.")
+	c.Assert(res.Answer, HasLen, 1)
+	c.Assert(res.Answer[0].Header().Ttl <= 60, Equals, true)
+	assertQueries(1)
+
+	// negative responses are cached if they have a SOA
+	res = lookup("missing.example.com.")
+	c.Assert(res.Rcode, Equals, dns.RcodeNameError)
+	lookup("missing.example.com.")
+	assertQueries(2)
+	lookup("nosoa.example.com.")
+	lookup("nosoa.example.com.")
+	assertQueries(4)
+
+	// zero TTL responses are not cached
+	lookup("zero.example.com.")
+	lookup("zero.example.com.")
+	assertQueries(6)
+
+	// the least recently used response is evicted
+	lookup("b.example.com.")
+	assertQueries(7)
+	lookup("b.example.com.")
+	lookup("missing.example.com.")
+	assertQueries(7)
+	lookup("a.example.com.")
+	assertQueries(8)
+
+	c.Assert(s.srv.Stats(), DeepEquals, DNSStats{CacheHits: 4, CacheMisses: 8, CacheSize: 2})
+
+	// stats are available over HTTP
+	srv := httptest.NewServer(NewHTTPHandler(nil, s.srv, ""))
+	defer srv.Close()
+	var stats DNSStats
+	c.Assert((&httpclient.Client{URL: srv.URL, HTTP: http.DefaultClient}).Get("/dns/stats", &stats), IsNil)
+	c.Assert(stats, DeepEquals, s.srv.Stats())
+}
+
+func (DNSSuite) TestRecursorCacheExpiry(c *C) {
+	cache := newDNSCache(10)
+	req := &dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+	res := &dns.Msg{}
+	res.SetReply(req)
+	res.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(10, 0, 0, 1),
+	}}
+	cache.Set(req, res, false)
+
+	// TTLs are reduced by the time the response has been cached
+	key, _ := cacheKey(req, false)
+	el := cache.entries[key]
+	entry := el.Value.(*dnsCacheEntry)
+	entry.added = entry.added.Add(-10 * time.Second)
+	cached := cache.Get(req, false)
+	c.Assert(cached, NotNil)
+	c.Assert(cached.Answer[0].Header().Ttl, Equals, uint32(50))
+	c.Assert(res.Answer[0].Header().Ttl, Equals, uint32(60))
+
+	// TCP responses are cached separately
+	c.Assert(cache.Get(req, true), IsNil)
+
+	// expired responses are removed
+	entry.expires = time.Now()
+	c.Assert(cache.Get(req, false), IsNil)
+	c.Assert(cache.Stats(), DeepEquals, DNSStats{CacheHits: 1, CacheMisses: 2})
+}
+
+func (DNSSuite) TestRecursorCacheEDNS(c *C) {
+	cache := newDNSCache(10)
+	newReq := func(edns bool, udpSize uint16, do, cd bool) *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion("example.com.", dns.TypeA)
+		req.CheckingDisabled = cd
+		if edns {
+			req.SetEdns0(udpSize, do)
+		}
+		return req
+	}
+	req := newReq(true, 4096, true, false)
+	res := &dns.Msg{}
+	res.SetReply(req)
+	res.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(10, 0, 0, 1),
+	}}
+	res.SetEdns0(1232, true)
+	cache.Set(req, res, false)
+
+	// responses are only returned for requests with the same EDNS buffer
+	// size and DO and CD bits
+	c.Assert(cache.Get(newReq(false, 0, false, false), false), IsNil)
+	c.Assert(cache.Get(newReq(true, 512, true, false), false), IsNil)
+	c.Assert(cache.Get(newReq(true, 4096, false, false), false), IsNil)
+	c.Assert(cache.Get(newReq(true, 4096, true, true), false), IsNil)
+
+	// the OPT record is built from the request
+	cached := cache.Get(newReq(true, 4096, true, false), false)
+	c.Assert(cached, NotNil)
+	opt := cached.IsEdns0()
+	c.Assert(opt, NotNil)
+	c.Assert(opt.UDPSize(), Equals, uint16(4096))
+	c.Assert(opt.Do(), Equals, true)
+	c.Assert(cached.Extra, HasLen, 1)
+
+	// responses to requests without EDNS have no OPT record
+	req = newReq(false, 0, false, false)
+	res = res.Copy()
+	res.Id = req.Id
+	cache.Set(req, res, false)
+	cached = cache.Get(req, false)
+	c.Assert(cached, NotNil)
+	c.Assert(cached.IsEdns0(), IsNil)
+}
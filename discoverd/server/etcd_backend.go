@@ -38,8 +38,6 @@ type etcdBackend struct {
 	done     chan struct{}
 }
 
-const defaultTTL = 10
-
 type NotFoundError struct {
 	Service  string
 	Instance string
@@ -86,11 +84,94 @@ func (b *etcdBackend) serviceKey(service string) string {
 	return path.Join(b.prefix, "services", service)
 }
 
-func (b *etcdBackend) AddService(service string) error {
+func (b *etcdBackend) configKey(service string) string {
+	return path.Join(b.serviceKey(service), "config")
+}
+
+func (b *etcdBackend) leaderKey(service string) string {
+	return path.Join(b.serviceKey(service), "leader")
+}
+
+func (b *etcdBackend) AddService(service string, config *discoverd.ServiceConfig) error {
 	_, err := b.etcd.CreateDir(b.serviceKey(service), 0)
 	if isEtcdExists(err) {
 		return ServiceExistsError(service)
 	}
+	if err != nil || config == nil {
+		return err
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	_, err = b.etcd.Set(b.configKey(service), string(data), 0)
+	return err
+}
+
+// serviceConfig returns the config stored in the service directory node.
+func (b *etcdBackend) serviceConfig(serviceNode *etcd.Node) *discoverd.ServiceConfig {
+	for _, n := range serviceNode.Nodes {
+		if path.Base(n.Key) != "config" {
+			continue
+		}
+		config := &discoverd.ServiceConfig{}
+		if err := json.Unmarshal([]byte(n.Value), config); err != nil {
+			log.Printf("Error decoding JSON for service config %s: %s", n.Key, err)
+			return nil
+		}
+		return config
+	}
+	return nil
+}
+
+// serviceLeader returns the manually set leader ID stored in the service
+// directory node.
+func (b *etcdBackend) serviceLeader(serviceNode *etcd.Node) string {
+	for _, n := range serviceNode.Nodes {
+		if path.Base(n.Key) == "leader" {
+			return n.Value
+		}
+	}
+	return ""
+}
+
+func (b *etcdBackend) SetServiceConfig(service string, config *discoverd.ServiceConfig) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if _, err := b.etcd.Get(b.serviceKey(service), false, false); err != nil {
+		if isEtcdNotFound(err) {
+			return NotFoundError{Service: service}
+		}
+		return err
+	}
+	_, err = b.etcd.Set(b.configKey(service), string(data), 0)
+	return err
+}
+
+func (b *etcdBackend) ServiceConfig(service string) (*discoverd.ServiceConfig, error) {
+	res, err := b.etcd.Get(b.configKey(service), false, false)
+	if isEtcdNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	config := &discoverd.ServiceConfig{}
+	if err := json.Unmarshal([]byte(res.Node.Value), config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (b *etcdBackend) SetLeader(service, id string) error {
+	if _, err := b.etcd.Get(b.instanceKey(service, id), false, false); err != nil {
+		if isEtcdNotFound(err) {
+			return NotFoundError{Service: service, Instance: id}
+		}
+		return err
+	}
+	_, err := b.etcd.Set(b.leaderKey(service), id, 0)
 	return err
 }
 
@@ -107,14 +188,15 @@ func (b *etcdBackend) AddInstance(service string, inst *discoverd.Instance) erro
 	if err != nil {
 		return err
 	}
-	_, err = b.etcd.Get(b.serviceKey(service), false, false)
+	res, err := b.etcd.Get(b.serviceKey(service), false, false)
 	if isEtcdNotFound(err) {
 		return NotFoundError{Service: service}
 	}
 	if err != nil {
 		return err
 	}
-	_, err = b.etcd.Set(b.instanceKey(service, inst.ID), string(data), defaultTTL)
+	ttl := instanceTTL(inst, b.serviceConfig(res.Node))
+	_, err = b.etcd.Set(b.instanceKey(service, inst.ID), string(data), uint64(ttl))
 	return err
 }
 
@@ -182,16 +264,24 @@ func (b *etcdBackend) StartSync() error {
 					recentError = false
 					nextIndex = res.EtcdIndex + 1
 
-					// ensure we have a key like /foo/bar/services/a/instances/id or /foo/bar/services/a
+					// ensure we have a key like /foo/bar/services/a/instances/id,
+					// /foo/bar/services/a/config, /foo/bar/services/a/leader or
+					// /foo/bar/services/a
 					slashes := strings.Count(res.Node.Key[len(keyPrefix):], "/")
-					if slashes != 3 && slashes != 1 {
+					base := path.Base(res.Node.Key)
+					if slashes < 1 || slashes > 3 || slashes == 2 && base != "config" && base != "leader" {
 						continue
 					}
 
 					serviceName := strings.SplitN(res.Node.Key[len(keyPrefix)+1:], "/", 2)[0]
-					if slashes == 3 {
+					switch {
+					case slashes == 3:
 						b.instanceEvent(serviceName, res)
-					} else {
+					case slashes == 2 && base == "config":
+						b.configEvent(serviceName, res)
+					case slashes == 2:
+						b.leaderEvent(serviceName, res)
+					default:
 						b.serviceEvent(serviceName, res)
 					}
 				}
@@ -233,6 +323,27 @@ func (b *etcdBackend) instanceEvent(serviceName string, res *etcd.Response) {
 	}
 }
 
+func (b *etcdBackend) configEvent(serviceName string, res *etcd.Response) {
+	if res.Action == "delete" || res.Action == "expire" {
+		b.h.SetServiceConfig(serviceName, nil)
+		return
+	}
+	config := &discoverd.ServiceConfig{}
+	if err := json.Unmarshal([]byte(res.Node.Value), config); err != nil {
+		log.Printf("Error decoding JSON for service config %s: %s", res.Node.Key, err)
+		return
+	}
+	b.h.SetServiceConfig(serviceName, config)
+}
+
+func (b *etcdBackend) leaderEvent(serviceName string, res *etcd.Response) {
+	if res.Action == "delete" || res.Action == "expire" {
+		b.h.SetManualLeader(serviceName, "")
+		return
+	}
+	b.h.SetManualLeader(serviceName, res.Node.Value)
+}
+
 func (b *etcdBackend) serviceEvent(serviceName string, res *etcd.Response) {
 	if res.Action == "delete" {
 		b.h.RemoveService(serviceName)
@@ -275,6 +386,11 @@ func (b *etcdBackend) fullSync() (uint64, error) {
 				instances = append(instances, inst)
 			}
 		}
+		// set the config and leader first so that the leader is only elected
+		// once
+		b.h.AddService(serviceName)
+		b.h.SetServiceConfig(serviceName, b.serviceConfig(serviceNode))
+		b.h.SetManualLeader(serviceName, b.serviceLeader(serviceNode))
 		b.h.SetService(serviceName, instances)
 	}
 	// remove any services that weren't found in the response
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"time"
+
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/coreos/go-etcd/etcd"
 	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
 	"github.com/flynn/flynn/discoverd/client"
@@ -36,7 +38,7 @@ func (s *EtcdSuite) TestBasicSync(c *C) {
 	events := make(chan *discoverd.Event, 1)
 	s.state.Subscribe("a", false, discoverd.EventKindUp|discoverd.EventKindDown|discoverd.EventKindUpdate, events)
 
-	c.Assert(s.backend.AddService("a"), IsNil)
+	c.Assert(s.backend.AddService("a", nil), IsNil)
 	c.Assert(s.backend.StartSync(), IsNil)
 
 	s.testBasicSync(c, events)
@@ -48,7 +50,7 @@ func (s *EtcdSuite) testBasicSync(c *C, events chan *discoverd.Event) {
 	c.Assert(err, DeepEquals, NotFoundError{Service: "a", Instance: "b"})
 
 	// Create service, and use instance creation as write barrier
-	err = s.backend.AddService("new-service")
+	err = s.backend.AddService("new-service", nil)
 	c.Assert(err, IsNil)
 
 	// Create instance
@@ -82,7 +84,7 @@ func (s *EtcdSuite) TestLeaderElection(c *C) {
 	events := make(chan *discoverd.Event, 2)
 	s.state.Subscribe("a", false, discoverd.EventKindLeader|discoverd.EventKindUp, events)
 
-	c.Assert(s.backend.AddService("a"), IsNil)
+	c.Assert(s.backend.AddService("a", nil), IsNil)
 	first := fakeInstance()
 	c.Assert(s.backend.AddInstance("a", first), IsNil)
 
@@ -108,6 +110,37 @@ func (s *EtcdSuite) TestLeaderElection(c *C) {
 	assertEvent(c, events, "a", discoverd.EventKindLeader, second)
 }
 
+func (s *EtcdSuite) TestManualLeader(c *C) {
+	config := &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual}
+	c.Assert(s.backend.AddService("a", config), IsNil)
+	first := fakeInstance()
+	second := fakeInstance()
+	c.Assert(s.backend.AddInstance("a", first), IsNil)
+	c.Assert(s.backend.AddInstance("a", second), IsNil)
+
+	// unknown instances can't become leader
+	err := s.backend.SetLeader("a", "foo")
+	c.Assert(err, DeepEquals, NotFoundError{Service: "a", Instance: "foo"})
+
+	// the manual leader is loaded by the initial sync
+	c.Assert(s.backend.SetLeader("a", second.ID), IsNil)
+	events := make(chan *discoverd.Event, 1)
+	s.state.Subscribe("a", false, discoverd.EventKindLeader, events)
+	c.Assert(s.backend.StartSync(), IsNil)
+	assertEvent(c, events, "a", discoverd.EventKindLeader, second)
+
+	// leader changes are watched
+	c.Assert(s.backend.SetLeader("a", first.ID), IsNil)
+	assertEvent(c, events, "a", discoverd.EventKindLeader, first)
+
+	// config changes are watched
+	c.Assert(s.backend.SetServiceConfig("a", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeNone}), IsNil)
+	c.Assert(s.backend.SetServiceConfig("b", config), DeepEquals, NotFoundError{Service: "b"})
+	c.Assert(s.backend.SetLeader("a", second.ID), IsNil)
+	assertNoEvent(c, events)
+	c.Assert(s.state.GetLeader("a"), IsNil)
+}
+
 // Sync starting with empty etcd, but services in local state
 func (s *EtcdSuite) TestNoServiceSync(c *C) {
 	inst := fakeInstance()
@@ -116,7 +149,7 @@ func (s *EtcdSuite) TestNoServiceSync(c *C) {
 	events := make(chan *discoverd.Event, 1)
 	s.state.Subscribe("a", false, discoverd.EventKindUp|discoverd.EventKindDown|discoverd.EventKindUpdate, events)
 
-	c.Assert(s.backend.AddService("a"), IsNil)
+	c.Assert(s.backend.AddService("a", nil), IsNil)
 	c.Assert(s.backend.StartSync(), IsNil)
 
 	assertEvent(c, events, "a", discoverd.EventKindDown, inst)
@@ -142,9 +175,9 @@ func (s *EtcdSuite) TestLocalDiffSync(c *C) {
 
 	updated2 := *updated
 	updated2.Meta = map[string]string{"a": "b"}
-	c.Assert(s.backend.AddService("a"), IsNil)
-	c.Assert(s.backend.AddService("existing"), IsNil)
-	c.Assert(s.backend.AddService("new"), IsNil)
+	c.Assert(s.backend.AddService("a", nil), IsNil)
+	c.Assert(s.backend.AddService("existing", nil), IsNil)
+	c.Assert(s.backend.AddService("new", nil), IsNil)
 	c.Assert(s.backend.AddInstance("a", existing), IsNil)
 	c.Assert(s.backend.AddInstance("a", &updated2), IsNil)
 	c.Assert(s.backend.AddInstance("a", added), IsNil)
@@ -188,10 +221,10 @@ func (s *EtcdSuite) TestServiceAddRemove(c *C) {
 	err := s.backend.RemoveService("a")
 	c.Assert(err, DeepEquals, NotFoundError{Service: "a"})
 
-	err = s.backend.AddService("a")
+	err = s.backend.AddService("a", nil)
 	c.Assert(err, IsNil)
 
-	err = s.backend.AddService("a")
+	err = s.backend.AddService("a", nil)
 	c.Assert(err, DeepEquals, ServiceExistsError("a"))
 
 	err = s.backend.RemoveService("a")
@@ -200,3 +233,51 @@ func (s *EtcdSuite) TestServiceAddRemove(c *C) {
 	err = s.backend.RemoveService("a")
 	c.Assert(err, DeepEquals, NotFoundError{Service: "a"})
 }
+
+func (s *EtcdSuite) TestServiceConfigTTL(c *C) {
+	// config is loaded by the initial sync
+	c.Assert(s.backend.AddService("a", &discoverd.ServiceConfig{TTL: 1}), IsNil)
+	c.Assert(s.backend.StartSync(), IsNil)
+	c.Assert(s.state.GetConfig("a"), DeepEquals, &discoverd.ServiceConfig{TTL: 1})
+
+	// the stored config can be read from the backend without waiting for
+	// the sync
+	config, err := s.backend.ServiceConfig("a")
+	c.Assert(err, IsNil)
+	c.Assert(config, DeepEquals, &discoverd.ServiceConfig{TTL: 1})
+	config, err = s.backend.ServiceConfig("missing")
+	c.Assert(err, IsNil)
+	c.Assert(config, IsNil)
+
+	// config is loaded for services created after the sync starts, use an
+	// instance as a write barrier
+	events := make(chan *discoverd.Event, 1)
+	s.state.Subscribe("b", false, discoverd.EventKindUp|discoverd.EventKindDown, events)
+	c.Assert(s.backend.AddService("b", &discoverd.ServiceConfig{TTL: 1}), IsNil)
+	inst := fakeInstance()
+	c.Assert(s.backend.AddInstance("b", inst), IsNil)
+	assertEvent(c, events, "b", discoverd.EventKindUp, inst)
+	c.Assert(s.state.GetConfig("b"), DeepEquals, &discoverd.ServiceConfig{TTL: 1})
+
+	// the instance expires after the service TTL
+	select {
+	case e := <-events:
+		assertEventEqual(c, e, &discoverd.Event{Service: "b", Kind: discoverd.EventKindDown, Instance: inst})
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for instance to expire")
+	}
+
+	// instance TTLs take precedence over the service TTL
+	c.Assert(s.backend.AddService("c", &discoverd.ServiceConfig{TTL: 60}), IsNil)
+	s.state.Subscribe("c", false, discoverd.EventKindUp|discoverd.EventKindDown, events)
+	inst = fakeInstance()
+	inst.TTL = 1
+	c.Assert(s.backend.AddInstance("c", inst), IsNil)
+	assertEvent(c, events, "c", discoverd.EventKindUp, inst)
+	select {
+	case e := <-events:
+		assertEventEqual(c, e, &discoverd.Event{Service: "c", Kind: discoverd.EventKindDown, Instance: inst})
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for instance to expire")
+	}
+}
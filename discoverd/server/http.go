@@ -1,28 +1,40 @@
 package server
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
+	"net/url"
+	"sort"
 	"strings"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/julienschmidt/httprouter"
 	"github.com/flynn/flynn/discoverd/client"
 	hh "github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/random"
 	"github.com/flynn/flynn/pkg/sse"
 	"github.com/flynn/flynn/pkg/stream"
 )
 
 type Datastore interface {
 	// Typically implemented by a Backend
-	AddService(service string) error
+	AddService(service string, config *discoverd.ServiceConfig) error
 	RemoveService(service string) error
 	AddInstance(service string, inst *discoverd.Instance) error
 	RemoveInstance(service, id string) error
+	SetServiceConfig(service string, config *discoverd.ServiceConfig) error
+	ServiceConfig(service string) (*discoverd.ServiceConfig, error)
+	SetLeader(service, id string) error
 
 	// Typically implemented by State
 	Get(service string) []*discoverd.Instance
 	GetLeader(service string) *discoverd.Instance
+	GetConfig(service string) *discoverd.ServiceConfig
+	ListServices() []string
 	Subscribe(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream
 }
 
@@ -31,8 +43,8 @@ type basicDatastore struct {
 	Backend
 }
 
-func (d basicDatastore) AddService(service string) error {
-	return d.Backend.AddService(service)
+func (d basicDatastore) AddService(service string, config *discoverd.ServiceConfig) error {
+	return d.Backend.AddService(service, config)
 }
 
 func (d basicDatastore) RemoveService(service string) error {
@@ -47,17 +59,35 @@ func (d basicDatastore) RemoveInstance(service, id string) error {
 	return d.Backend.RemoveInstance(service, id)
 }
 
+func (d basicDatastore) SetServiceConfig(service string, config *discoverd.ServiceConfig) error {
+	return d.Backend.SetServiceConfig(service, config)
+}
+
+func (d basicDatastore) ServiceConfig(service string) (*discoverd.ServiceConfig, error) {
+	return d.Backend.ServiceConfig(service)
+}
+
+func (d basicDatastore) SetLeader(service, id string) error {
+	return d.Backend.SetLeader(service, id)
+}
+
 func NewBasicDatastore(state *State, backend Backend) Datastore {
 	return &basicDatastore{state, backend}
 }
 
-func NewHTTPHandler(ds Datastore) http.Handler {
+// NewHTTPHandler returns a handler for the HTTP API, dns may be nil if there
+// is no DNS server. If platformKey is set, it is required to change platform
+// services.
+func NewHTTPHandler(ds Datastore, dns *DNSServer, platformKey string) http.Handler {
 	router := httprouter.New()
 
 	api := &httpAPI{
-		Store: ds,
+		Store:       ds,
+		DNS:         dns,
+		PlatformKey: platformKey,
 	}
 
+	router.GET("/services", api.GetServices)
 	router.PUT("/services/:service", api.AddService)
 	router.DELETE("/services/:service", api.RemoveService)
 	router.GET("/services/:service", api.GetServiceStream)
@@ -67,6 +97,12 @@ func NewHTTPHandler(ds Datastore) http.Handler {
 	router.GET("/services/:service/instances", api.GetInstances)
 
 	router.GET("/services/:service/leader", api.GetLeader)
+	router.PUT("/services/:service/leader", api.SetLeader)
+
+	router.GET("/services/:service/config", api.GetConfig)
+	router.PUT("/services/:service/config", api.SetConfig)
+
+	router.GET("/dns/stats", api.GetDNSStats)
 
 	router.GET("/ping", func(http.ResponseWriter, *http.Request, httprouter.Params) {})
 
@@ -74,20 +110,129 @@ func NewHTTPHandler(ds Datastore) http.Handler {
 }
 
 type httpAPI struct {
-	Store Datastore
+	Store       Datastore
+	DNS         *DNSServer
+	PlatformKey string
 }
 
 func jsonError(w http.ResponseWriter, code hh.ErrorCode, err error) {
 	hh.Error(w, hh.JSONError{Code: code, Message: err.Error()})
 }
 
+var errUnauthorized = errors.New("discoverd: the service key is required to change the service")
+
+// reservedServicePrefix is the prefix of the names of platform services, which
+// can only be changed with the platform key if it is set.
+const reservedServicePrefix = "flynn-"
+
+// platformServices are the services of the platform apps which are not
+// prefixed with reservedServicePrefix, they also require the platform key.
+var platformServices = map[string]struct{}{
+	"pg":            {},
+	"pg-api":        {},
+	"blobstore":     {},
+	"gitreceive":    {},
+	"router-api":    {},
+	"router-http":   {},
+	"dashboard-web": {},
+}
+
+// serviceKeyBytes is the number of random bytes in generated service keys.
+const serviceKeyBytes = 32
+
+// requestKey returns the key given as the basic auth password of r.
+func requestKey(r *http.Request) string {
+	_, key, _ := r.BasicAuth()
+	return key
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// isReserved returns whether service is a platform service.
+func (h *httpAPI) isReserved(service string) bool {
+	if h.PlatformKey == "" {
+		return false
+	}
+	_, ok := platformServices[service]
+	return ok || strings.HasPrefix(service, reservedServicePrefix)
+}
+
+// authorize checks that r has the platform key if service is reserved, or the
+// key of service if it was created with one. It responds with an error and
+// returns false if it does not. The key hash is read from the backend rather
+// than the state, which is updated asynchronously, so that a service is
+// protected as soon as it has been created.
+func (h *httpAPI) authorize(w http.ResponseWriter, r *http.Request, service string) bool {
+	var keyHash string
+	if h.isReserved(service) {
+		keyHash = hashKey(h.PlatformKey)
+	} else {
+		config, err := h.Store.ServiceConfig(service)
+		if err != nil {
+			hh.Error(w, err)
+			return false
+		}
+		if config != nil {
+			keyHash = config.KeyHash
+		}
+	}
+	if keyHash == "" {
+		return true
+	}
+	key := requestKey(r)
+	if key == "" || subtle.ConstantTimeCompare([]byte(hashKey(key)), []byte(keyHash)) != 1 {
+		jsonError(w, hh.UnauthorizedError, errUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (h *httpAPI) GetServices(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		h.handleStream(w, allServices, discoverd.EventKindAll)
+		return
+	}
+
+	services := h.Store.ListServices()
+	sort.Strings(services)
+	hh.JSON(w, 200, services)
+}
+
 func (h *httpAPI) AddService(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	service := params.ByName("service")
 	if err := ValidServiceName(service); err != nil {
 		jsonError(w, hh.ValidationError, err)
 		return
 	}
-	if err := h.Store.AddService(service); err != nil {
+	var config *discoverd.ServiceConfig
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil && err != io.EOF {
+		hh.Error(w, err)
+		return
+	}
+	if config != nil {
+		if err := config.Valid(); err != nil {
+			jsonError(w, hh.ValidationError, err)
+			return
+		}
+		config.KeyHash = ""
+	}
+	if h.isReserved(service) && !h.authorize(w, r, service) {
+		return
+	}
+	// services created with a generated key can only be changed with that
+	// key, which is only returned to the client that created the service
+	var key string
+	if r.URL.Query().Get("generate_key") == "true" {
+		key = random.Hex(serviceKeyBytes)
+		if config == nil {
+			config = &discoverd.ServiceConfig{}
+		}
+		config.KeyHash = hashKey(key)
+	}
+	if err := h.Store.AddService(service, config); err != nil {
 		if IsServiceExists(err) {
 			jsonError(w, hh.ObjectExistsError, err)
 		} else {
@@ -95,6 +240,9 @@ func (h *httpAPI) AddService(w http.ResponseWriter, r *http.Request, params http
 		}
 		return
 	}
+	if key != "" {
+		hh.JSON(w, 200, &discoverd.ServiceKey{Key: key})
+	}
 }
 
 func (h *httpAPI) RemoveService(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
@@ -103,7 +251,10 @@ func (h *httpAPI) RemoveService(w http.ResponseWriter, r *http.Request, params h
 		jsonError(w, hh.ValidationError, err)
 		return
 	}
-	if err := h.Store.RemoveService(params.ByName("service")); err != nil {
+	if !h.authorize(w, r, service) {
+		return
+	}
+	if err := h.Store.RemoveService(service); err != nil {
 		if IsNotFound(err) {
 			jsonError(w, hh.ObjectNotFoundError, err)
 		} else {
@@ -123,7 +274,11 @@ func (h *httpAPI) AddInstance(w http.ResponseWriter, r *http.Request, params htt
 		jsonError(w, hh.ValidationError, err)
 		return
 	}
-	if err := h.Store.AddInstance(params.ByName("service"), inst); err != nil {
+	service := params.ByName("service")
+	if !h.authorize(w, r, service) {
+		return
+	}
+	if err := h.Store.AddInstance(service, inst); err != nil {
 		if IsNotFound(err) {
 			jsonError(w, hh.ObjectNotFoundError, err)
 		} else {
@@ -131,10 +286,18 @@ func (h *httpAPI) AddInstance(w http.ResponseWriter, r *http.Request, params htt
 		}
 		return
 	}
+	// respond with the effective TTL so that the heartbeat interval can be
+	// picked by the client
+	inst.TTL = instanceTTL(inst, h.Store.GetConfig(service))
+	hh.JSON(w, 200, inst)
 }
 
 func (h *httpAPI) RemoveInstance(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	if err := h.Store.RemoveInstance(params.ByName("service"), params.ByName("instance_id")); err != nil {
+	service := params.ByName("service")
+	if !h.authorize(w, r, service) {
+		return
+	}
+	if err := h.Store.RemoveInstance(service, params.ByName("instance_id")); err != nil {
 		if IsNotFound(err) {
 			jsonError(w, hh.ObjectNotFoundError, err)
 		} else {
@@ -146,7 +309,7 @@ func (h *httpAPI) RemoveInstance(w http.ResponseWriter, r *http.Request, params
 
 func (h *httpAPI) GetInstances(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
-		h.handleStream(w, params, discoverd.EventKindUp|discoverd.EventKindUpdate|discoverd.EventKindDown)
+		h.handleStream(w, params.ByName("service"), discoverd.EventKindUp|discoverd.EventKindUpdate|discoverd.EventKindDown)
 		return
 	}
 
@@ -155,12 +318,28 @@ func (h *httpAPI) GetInstances(w http.ResponseWriter, r *http.Request, params ht
 		jsonError(w, hh.ObjectNotFoundError, errors.New("service not found"))
 		return
 	}
-	hh.JSON(w, 200, instances)
+	hh.JSON(w, 200, filterInstances(instances, metaFilter(r.URL.Query())))
+}
+
+// metaFilter returns the metadata filter given as meta.<key>=<value> query
+// parameters.
+func metaFilter(q url.Values) map[string]string {
+	var meta map[string]string
+	for k, v := range q {
+		if !strings.HasPrefix(k, "meta.") || len(v) == 0 {
+			continue
+		}
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[strings.TrimPrefix(k, "meta.")] = v[0]
+	}
+	return meta
 }
 
 func (h *httpAPI) GetLeader(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
-		h.handleStream(w, params, discoverd.EventKindLeader)
+		h.handleStream(w, params.ByName("service"), discoverd.EventKindLeader)
 		return
 	}
 
@@ -172,14 +351,91 @@ func (h *httpAPI) GetLeader(w http.ResponseWriter, r *http.Request, params httpr
 	hh.JSON(w, 200, leader)
 }
 
+func (h *httpAPI) SetLeader(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	inst := &discoverd.Instance{}
+	if err := json.NewDecoder(r.Body).Decode(inst); err != nil {
+		hh.Error(w, err)
+		return
+	}
+	service := params.ByName("service")
+	if !h.authorize(w, r, service) {
+		return
+	}
+	if err := h.Store.SetLeader(service, inst.ID); err != nil {
+		if IsNotFound(err) {
+			jsonError(w, hh.ObjectNotFoundError, err)
+		} else {
+			hh.Error(w, err)
+		}
+		return
+	}
+}
+
+func (h *httpAPI) GetConfig(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	service := params.ByName("service")
+	if h.Store.Get(service) == nil {
+		jsonError(w, hh.ObjectNotFoundError, errors.New("service not found"))
+		return
+	}
+	config := &discoverd.ServiceConfig{}
+	if c := h.Store.GetConfig(service); c != nil {
+		*config = *c
+	}
+	// the key hash is not secret, but there is no need for clients to see it
+	config.KeyHash = ""
+	hh.JSON(w, 200, config)
+}
+
+func (h *httpAPI) SetConfig(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	config := &discoverd.ServiceConfig{}
+	if err := json.NewDecoder(r.Body).Decode(config); err != nil {
+		hh.Error(w, err)
+		return
+	}
+	if err := config.Valid(); err != nil {
+		jsonError(w, hh.ValidationError, err)
+		return
+	}
+	service := params.ByName("service")
+	if !h.authorize(w, r, service) {
+		return
+	}
+	// the key can't be changed once the service is created
+	existing, err := h.Store.ServiceConfig(service)
+	if err != nil {
+		hh.Error(w, err)
+		return
+	}
+	config.KeyHash = ""
+	if existing != nil {
+		config.KeyHash = existing.KeyHash
+	}
+	if err := h.Store.SetServiceConfig(service, config); err != nil {
+		if IsNotFound(err) {
+			jsonError(w, hh.ObjectNotFoundError, err)
+		} else {
+			hh.Error(w, err)
+		}
+		return
+	}
+}
+
 func (h *httpAPI) GetServiceStream(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
-		h.handleStream(w, params, discoverd.EventKindAll)
+		h.handleStream(w, params.ByName("service"), discoverd.EventKindAll)
+		return
+	}
+}
+
+func (h *httpAPI) GetDNSStats(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if h.DNS == nil {
+		jsonError(w, hh.ObjectNotFoundError, errors.New("DNS server not running"))
 		return
 	}
+	hh.JSON(w, 200, h.DNS.Stats())
 }
 
-func (h *httpAPI) handleStream(w http.ResponseWriter, params httprouter.Params, kind discoverd.EventKind) {
+func (h *httpAPI) handleStream(w http.ResponseWriter, service string, kind discoverd.EventKind) {
 	sw := sse.NewWriter(w)
 	enc := json.NewEncoder(hh.FlushWriter{Writer: sw, Enabled: true})
 	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
@@ -198,7 +454,7 @@ func (h *httpAPI) handleStream(w http.ResponseWriter, params httprouter.Params,
 		}
 	}()
 
-	stream := h.Store.Subscribe(params.ByName("service"), true, kind, ch)
+	stream := h.Store.Subscribe(service, true, kind, ch)
 
 	if cn, ok := w.(http.CloseNotifier); ok {
 		go func() {
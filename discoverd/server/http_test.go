@@ -1,8 +1,13 @@
 package server
 
 import (
+	"io/ioutil"
+	"net"
+	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/coreos/go-etcd/etcd"
@@ -29,10 +34,15 @@ func (s *HTTPSuite) SetUpTest(c *C) {
 	s.state = NewState()
 
 	s.backend = NewEtcdBackend(etcd.NewClient([]string{etcdAddr}), "/test/discoverd", s.state)
+	s.setup(c)
+}
+
+// setup starts the HTTP server using s.state and s.backend
+func (s *HTTPSuite) setup(c *C) {
 	c.Assert(s.backend.StartSync(), IsNil)
 	s.cleanup = append(s.cleanup, func() { s.backend.Close() })
 
-	s.server = httptest.NewServer(NewHTTPHandler(NewBasicDatastore(s.state, s.backend)))
+	s.server = httptest.NewServer(NewHTTPHandler(NewBasicDatastore(s.state, s.backend), nil, testPlatformKey))
 	s.cleanup = append(s.cleanup, s.server.Close)
 
 	s.client = discoverd.NewClientWithURL(s.server.URL)
@@ -129,6 +139,36 @@ func (s *HTTPSuite) TestWatch(c *C) {
 	assertEvent(c, events, "a", discoverd.EventKindDown, inst2)
 }
 
+func (s *HTTPSuite) TestServices(c *C) {
+	inst1 := fakeInstance()
+	_, err := s.client.AddServiceAndRegisterInstance("b", inst1)
+	c.Assert(err, IsNil)
+
+	services, err := s.client.Services()
+	c.Assert(err, IsNil)
+	c.Assert(services, DeepEquals, []string{"a", "b"})
+
+	events := make(chan *discoverd.Event)
+	stream, err := s.client.WatchAll(events)
+	c.Assert(err, IsNil)
+	defer stream.Close()
+
+	// the current state of every service is sent first
+	assertEvent(c, events, "b", discoverd.EventKindUp, inst1)
+	assertEvent(c, events, "b", discoverd.EventKindLeader, inst1)
+	assertEvent(c, events, "*", discoverd.EventKindCurrent, nil)
+
+	// events of all services are sent
+	inst2 := fakeInstance()
+	inst2.Meta = map[string]string{"a": "b"}
+	hb, err := s.client.RegisterInstance("a", inst2)
+	c.Assert(err, IsNil)
+	assertEvent(c, events, "a", discoverd.EventKindUp, inst2)
+	assertEvent(c, events, "a", discoverd.EventKindLeader, inst2)
+	c.Assert(hb.Close(), IsNil)
+	assertEvent(c, events, "a", discoverd.EventKindDown, inst2)
+}
+
 func assertLeader(c *C, leaders <-chan *discoverd.Instance, expected *discoverd.Instance) {
 	var actual *discoverd.Instance
 	var ok bool
@@ -269,6 +309,50 @@ func (s *HTTPSuite) TestInstances(c *C) {
 	c.Assert(res, HasLen, 1)
 	assertInstanceEqual(c, res[0], inst2)
 
+	// InstancesWithMeta filters by metadata
+	inst3 := fakeInstance()
+	inst3.Meta = map[string]string{"a": "c"}
+	hb3, err := s.client.RegisterInstance("a", inst3)
+	c.Assert(err, IsNil)
+	defer hb3.Close()
+	assertEvent(c, events, "a", discoverd.EventKindUp, inst3)
+	res, err = srv.InstancesWithMeta(map[string]string{"a": "b"})
+	c.Assert(err, IsNil)
+	c.Assert(res, HasLen, 1)
+	assertInstanceEqual(c, res[0], inst2)
+	res, err = srv.InstancesWithMeta(map[string]string{"a": "b", "b": "c"})
+	c.Assert(err, IsNil)
+	c.Assert(res, HasLen, 0)
+	res, err = srv.InstancesWithMeta(nil)
+	c.Assert(err, IsNil)
+	c.Assert(res, HasLen, 2)
+}
+
+func (s *HTTPSuite) TestWaitForInstance(c *C) {
+	// WaitForInstance times out if no instance matches
+	inst1 := fakeInstance()
+	inst1.Meta = map[string]string{"up": "false"}
+	hb1, err := s.client.RegisterInstance("a", inst1)
+	c.Assert(err, IsNil)
+	defer hb1.Close()
+	_, err = s.client.WaitForInstance("a", map[string]string{"up": "true"}, 100*time.Millisecond)
+	c.Assert(err, Equals, discoverd.ErrTimedOut)
+
+	// WaitForInstance returns an existing instance once it matches
+	done := make(chan *discoverd.Instance)
+	go func() {
+		inst, err := s.client.WaitForInstance("a", map[string]string{"up": "true"}, 10*time.Second)
+		c.Assert(err, IsNil)
+		done <- inst
+	}()
+	inst1.Meta = map[string]string{"up": "true"}
+	c.Assert(hb1.SetMeta(inst1.Meta), IsNil)
+	select {
+	case inst := <-done:
+		assertInstanceEqual(c, inst, inst1)
+	case <-time.After(10 * time.Second):
+		c.Fatal("timed out waiting for instance")
+	}
 }
 
 func (s *HTTPSuite) TestInstancesShortcut(c *C) {
@@ -330,6 +414,378 @@ func (s *HTTPSuite) TestAddServiceAndRegister(c *C) {
 	c.Assert(err, NotNil)
 }
 
+func (s *HTTPSuite) TestServiceConfig(c *C) {
+	// invalid configs are rejected
+	err := s.client.AddService("b", &discoverd.ServiceConfig{TTL: -1})
+	c.Assert(err, NotNil)
+
+	// instances of services with a short TTL stay registered while
+	// heartbeating
+	events := make(chan *discoverd.Event, 1)
+	s.state.Subscribe("b", false, discoverd.EventKindUp|discoverd.EventKindDown, events)
+	c.Assert(s.client.AddService("b", &discoverd.ServiceConfig{TTL: 1}), IsNil)
+	inst := fakeInstance()
+	hb, err := s.client.RegisterInstance("b", inst)
+	c.Assert(err, IsNil)
+	assertEvent(c, events, "b", discoverd.EventKindUp, inst)
+	select {
+	case e := <-events:
+		c.Fatalf("unexpected event %s", e)
+	case <-time.After(3 * time.Second):
+	}
+	c.Assert(hb.Close(), IsNil)
+	assertEvent(c, events, "b", discoverd.EventKindDown, inst)
+}
+
+func (s *HTTPSuite) TestHeartbeatInterval(c *C) {
+	var mtx sync.Mutex
+	heartbeats := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/services/b/instances/") {
+			mtx.Lock()
+			heartbeats++
+			mtx.Unlock()
+		}
+		s.server.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	client := discoverd.NewClientWithURL(srv.URL)
+
+	events := make(chan *discoverd.Event, 1)
+	s.state.Subscribe("b", false, discoverd.EventKindUp|discoverd.EventKindDown, events)
+	c.Assert(client.AddService("b", &discoverd.ServiceConfig{TTL: 1}), IsNil)
+
+	// intervals which are not less than the TTL are ignored
+	client.HeartbeatInterval = 5 * time.Second
+	inst := fakeInstance()
+	hb, err := client.RegisterInstance("b", inst)
+	c.Assert(err, IsNil)
+	assertEvent(c, events, "b", discoverd.EventKindUp, inst)
+	select {
+	case e := <-events:
+		c.Fatalf("unexpected event %s", e)
+	case <-time.After(3 * time.Second):
+	}
+	c.Assert(hb.Close(), IsNil)
+	assertEvent(c, events, "b", discoverd.EventKindDown, inst)
+
+	// shorter intervals are used
+	mtx.Lock()
+	heartbeats = 0
+	mtx.Unlock()
+	client.HeartbeatInterval = 100 * time.Millisecond
+	hb, err = client.RegisterInstance("b", inst)
+	c.Assert(err, IsNil)
+	assertEvent(c, events, "b", discoverd.EventKindUp, inst)
+	time.Sleep(time.Second)
+	c.Assert(hb.Close(), IsNil)
+	mtx.Lock()
+	defer mtx.Unlock()
+	c.Assert(heartbeats >= 5, Equals, true, Commentf("heartbeats = %d", heartbeats))
+}
+
+func (s *HTTPSuite) TestManualLeader(c *C) {
+	srv := s.client.Service("a")
+	events := make(chan *discoverd.Event, 2)
+	s.state.Subscribe("a", false, discoverd.EventKindUp|discoverd.EventKindLeader, events)
+
+	first := fakeInstance()
+	_, err := s.client.RegisterInstance("a", first)
+	c.Assert(err, IsNil)
+	assertEvent(c, events, "a", discoverd.EventKindUp, first)
+	assertEvent(c, events, "a", discoverd.EventKindLeader, first)
+	second := fakeInstance()
+	_, err = s.client.RegisterInstance("a", second)
+	c.Assert(err, IsNil)
+	assertEvent(c, events, "a", discoverd.EventKindUp, second)
+
+	c.Assert(srv.SetConfig(&discoverd.ServiceConfig{LeaderType: "foo"}), NotNil)
+	c.Assert(srv.SetConfig(&discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual}), IsNil)
+
+	// unknown instances can't become leader
+	err = srv.SetLeader("foo")
+	c.Assert(discoverd.IsNotFound(err), Equals, true)
+
+	c.Assert(srv.SetLeader(second.ID), IsNil)
+	assertEvent(c, events, "a", discoverd.EventKindLeader, second)
+	leader, err := srv.Leader()
+	c.Assert(err, IsNil)
+	assertInstanceEqual(c, leader, second)
+
+	config, err := srv.GetConfig()
+	c.Assert(err, IsNil)
+	c.Assert(config.LeaderType, Equals, discoverd.LeaderTypeManual)
+}
+
+func (s *HTTPSuite) TestDrain(c *C) {
+	events := make(chan *discoverd.Event, 1)
+	s.state.Subscribe("a", false, discoverd.EventKindUp|discoverd.EventKindUpdate|discoverd.EventKindDown, events)
+
+	inst := fakeInstance()
+	hb, err := s.client.RegisterInstance("a", inst)
+	c.Assert(err, IsNil)
+	assertEvent(c, events, "a", discoverd.EventKindUp, inst)
+
+	// draining instances are updated but stay registered
+	c.Assert(hb.Drain(), IsNil)
+	inst.Draining = true
+	assertEvent(c, events, "a", discoverd.EventKindUpdate, inst)
+	res, err := s.client.Service("a").Instances()
+	c.Assert(err, IsNil)
+	c.Assert(res, HasLen, 1)
+	c.Assert(res[0].Draining, Equals, true)
+
+	c.Assert(hb.Close(), IsNil)
+	assertEvent(c, events, "a", discoverd.EventKindDown, inst)
+}
+
 func (s *HTTPSuite) TestPing(c *C) {
 	c.Assert(s.client.Ping(), IsNil)
 }
+
+func (s *HTTPSuite) TestBalancer(c *C) {
+	// an instance which is not listening and an instance serving HTTP
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	dead := &discoverd.Instance{Addr: l.Addr().String(), Proto: "tcp"}
+	dead.ID = md5sum(dead.Proto + "-" + dead.Addr)
+	l.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.URL.Path))
+	}))
+	defer srv.Close()
+	live := &discoverd.Instance{Addr: srv.Listener.Addr().String(), Proto: "tcp"}
+	live.ID = md5sum(live.Proto + "-" + live.Addr)
+
+	// there are no instances
+	b, err := s.client.NewBalancer("a", discoverd.BalanceRoundRobin)
+	c.Assert(err, IsNil)
+	b.Attempts = 2
+	b.Backoff = time.Millisecond
+	_, err = b.Pick()
+	c.Assert(err, Equals, discoverd.ErrNoInstances)
+	_, err = b.Dial("tcp", "")
+	c.Assert(err, Equals, discoverd.ErrNoInstances)
+	c.Assert(b.Close(), IsNil)
+
+	hb1, err := s.client.RegisterInstance("a", dead)
+	c.Assert(err, IsNil)
+	defer hb1.Close()
+	hb2, err := s.client.RegisterInstance("a", live)
+	c.Assert(err, IsNil)
+	defer hb2.Close()
+
+	// round robin picks each instance in turn
+	b, err = s.client.NewBalancer("a", discoverd.BalanceRoundRobin)
+	c.Assert(err, IsNil)
+	defer b.Close()
+	b.Attempts = 2
+	b.Backoff = time.Millisecond
+	c.Assert(b.Instances(), HasLen, 2)
+	picked := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		inst, err := b.Pick()
+		c.Assert(err, IsNil)
+		picked[inst.ID]++
+	}
+	c.Assert(picked, DeepEquals, map[string]int{dead.ID: 2, live.ID: 2})
+
+	// Dial and RoundTrip fail over to the live instance
+	for i := 0; i < 2; i++ {
+		conn, err := b.Dial("tcp", "")
+		c.Assert(err, IsNil)
+		c.Assert(conn.RemoteAddr().String(), Equals, live.Addr)
+		conn.Close()
+	}
+	client := &http.Client{Transport: b}
+	for i := 0; i < 2; i++ {
+		res, err := client.Get("http://a/foo")
+		c.Assert(err, IsNil)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, IsNil)
+		c.Assert(string(body), Equals, "/foo")
+	}
+
+	// requests which are not idempotent are not retried, so the request
+	// sent to the dead instance fails
+	failed := 0
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("DELETE", "http://a/foo", nil)
+		c.Assert(err, IsNil)
+		res, err := client.Do(req)
+		if err != nil {
+			failed++
+			continue
+		}
+		res.Body.Close()
+	}
+	c.Assert(failed, Equals, 1)
+
+	// the leader is the oldest instance
+	lb, err := s.client.NewBalancer("a", discoverd.BalanceLeader)
+	c.Assert(err, IsNil)
+	defer lb.Close()
+	for i := 0; i < 2; i++ {
+		inst, err := lb.Pick()
+		c.Assert(err, IsNil)
+		c.Assert(inst.ID, Equals, dead.ID)
+	}
+
+	// draining instances are not picked
+	c.Assert(hb1.Drain(), IsNil)
+	waitForBalancer(c, b, 1)
+	for i := 0; i < 2; i++ {
+		inst, err := b.Pick()
+		c.Assert(err, IsNil)
+		c.Assert(inst.ID, Equals, live.ID)
+	}
+}
+
+func waitForBalancer(c *C, b *discoverd.Balancer, count int) {
+	timeout := time.After(5 * time.Second)
+	for len(b.Instances()) != count {
+		select {
+		case <-timeout:
+			c.Fatalf("timed out waiting for %d balancer instances", count)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// testPlatformKey is the key required to change reserved services
+const testPlatformKey = "platform-key"
+
+func (s *HTTPSuite) TestServiceKey(c *C) {
+	key, err := s.client.AddServiceWithKey("b", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual})
+	c.Assert(err, IsNil)
+	c.Assert(key, HasLen, 64)
+	owner := discoverd.NewClientWithKey(s.server.URL, key)
+	other := discoverd.NewClientWithKey(s.server.URL, "wrong")
+
+	// changes without the key are rejected, even before the config has been
+	// synced to the state
+	inst := fakeInstance()
+	for _, client := range []*discoverd.Client{s.client, other} {
+		_, err := client.RegisterInstance("b", inst)
+		c.Assert(discoverd.IsUnauthorized(err), Equals, true)
+		err = client.Service("b").SetConfig(&discoverd.ServiceConfig{})
+		c.Assert(discoverd.IsUnauthorized(err), Equals, true)
+		err = client.RemoveService("b")
+		c.Assert(discoverd.IsUnauthorized(err), Equals, true)
+	}
+
+	// reads don't need the key, and the key hash is not returned
+	waitForServiceConfig(c, s.state, "b", func(config *discoverd.ServiceConfig) bool { return config.KeyHash != "" })
+	config, err := s.client.Service("b").GetConfig()
+	c.Assert(err, IsNil)
+	c.Assert(config, DeepEquals, &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual})
+
+	// changes with the key are allowed
+	events := make(chan *discoverd.Event, 1)
+	s.state.Subscribe("b", false, discoverd.EventKindUp|discoverd.EventKindLeader|discoverd.EventKindDown, events)
+	hb, err := owner.RegisterInstance("b", inst)
+	c.Assert(err, IsNil)
+	assertEvent(c, events, "b", discoverd.EventKindUp, inst)
+	c.Assert(discoverd.IsUnauthorized(other.Service("b").SetLeader(inst.ID)), Equals, true)
+	c.Assert(owner.Service("b").SetLeader(inst.ID), IsNil)
+	assertEvent(c, events, "b", discoverd.EventKindLeader, inst)
+
+	// instances can't be removed without the key
+	req, err := http.NewRequest("DELETE", s.server.URL+"/services/b/instances/"+inst.ID, nil)
+	c.Assert(err, IsNil)
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 401)
+	c.Assert(hb.Close(), IsNil)
+	assertEvent(c, events, "b", discoverd.EventKindDown, inst)
+
+	// the key is kept when the config is changed
+	c.Assert(owner.Service("b").SetConfig(&discoverd.ServiceConfig{TTL: 5}), IsNil)
+	waitForServiceConfig(c, s.state, "b", func(config *discoverd.ServiceConfig) bool { return config.TTL == 5 })
+	c.Assert(s.state.GetConfig("b").KeyHash, Not(Equals), "")
+	c.Assert(discoverd.IsUnauthorized(other.RemoveService("b")), Equals, true)
+
+	c.Assert(owner.RemoveService("b"), IsNil)
+
+	// services created without a generated key can be changed by any
+	// client, even if the creator sent a key
+	c.Assert(other.AddService("c", nil), IsNil)
+	hb, err = s.client.RegisterInstance("c", fakeInstance())
+	c.Assert(err, IsNil)
+	c.Assert(hb.Close(), IsNil)
+	c.Assert(s.client.RemoveService("c"), IsNil)
+}
+
+func (s *HTTPSuite) TestReservedServices(c *C) {
+	platform := discoverd.NewClientWithKey(s.server.URL, testPlatformKey)
+	other := discoverd.NewClientWithKey(s.server.URL, "wrong")
+
+	// platform services without the prefix are also reserved
+	for _, client := range []*discoverd.Client{s.client, other} {
+		c.Assert(discoverd.IsUnauthorized(client.AddService("pg", nil)), Equals, true)
+	}
+	c.Assert(platform.AddService("pg", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual}), IsNil)
+	pgInst := fakeInstance()
+	pgHB, err := platform.RegisterInstance("pg", pgInst)
+	c.Assert(err, IsNil)
+	for _, client := range []*discoverd.Client{s.client, other} {
+		c.Assert(discoverd.IsUnauthorized(client.Service("pg").SetLeader(pgInst.ID)), Equals, true)
+	}
+	c.Assert(platform.Service("pg").SetLeader(pgInst.ID), IsNil)
+	c.Assert(pgHB.Close(), IsNil)
+	c.Assert(platform.RemoveService("pg"), IsNil)
+
+	// reserved services can't be created without the platform key
+	for _, client := range []*discoverd.Client{s.client, other} {
+		c.Assert(discoverd.IsUnauthorized(client.AddService("flynn-test", nil)), Equals, true)
+		_, err := client.AddServiceWithKey("flynn-test", nil)
+		c.Assert(discoverd.IsUnauthorized(err), Equals, true)
+		_, err = client.AddServiceAndRegister("flynn-test", "127.0.0.1:1111")
+		c.Assert(discoverd.IsUnauthorized(err), Equals, true)
+	}
+
+	events := make(chan *discoverd.Event, 1)
+	s.state.Subscribe("flynn-test", false, discoverd.EventKindUp|discoverd.EventKindDown, events)
+	inst := fakeInstance()
+	hb, err := platform.AddServiceAndRegisterInstance("flynn-test", inst)
+	c.Assert(err, IsNil)
+	assertEvent(c, events, "flynn-test", discoverd.EventKindUp, inst)
+
+	// or changed without it
+	for _, client := range []*discoverd.Client{s.client, other} {
+		_, err := client.RegisterInstance("flynn-test", fakeInstance())
+		c.Assert(discoverd.IsUnauthorized(err), Equals, true)
+		err = client.Service("flynn-test").SetConfig(&discoverd.ServiceConfig{})
+		c.Assert(discoverd.IsUnauthorized(err), Equals, true)
+		err = client.Service("flynn-test").SetLeader(inst.ID)
+		c.Assert(discoverd.IsUnauthorized(err), Equals, true)
+		err = client.RemoveService("flynn-test")
+		c.Assert(discoverd.IsUnauthorized(err), Equals, true)
+	}
+
+	// but can be read by any client
+	instances, err := s.client.Instances("flynn-test", time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(instances, HasLen, 1)
+
+	c.Assert(hb.Close(), IsNil)
+	assertEvent(c, events, "flynn-test", discoverd.EventKindDown, inst)
+	c.Assert(platform.RemoveService("flynn-test"), IsNil)
+}
+
+// waitForServiceConfig waits for the config of service to be synced to state
+func waitForServiceConfig(c *C, state *State, service string, f func(*discoverd.ServiceConfig) bool) {
+	timeout := time.After(5 * time.Second)
+	for {
+		if config := state.GetConfig(service); config != nil && f(config) {
+			return
+		}
+		select {
+		case <-timeout:
+			c.Fatalf("timed out waiting for the config of %s", service)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package server
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/boltdb/bolt"
+	"github.com/flynn/flynn/discoverd/client"
+)
+
+var servicesBucket = []byte("services")
+
+// NewLocalBackend returns a single node Backend which does not need an etcd
+// cluster, it is intended for development and testing.
+//
+// Services are kept in memory, and if path is set they are also persisted
+// with their config and leader in a bolt database at path. Instances are not
+// persisted as they are registered again by their heartbeats.
+func NewLocalBackend(path string, h SyncHandler) (Backend, error) {
+	b := &localBackend{
+		h:        h,
+		services: make(map[string]*localService),
+	}
+	if path == "" {
+		return b, nil
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	b.db = db
+	if err := b.restore(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+type localBackend struct {
+	h  SyncHandler
+	db *bolt.DB
+
+	mtx      sync.Mutex
+	services map[string]*localService
+	// index is incremented for each new instance, and is used as the Index
+	// of the instance like the etcd CreatedIndex
+	index uint64
+	// synced is true if changes are being sent to h
+	synced bool
+}
+
+type localService struct {
+	config    *discoverd.ServiceConfig
+	leaderID  string
+	instances map[string]*localInstance
+}
+
+type localInstance struct {
+	// data is the JSON encoded instance, a new instance is decoded for each
+	// SyncHandler call so that callers can't modify the stored instance
+	data   []byte
+	index  uint64
+	expiry *time.Timer
+}
+
+func (i *localInstance) instance() *discoverd.Instance {
+	inst := &discoverd.Instance{}
+	// data was encoded by AddInstance so it is always valid
+	json.Unmarshal(i.data, inst)
+	inst.Index = i.index
+	return inst
+}
+
+// restore loads the services persisted in the database.
+func (b *localBackend) restore() error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(servicesBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.ForEach(func(k, _ []byte) error {
+			sb := bucket.Bucket(k)
+			s := &localService{
+				leaderID:  string(sb.Get([]byte("leader"))),
+				instances: make(map[string]*localInstance),
+			}
+			if data := sb.Get([]byte("config")); data != nil {
+				s.config = &discoverd.ServiceConfig{}
+				if err := json.Unmarshal(data, s.config); err != nil {
+					return err
+				}
+			}
+			b.services[string(k)] = s
+			return nil
+		})
+	})
+}
+
+// persist runs fn with the bucket of service if the backend has a database.
+func (b *localBackend) persist(service string, fn func(*bolt.Bucket) error) error {
+	if b.db == nil {
+		return nil
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		sb, err := tx.Bucket(servicesBucket).CreateBucketIfNotExists([]byte(service))
+		if err != nil {
+			return err
+		}
+		return fn(sb)
+	})
+}
+
+func putConfig(sb *bolt.Bucket, config *discoverd.ServiceConfig) error {
+	if config == nil {
+		return sb.Delete([]byte("config"))
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return sb.Put([]byte("config"), data)
+}
+
+func (b *localBackend) AddService(service string, config *discoverd.ServiceConfig) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if _, ok := b.services[service]; ok {
+		return ServiceExistsError(service)
+	}
+	if err := b.persist(service, func(sb *bolt.Bucket) error { return putConfig(sb, config) }); err != nil {
+		return err
+	}
+	b.services[service] = &localService{
+		config:    config,
+		instances: make(map[string]*localInstance),
+	}
+	if b.synced {
+		b.h.AddService(service)
+		if config != nil {
+			b.h.SetServiceConfig(service, config)
+		}
+	}
+	return nil
+}
+
+func (b *localBackend) RemoveService(service string) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	s, ok := b.services[service]
+	if !ok {
+		return NotFoundError{Service: service}
+	}
+	if b.db != nil {
+		if err := b.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(servicesBucket).DeleteBucket([]byte(service))
+		}); err != nil {
+			return err
+		}
+	}
+	for _, inst := range s.instances {
+		inst.expiry.Stop()
+	}
+	delete(b.services, service)
+	if b.synced {
+		b.h.RemoveService(service)
+	}
+	return nil
+}
+
+func (b *localBackend) AddInstance(service string, inst *discoverd.Instance) error {
+	data, err := json.Marshal(inst)
+	if err != nil {
+		return err
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	s, ok := b.services[service]
+	if !ok {
+		return NotFoundError{Service: service}
+	}
+
+	li := &localInstance{data: data}
+	if existing, ok := s.instances[inst.ID]; ok {
+		existing.expiry.Stop()
+		li.index = existing.index
+	} else {
+		b.index++
+		li.index = b.index
+	}
+	ttl := time.Duration(instanceTTL(inst, s.config)) * time.Second
+	li.expiry = time.AfterFunc(ttl, func() { b.expire(service, inst.ID, li) })
+	s.instances[inst.ID] = li
+
+	if b.synced {
+		b.h.AddInstance(service, li.instance())
+	}
+	return nil
+}
+
+// expire removes an instance which has not been updated within its TTL.
+func (b *localBackend) expire(service, id string, inst *localInstance) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	s, ok := b.services[service]
+	if !ok || s.instances[id] != inst {
+		// the instance has been updated or removed
+		return
+	}
+	delete(s.instances, id)
+	if b.synced {
+		b.h.RemoveInstance(service, id)
+	}
+}
+
+func (b *localBackend) RemoveInstance(service, id string) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	s, ok := b.services[service]
+	if !ok {
+		return NotFoundError{Service: service, Instance: id}
+	}
+	inst, ok := s.instances[id]
+	if !ok {
+		return NotFoundError{Service: service, Instance: id}
+	}
+	inst.expiry.Stop()
+	delete(s.instances, id)
+	if b.synced {
+		b.h.RemoveInstance(service, id)
+	}
+	return nil
+}
+
+func (b *localBackend) SetServiceConfig(service string, config *discoverd.ServiceConfig) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	s, ok := b.services[service]
+	if !ok {
+		return NotFoundError{Service: service}
+	}
+	if err := b.persist(service, func(sb *bolt.Bucket) error { return putConfig(sb, config) }); err != nil {
+		return err
+	}
+	s.config = config
+	if b.synced {
+		b.h.SetServiceConfig(service, config)
+	}
+	return nil
+}
+
+func (b *localBackend) ServiceConfig(service string) (*discoverd.ServiceConfig, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	s, ok := b.services[service]
+	if !ok || s.config == nil {
+		return nil, nil
+	}
+	config := *s.config
+	return &config, nil
+}
+
+func (b *localBackend) SetLeader(service, id string) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	s, ok := b.services[service]
+	if !ok {
+		return NotFoundError{Service: service, Instance: id}
+	}
+	if _, ok := s.instances[id]; !ok {
+		return NotFoundError{Service: service, Instance: id}
+	}
+	if err := b.persist(service, func(sb *bolt.Bucket) error {
+		return sb.Put([]byte("leader"), []byte(id))
+	}); err != nil {
+		return err
+	}
+	s.leaderID = id
+	if b.synced {
+		b.h.SetManualLeader(service, id)
+	}
+	return nil
+}
+
+// StartSync sends the current services to the SyncHandler, and then sends
+// each change as it is made.
+func (b *localBackend) StartSync() error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for name, s := range b.services {
+		instances := make([]*discoverd.Instance, 0, len(s.instances))
+		for _, inst := range s.instances {
+			instances = append(instances, inst.instance())
+		}
+		// set the config and leader first so that the leader is only
+		// elected once
+		b.h.AddService(name)
+		b.h.SetServiceConfig(name, s.config)
+		b.h.SetManualLeader(name, s.leaderID)
+		b.h.SetService(name, instances)
+	}
+	// remove any services that the backend doesn't have
+	for _, name := range b.h.ListServices() {
+		if _, ok := b.services[name]; !ok {
+			b.h.SetService(name, nil)
+		}
+	}
+	b.synced = true
+	return nil
+}
+
+func (b *localBackend) Close() error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.synced = false
+	for _, s := range b.services {
+		for _, inst := range s.instances {
+			inst.expiry.Stop()
+		}
+	}
+	if b.db != nil {
+		err := b.db.Close()
+		b.db = nil
+		return err
+	}
+	return nil
+}
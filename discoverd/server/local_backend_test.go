@@ -0,0 +1,80 @@
+package server
+
+import (
+	"path/filepath"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/discoverd/client"
+)
+
+// LocalSuite runs the EtcdSuite tests against the local backend
+type LocalSuite struct {
+	EtcdSuite
+}
+
+var _ = Suite(&LocalSuite{})
+
+func (s *LocalSuite) SetUpTest(c *C) {
+	s.state = NewState()
+	var err error
+	s.backend, err = NewLocalBackend("", s.state)
+	c.Assert(err, IsNil)
+}
+
+// LocalHTTPSuite runs the HTTPSuite tests against the local backend
+type LocalHTTPSuite struct {
+	HTTPSuite
+}
+
+var _ = Suite(&LocalHTTPSuite{})
+
+func (s *LocalHTTPSuite) SetUpTest(c *C) {
+	s.cleanup = nil
+	s.state = NewState()
+	var err error
+	s.backend, err = NewLocalBackend("", s.state)
+	c.Assert(err, IsNil)
+	s.setup(c)
+}
+
+func (s *LocalSuite) TestPersistence(c *C) {
+	path := filepath.Join(c.MkDir(), "discoverd.db")
+	backend, err := NewLocalBackend(path, s.state)
+	c.Assert(err, IsNil)
+
+	config := &discoverd.ServiceConfig{TTL: 5, LeaderType: discoverd.LeaderTypeManual}
+	c.Assert(backend.AddService("a", config), IsNil)
+	c.Assert(backend.AddService("b", nil), IsNil)
+	c.Assert(backend.AddService("c", nil), IsNil)
+	c.Assert(backend.RemoveService("c"), IsNil)
+	inst := fakeInstance()
+	c.Assert(backend.AddInstance("a", inst), IsNil)
+	c.Assert(backend.SetLeader("a", inst.ID), IsNil)
+	c.Assert(backend.Close(), IsNil)
+
+	// services, config and leaders are restored but instances are not
+	state := NewState()
+	backend, err = NewLocalBackend(path, state)
+	c.Assert(err, IsNil)
+	defer backend.Close()
+	c.Assert(backend.StartSync(), IsNil)
+	c.Assert(state.Get("a"), HasLen, 0)
+	c.Assert(state.Get("b"), NotNil)
+	c.Assert(state.Get("c"), IsNil)
+	c.Assert(state.GetConfig("a"), DeepEquals, config)
+	c.Assert(state.GetConfig("b"), IsNil)
+	stored, err := backend.ServiceConfig("a")
+	c.Assert(err, IsNil)
+	c.Assert(stored, DeepEquals, config)
+	stored, err = backend.ServiceConfig("b")
+	c.Assert(err, IsNil)
+	c.Assert(stored, IsNil)
+
+	// the leader is elected when the instance registers again
+	events := make(chan *discoverd.Event, 1)
+	state.Subscribe("a", false, discoverd.EventKindLeader, events)
+	c.Assert(backend.AddInstance("a", fakeInstance()), IsNil)
+	assertNoEvent(c, events)
+	c.Assert(backend.AddInstance("a", inst), IsNil)
+	assertEvent(c, events, "a", discoverd.EventKindLeader, inst)
+}
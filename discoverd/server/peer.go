@@ -0,0 +1,376 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/stream"
+)
+
+// Peer mirrors services from the discoverd of another cluster. The mirrored
+// services are read-only and are named <service>.<peer name>, so pg on the
+// peer-east peer is pg.peer-east.
+type Peer struct {
+	Name     string
+	Services []string
+
+	client *discoverd.Client
+	state  *State
+
+	mtx     sync.Mutex
+	streams map[string]stream.Stream
+	stop    chan struct{}
+}
+
+// reservedPeerNames are labels with a special meaning in DNS lookups, which
+// would be ambiguous as peer names.
+var reservedPeerNames = map[string]struct{}{
+	"leader": {},
+}
+
+var ErrReservedPeerName = errors.New("discoverd: peer name is reserved")
+
+// NewPeer returns a Peer which mirrors services from the discoverd at url once
+// started.
+func NewPeer(name, url string, services []string) (*Peer, error) {
+	if err := ValidServiceName(name); err != nil {
+		return nil, err
+	}
+	if _, ok := reservedPeerNames[name]; ok {
+		return nil, ErrReservedPeerName
+	}
+	return &Peer{
+		Name:     name,
+		Services: services,
+		client:   discoverd.NewClientWithURL(url),
+		state:    NewState(),
+		streams:  make(map[string]stream.Stream, len(services)),
+		stop:     make(chan struct{}),
+	}, nil
+}
+
+// ServiceName returns the local name of a service mirrored from the peer.
+func (p *Peer) ServiceName(service string) string {
+	return service + "." + p.Name
+}
+
+// Start starts mirroring the services, they are kept in sync until Close is
+// called.
+func (p *Peer) Start() {
+	for _, service := range p.Services {
+		name := p.ServiceName(service)
+		// the peer picks the leader, so use the leader from its events
+		p.state.AddService(name)
+		p.state.SetServiceConfig(name, &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual})
+		go p.watch(service, name)
+	}
+}
+
+func (p *Peer) Close() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	select {
+	case <-p.stop:
+		return nil
+	default:
+	}
+	close(p.stop)
+	for _, s := range p.streams {
+		s.Close()
+	}
+	return nil
+}
+
+const peerRetryInterval = 5 * time.Second
+
+// watch mirrors a service until the peer is closed, reconnecting if the watch
+// fails. The last known instances are served while disconnected.
+func (p *Peer) watch(service, name string) {
+	for {
+		events := make(chan *discoverd.Event)
+		s, err := p.client.Service(service).Watch(events)
+		if err == nil && p.setStream(service, s) {
+			p.mirror(name, events)
+			err = s.Err()
+		}
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+		log.Printf("Error watching service %s on peer %s, retrying in %s: %v", service, p.Name, peerRetryInterval, err)
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(peerRetryInterval):
+		}
+	}
+}
+
+// setStream tracks the watch stream of service so that it is closed by Close,
+// it returns false if the peer has already been closed.
+func (p *Peer) setStream(service string, s stream.Stream) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	select {
+	case <-p.stop:
+		s.Close()
+		return false
+	default:
+	}
+	p.streams[service] = s
+	return true
+}
+
+// mirror applies the events of a service watch to the state. The events before
+// the current event are the instances and leader of the service, which
+// replace the existing mirrored state.
+func (p *Peer) mirror(name string, events chan *discoverd.Event) {
+	current := false
+	instances := []*discoverd.Instance{}
+	var leaderID string
+	for e := range events {
+		if !current {
+			switch e.Kind {
+			case discoverd.EventKindUp:
+				instances = append(instances, e.Instance)
+			case discoverd.EventKindLeader:
+				leaderID = e.Instance.ID
+			case discoverd.EventKindCurrent:
+				p.state.SetService(name, instances)
+				p.state.SetManualLeader(name, leaderID)
+				current = true
+			}
+			continue
+		}
+		switch e.Kind {
+		case discoverd.EventKindUp, discoverd.EventKindUpdate:
+			p.state.AddInstance(name, e.Instance)
+		case discoverd.EventKindDown:
+			p.state.RemoveInstance(name, e.Instance.ID)
+		case discoverd.EventKindLeader:
+			p.state.SetManualLeader(name, e.Instance.ID)
+		}
+	}
+}
+
+// FederatedStore is a Datastore which also serves the services of peers. Peer
+// services are read-only, writes to them fail as the backend does not have
+// them.
+type FederatedStore struct {
+	Datastore
+	peers map[string]*Peer
+}
+
+// NewFederatedStore returns a store which serves the services of ds and
+// peers. It fails if a peer has the same name as a local service, as DNS
+// lookups of the service would be ambiguous.
+func NewFederatedStore(ds Datastore, peers []*Peer) (*FederatedStore, error) {
+	s := &FederatedStore{
+		Datastore: ds,
+		peers:     make(map[string]*Peer, len(peers)),
+	}
+	for _, p := range peers {
+		if _, ok := s.peers[p.Name]; ok {
+			return nil, fmt.Errorf("discoverd: duplicate peer %s", p.Name)
+		}
+		s.peers[p.Name] = p
+	}
+	for _, service := range ds.ListServices() {
+		if s.IsPeer(service) {
+			return nil, fmt.Errorf("discoverd: peer %s has the same name as a local service", service)
+		}
+	}
+	return s, nil
+}
+
+var ErrPeerServiceName = errors.New("discoverd: service name is the name of a peer")
+
+// AddService adds a local service, which must not have the name of a peer.
+func (s *FederatedStore) AddService(service string, config *discoverd.ServiceConfig) error {
+	if s.IsPeer(service) {
+		return ErrPeerServiceName
+	}
+	return s.Datastore.AddService(service, config)
+}
+
+// IsPeer returns whether name is the name of a peer.
+func (s *FederatedStore) IsPeer(name string) bool {
+	_, ok := s.peers[name]
+	return ok
+}
+
+// peerState returns the state of the peer that service is mirrored from, or
+// nil if it is a local service.
+func (s *FederatedStore) peerState(service string) *State {
+	i := strings.LastIndex(service, ".")
+	if i == -1 {
+		return nil
+	}
+	if p, ok := s.peers[service[i+1:]]; ok {
+		return p.state
+	}
+	return nil
+}
+
+func (s *FederatedStore) Get(service string) []*discoverd.Instance {
+	if state := s.peerState(service); state != nil {
+		return state.Get(service)
+	}
+	return s.Datastore.Get(service)
+}
+
+func (s *FederatedStore) GetLeader(service string) *discoverd.Instance {
+	if state := s.peerState(service); state != nil {
+		return state.GetLeader(service)
+	}
+	return s.Datastore.GetLeader(service)
+}
+
+func (s *FederatedStore) GetConfig(service string) *discoverd.ServiceConfig {
+	if state := s.peerState(service); state != nil {
+		return state.GetConfig(service)
+	}
+	return s.Datastore.GetConfig(service)
+}
+
+// ListServices returns the local services and the services mirrored from
+// peers.
+func (s *FederatedStore) ListServices() []string {
+	services := s.Datastore.ListServices()
+	for _, p := range s.peers {
+		services = append(services, p.state.ListServices()...)
+	}
+	return services
+}
+
+// Subscribe subscribes to the events of a local or peer service. Subscribing
+// to allServices receives the events of the local services and the services
+// mirrored from peers.
+func (s *FederatedStore) Subscribe(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream {
+	if service == allServices && len(s.peers) > 0 {
+		return s.subscribeAll(sendCurrent, kinds, ch)
+	}
+	if state := s.peerState(service); state != nil {
+		return state.Subscribe(service, sendCurrent, kinds, ch)
+	}
+	return s.Datastore.Subscribe(service, sendCurrent, kinds, ch)
+}
+
+// subscribeAll subscribes to every service of the local store and the peers,
+// forwarding their events to ch. A single current event is sent once the
+// current events of every store have been sent, and ch is closed once all of
+// the subscriptions have been closed. If any subscription is closed, they all
+// are.
+func (s *FederatedStore) subscribeAll(sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream {
+	subscribers := []func(chan *discoverd.Event) stream.Stream{
+		func(c chan *discoverd.Event) stream.Stream {
+			return s.Datastore.Subscribe(allServices, sendCurrent, kinds|discoverd.EventKindCurrent, c)
+		},
+	}
+	for _, p := range s.peers {
+		state := p.state
+		subscribers = append(subscribers, func(c chan *discoverd.Event) stream.Stream {
+			return state.Subscribe(allServices, sendCurrent, kinds|discoverd.EventKindCurrent, c)
+		})
+	}
+
+	m := &multiStream{
+		ch:      ch,
+		streams: make([]stream.Stream, 0, len(subscribers)),
+	}
+	var wg sync.WaitGroup
+	var current sync.WaitGroup
+	for _, subscribe := range subscribers {
+		c := make(chan *discoverd.Event, cap(ch))
+		wg.Add(1)
+		current.Add(1)
+		go func() {
+			defer wg.Done()
+			defer m.Close()
+			sentCurrent := !sendCurrent
+			if sentCurrent {
+				current.Done()
+			}
+			for e := range c {
+				if e.Kind == discoverd.EventKindCurrent {
+					if !sentCurrent {
+						sentCurrent = true
+						current.Done()
+					}
+					continue
+				}
+				ch <- e
+			}
+			if !sentCurrent {
+				current.Done()
+			}
+		}()
+		m.add(subscribe(c))
+	}
+	if sendCurrent && kinds&discoverd.EventKindCurrent != 0 {
+		current.Wait()
+		ch <- &discoverd.Event{
+			Service: allServices,
+			Kind:    discoverd.EventKindCurrent,
+		}
+	}
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+	return m
+}
+
+// multiStream is a stream of the events of several subscriptions.
+type multiStream struct {
+	ch chan *discoverd.Event
+
+	mtx     sync.Mutex
+	streams []stream.Stream
+	closed  bool
+}
+
+func (m *multiStream) add(s stream.Stream) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.streams = append(m.streams, s)
+	if m.closed {
+		s.Close()
+	}
+}
+
+func (m *multiStream) Close() error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	go func() {
+		// drain channel to prevent deadlocks
+		for range m.ch {
+		}
+	}()
+	for _, s := range m.streams {
+		s.Close()
+	}
+	return nil
+}
+
+// Err returns the first error of the subscriptions.
+func (m *multiStream) Err() error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for _, s := range m.streams {
+		if err := s.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
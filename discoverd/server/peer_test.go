@@ -0,0 +1,161 @@
+package server
+
+import (
+	"net/http/httptest"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/discoverd/client"
+)
+
+type PeerSuite struct {
+	remote  *discoverd.Client
+	peer    *Peer
+	store   *FederatedStore
+	cleanup []func()
+}
+
+var _ = Suite(&PeerSuite{})
+
+func (s *PeerSuite) SetUpTest(c *C) {
+	s.cleanup = nil
+
+	// the remote cluster
+	state := NewState()
+	backend, err := NewLocalBackend("", state)
+	c.Assert(err, IsNil)
+	c.Assert(backend.StartSync(), IsNil)
+	s.cleanup = append(s.cleanup, func() { backend.Close() })
+	srv := httptest.NewServer(NewHTTPHandler(NewBasicDatastore(state, backend), nil, ""))
+	s.cleanup = append(s.cleanup, srv.Close)
+	s.remote = discoverd.NewClientWithURL(srv.URL)
+
+	// the local cluster
+	localState := NewState()
+	localBackend, err := NewLocalBackend("", localState)
+	c.Assert(err, IsNil)
+	c.Assert(localBackend.StartSync(), IsNil)
+	s.cleanup = append(s.cleanup, func() { localBackend.Close() })
+	s.peer, err = NewPeer("peer-east", srv.URL, []string{"pg"})
+	c.Assert(err, IsNil)
+	s.cleanup = append(s.cleanup, func() { s.peer.Close() })
+	s.store, err = NewFederatedStore(NewBasicDatastore(localState, localBackend), []*Peer{s.peer})
+	c.Assert(err, IsNil)
+}
+
+func (s *PeerSuite) TearDownTest(c *C) {
+	for i := len(s.cleanup); i != 0; i-- {
+		s.cleanup[i-1]()
+	}
+}
+
+func (s *PeerSuite) TestMirror(c *C) {
+	// existing instances are mirrored when the peer starts
+	first := fakeInstance()
+	_, err := s.remote.AddServiceAndRegisterInstance("pg", first)
+	c.Assert(err, IsNil)
+
+	events := make(chan *discoverd.Event, 2)
+	s.store.Subscribe("pg.peer-east", false, discoverd.EventKindUp|discoverd.EventKindDown|discoverd.EventKindLeader, events)
+	s.peer.Start()
+	assertEvent(c, events, "pg.peer-east", discoverd.EventKindUp, first)
+	assertEvent(c, events, "pg.peer-east", discoverd.EventKindLeader, first)
+	assertInstanceEqual(c, s.store.GetLeader("pg.peer-east"), first)
+
+	// changes are mirrored
+	second := fakeInstance()
+	hb, err := s.remote.RegisterInstance("pg", second)
+	c.Assert(err, IsNil)
+	assertEvent(c, events, "pg.peer-east", discoverd.EventKindUp, second)
+	c.Assert(s.store.Get("pg.peer-east"), HasLen, 2)
+	c.Assert(hb.Close(), IsNil)
+	assertEvent(c, events, "pg.peer-east", discoverd.EventKindDown, second)
+
+	// the leader is the leader of the peer service
+	config := &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual}
+	c.Assert(s.remote.Service("pg").SetConfig(config), IsNil)
+	third := fakeInstance()
+	_, err = s.remote.RegisterInstance("pg", third)
+	c.Assert(err, IsNil)
+	assertEvent(c, events, "pg.peer-east", discoverd.EventKindUp, third)
+	c.Assert(s.remote.Service("pg").SetLeader(third.ID), IsNil)
+	assertEvent(c, events, "pg.peer-east", discoverd.EventKindLeader, third)
+
+	// peer services are read-only
+	c.Assert(s.store.AddInstance("pg.peer-east", fakeInstance()), NotNil)
+	c.Assert(s.store.RemoveInstance("pg.peer-east", first.ID), NotNil)
+
+	// local services are unaffected
+	c.Assert(s.store.Get("pg"), IsNil)
+	c.Assert(s.store.Get("pg.peer-west"), IsNil)
+}
+
+func (s *PeerSuite) TestSubscribeAll(c *C) {
+	local := fakeInstance()
+	c.Assert(s.store.AddService("web", nil), IsNil)
+	c.Assert(s.store.AddInstance("web", local), IsNil)
+	remote := fakeInstance()
+	_, err := s.remote.AddServiceAndRegisterInstance("pg", remote)
+	c.Assert(err, IsNil)
+	s.peer.Start()
+	waitForPeerService(c, s.store, "pg.peer-east", 1)
+
+	// the current instances of local and peer services are sent before a
+	// single current event
+	events := make(chan *discoverd.Event, 64)
+	stream := s.store.Subscribe(allServices, true, discoverd.EventKindUp|discoverd.EventKindDown|discoverd.EventKindCurrent, events)
+	up := make(map[string]*discoverd.Instance)
+	for len(up) < 2 {
+		e := <-events
+		c.Assert(e.Kind, Equals, discoverd.EventKindUp)
+		up[e.Service] = e.Instance
+	}
+	assertInstanceEqual(c, up["web"], local)
+	assertInstanceEqual(c, up["pg.peer-east"], remote)
+	assertEvent(c, events, allServices, discoverd.EventKindCurrent, nil)
+
+	// changes to local and peer services are sent
+	second := fakeInstance()
+	hb, err := s.remote.RegisterInstance("pg", second)
+	c.Assert(err, IsNil)
+	assertEvent(c, events, "pg.peer-east", discoverd.EventKindUp, second)
+	c.Assert(hb.Close(), IsNil)
+	assertEvent(c, events, "pg.peer-east", discoverd.EventKindDown, second)
+	c.Assert(s.store.RemoveInstance("web", local.ID), IsNil)
+	assertEvent(c, events, "web", discoverd.EventKindDown, local)
+
+	// closing the stream closes the channel
+	c.Assert(stream.Close(), IsNil)
+	for range events {
+	}
+	c.Assert(stream.Err(), IsNil)
+}
+
+func (s *PeerSuite) TestNames(c *C) {
+	// names used in DNS lookups can't be peers
+	_, err := NewPeer("leader", "127.0.0.1:0", nil)
+	c.Assert(err, Equals, ErrReservedPeerName)
+	_, err = NewPeer("_m", "127.0.0.1:0", nil)
+	c.Assert(err, Equals, ErrInvalidService)
+
+	// local services can't have the name of a peer
+	c.Assert(s.store.AddService("peer-east", nil), Equals, ErrPeerServiceName)
+	c.Assert(s.store.AddService("peer-west", nil), IsNil)
+
+	// peers can't have the name of a local service
+	peer, err := NewPeer("peer-west", "127.0.0.1:0", nil)
+	c.Assert(err, IsNil)
+	_, err = NewFederatedStore(s.store.Datastore, []*Peer{peer})
+	c.Assert(err, NotNil)
+}
+
+func waitForPeerService(c *C, store *FederatedStore, service string, n int) {
+	timeout := time.After(5 * time.Second)
+	for len(store.Get(service)) != n {
+		select {
+		case <-timeout:
+			c.Fatalf("timed out waiting for %d instances of %s", n, service)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -54,6 +54,12 @@ type service struct {
 	// instance ID -> instance
 	instances map[string]*discoverd.Instance
 
+	config *discoverd.ServiceConfig
+	// manualLeaderID is the leader set for services using the manual leader
+	// type. It is kept while the instance is not registered so that the
+	// instance becomes leader again if it re-registers.
+	manualLeaderID string
+
 	leaderID string
 	// leaderIndex is >0 when set, zero is unset
 	leaderIndex uint64
@@ -62,17 +68,59 @@ type service struct {
 	notifyLeader bool
 }
 
+func (s *service) leaderType() discoverd.LeaderType {
+	if s.config == nil || s.config.LeaderType == "" {
+		return discoverd.LeaderTypeOldest
+	}
+	return s.config.LeaderType
+}
+
+func (s *service) setLeader(inst *discoverd.Instance) {
+	if inst == nil {
+		s.leaderID = ""
+		s.leaderIndex = 0
+		return
+	}
+	s.notifyLeader = s.notifyLeader || inst.ID != s.leaderID
+	s.leaderID = inst.ID
+	s.leaderIndex = inst.Index
+}
+
+// maybeSetLeader makes inst the leader if it should replace the current
+// leader.
 func (s *service) maybeSetLeader(inst *discoverd.Instance) {
-	if s.leaderIndex == 0 || s.leaderIndex > inst.Index {
-		s.notifyLeader = s.notifyLeader || inst.ID != s.leaderID
-		s.leaderID = inst.ID
-		s.leaderIndex = inst.Index
+	switch s.leaderType() {
+	case discoverd.LeaderTypeManual:
+		if inst.ID == s.manualLeaderID {
+			s.setLeader(inst)
+		}
+	case discoverd.LeaderTypeOldest:
+		sticky := s.config != nil && s.config.StickyLeader
+		if s.leaderID == "" || !sticky && (s.leaderIndex == 0 || s.leaderIndex > inst.Index) {
+			s.setLeader(inst)
+		}
 	}
 }
 
+// maybePickLeader elects a leader from all of the instances.
 func (s *service) maybePickLeader() {
-	for _, inst := range s.instances {
-		s.maybeSetLeader(inst)
+	switch s.leaderType() {
+	case discoverd.LeaderTypeNone:
+		s.setLeader(nil)
+	case discoverd.LeaderTypeManual:
+		s.setLeader(s.instances[s.manualLeaderID])
+	case discoverd.LeaderTypeOldest:
+		if _, ok := s.instances[s.leaderID]; ok && s.config != nil && s.config.StickyLeader {
+			return
+		}
+		// prefer the current leader if there are instances with the same index
+		oldest := s.instances[s.leaderID]
+		for _, inst := range s.instances {
+			if oldest == nil || inst.Index < oldest.Index {
+				oldest = inst
+			}
+		}
+		s.setLeader(oldest)
 	}
 }
 
@@ -90,19 +138,13 @@ func (s *service) RemoveInstance(id string) *discoverd.Instance {
 	}
 	delete(s.instances, id)
 	if inst.ID == s.leaderID {
-		s.leaderID = ""
-		s.leaderIndex = 0
+		s.setLeader(nil)
 		s.maybePickLeader()
 	}
 	return inst
 }
 
 func (s *service) SetInstances(data map[string]*discoverd.Instance) {
-	if _, ok := data[s.leaderID]; !ok {
-		// the current leader is not in the new set
-		s.leaderID = ""
-		s.leaderIndex = 0
-	}
 	s.instances = data
 	s.maybePickLeader()
 }
@@ -263,6 +305,44 @@ func (s *State) SetService(serviceName string, data []*discoverd.Instance) {
 	}
 }
 
+// SetServiceConfig sets the config of an existing service, re-electing the
+// leader if the leader type changed.
+func (s *State) SetServiceConfig(serviceName string, config *discoverd.ServiceConfig) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	data, ok := s.services[serviceName]
+	if !ok {
+		return
+	}
+	data.config = config
+	data.maybePickLeader()
+	s.broadcastLeader(serviceName)
+}
+
+// SetManualLeader sets the leader of a service using the manual leader type.
+func (s *State) SetManualLeader(serviceName, id string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	data, ok := s.services[serviceName]
+	if !ok {
+		return
+	}
+	data.manualLeaderID = id
+	data.maybePickLeader()
+	s.broadcastLeader(serviceName)
+}
+
+// GetConfig returns the config of service, or nil if it is not set.
+func (s *State) GetConfig(service string) *discoverd.ServiceConfig {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	data, ok := s.services[service]
+	if !ok {
+		return nil
+	}
+	return data.config
+}
+
 func (s *State) GetLeader(service string) *discoverd.Instance {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
@@ -300,6 +380,20 @@ func (s *State) getLocked(name string) []*discoverd.Instance {
 	return res
 }
 
+// filterInstances returns the instances which match meta, preserving order.
+func filterInstances(instances []*discoverd.Instance, meta map[string]string) []*discoverd.Instance {
+	if len(meta) == 0 {
+		return instances
+	}
+	res := make([]*discoverd.Instance, 0, len(instances))
+	for _, inst := range instances {
+		if inst.MatchesMeta(meta) {
+			res = append(res, inst)
+		}
+	}
+	return res
+}
+
 type subscription struct {
 	kinds discoverd.EventKind
 	ch    chan *discoverd.Event
@@ -345,17 +439,32 @@ func (s *subscription) close() {
 	s.closed = true
 }
 
+// allServices is the service name used to subscribe to the events of every
+// service.
+const allServices = "*"
+
+// Subscribe sends events of the given kinds for service to ch, or the events
+// of all services if service is "*".
 func (s *State) Subscribe(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream {
 	// Grab a copy of the state if we need it. If we do this later we risk
 	// a deadlock as updates are broadcast with mtx and subscribersMtx both
 	// locked.
-	var current []*discoverd.Instance
-	var currentLeader *discoverd.Instance
+	var current []*discoverd.Event
 	getCurrent := sendCurrent && kinds&(discoverd.EventKindUp|discoverd.EventKindLeader) != 0
 	if getCurrent {
 		s.mtx.RLock()
-		current = s.getLocked(service)
-		currentLeader = s.services[service].Leader()
+		if service == allServices {
+			names := make([]string, 0, len(s.services))
+			for name := range s.services {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				current = append(current, s.currentEventsLocked(name, kinds)...)
+			}
+		} else {
+			current = s.currentEventsLocked(service, kinds)
+		}
 	}
 
 	s.subscribersMtx.Lock()
@@ -380,22 +489,9 @@ func (s *State) Subscribe(service string, sendCurrent bool, kinds discoverd.Even
 	}
 	sub.el = l.PushBack(sub)
 
-	if kinds&discoverd.EventKindUp != 0 {
-		for _, inst := range current {
-			ch <- &discoverd.Event{
-				Service:  service,
-				Kind:     discoverd.EventKindUp,
-				Instance: inst,
-			}
-			// TODO: add a timeout to sends so that clients can't slow things down too much
-		}
-	}
-	if kinds&discoverd.EventKindLeader != 0 && currentLeader != nil {
-		ch <- &discoverd.Event{
-			Service:  service,
-			Kind:     discoverd.EventKindLeader,
-			Instance: currentLeader,
-		}
+	for _, e := range current {
+		ch <- e
+		// TODO: add a timeout to sends so that clients can't slow things down too much
 	}
 	if sendCurrent && kinds&discoverd.EventKindCurrent != 0 {
 		ch <- &discoverd.Event{
@@ -407,17 +503,44 @@ func (s *State) Subscribe(service string, sendCurrent bool, kinds discoverd.Even
 	return sub
 }
 
+// currentEventsLocked returns the up events for the instances of service and
+// the leader event for its leader, filtered by kinds.
+func (s *State) currentEventsLocked(service string, kinds discoverd.EventKind) []*discoverd.Event {
+	var events []*discoverd.Event
+	if kinds&discoverd.EventKindUp != 0 {
+		for _, inst := range s.getLocked(service) {
+			events = append(events, &discoverd.Event{
+				Service:  service,
+				Kind:     discoverd.EventKindUp,
+				Instance: inst,
+			})
+		}
+	}
+	if leader := s.services[service].Leader(); kinds&discoverd.EventKindLeader != 0 && leader != nil {
+		events = append(events, &discoverd.Event{
+			Service:  service,
+			Kind:     discoverd.EventKindLeader,
+			Instance: leader,
+		})
+	}
+	return events
+}
+
 var ErrSendBlocked = errors.New("discoverd: channel send failed due to blocked receiver")
 
 func (s *State) broadcast(event *discoverd.Event) {
 	s.subscribersMtx.Lock()
 	defer s.subscribersMtx.Unlock()
 
-	l, ok := s.subscribers[event.Service]
-	if !ok {
-		return
+	if l, ok := s.subscribers[event.Service]; ok {
+		broadcastList(l, event)
 	}
+	if l, ok := s.subscribers[allServices]; ok {
+		broadcastList(l, event)
+	}
+}
 
+func broadcastList(l *list.List, event *discoverd.Event) {
 	for e := l.Front(); e != nil; e = e.Next() {
 		sub := e.Value.(*subscription)
 
@@ -495,6 +495,23 @@ func (StateSuite) TestListServices(c *C) {
 	c.Assert(services, DeepEquals, []string{"a", "b"})
 }
 
+func (StateSuite) TestSubscribeAll(c *C) {
+	state := NewState()
+	a := fakeInstance()
+	state.AddInstance("a", a)
+
+	events := make(chan *discoverd.Event, 4)
+	state.Subscribe("*", true, discoverd.EventKindUp|discoverd.EventKindDown|discoverd.EventKindCurrent, events)
+	assertEvent(c, events, "a", discoverd.EventKindUp, a)
+	assertEvent(c, events, "*", discoverd.EventKindCurrent, nil)
+
+	b := fakeInstance()
+	state.AddInstance("b", b)
+	assertEvent(c, events, "b", discoverd.EventKindUp, b)
+	state.RemoveInstance("a", a.ID)
+	assertEvent(c, events, "a", discoverd.EventKindDown, a)
+}
+
 func (StateSuite) TestAddRemoveService(c *C) {
 	state := NewState()
 
@@ -515,6 +532,120 @@ func (StateSuite) TestAddRemoveService(c *C) {
 	c.Assert(state.Get("a"), IsNil)
 }
 
+func (StateSuite) TestServiceConfig(c *C) {
+	state := NewState()
+
+	// config is not stored for services that don't exist
+	state.SetServiceConfig("a", &discoverd.ServiceConfig{TTL: 5})
+	c.Assert(state.GetConfig("a"), IsNil)
+
+	state.AddService("a")
+	c.Assert(state.GetConfig("a"), IsNil)
+	state.SetServiceConfig("a", &discoverd.ServiceConfig{TTL: 5})
+	c.Assert(state.GetConfig("a"), DeepEquals, &discoverd.ServiceConfig{TTL: 5})
+
+	inst := fakeInstance()
+	c.Assert(instanceTTL(inst, nil), Equals, defaultTTL)
+	c.Assert(instanceTTL(inst, state.GetConfig("a")), Equals, 5)
+	inst.TTL = 2
+	c.Assert(instanceTTL(inst, state.GetConfig("a")), Equals, 2)
+}
+
+func (StateSuite) TestStickyLeader(c *C) {
+	state := NewState()
+	events := make(chan *discoverd.Event, 1)
+	state.Subscribe("a", false, discoverd.EventKindLeader, events)
+	state.AddService("a")
+	state.SetServiceConfig("a", &discoverd.ServiceConfig{StickyLeader: true})
+
+	first := fakeInstance()
+	first.Index = 3
+	state.AddInstance("a", first)
+	assertEvent(c, events, "a", discoverd.EventKindLeader, first)
+
+	// instance with lower index doesn't replace the leader
+	second := fakeInstance()
+	second.Index = 2
+	state.AddInstance("a", second)
+	assertNoEvent(c, events)
+	state.SetService("a", []*discoverd.Instance{first, second})
+	assertNoEvent(c, events)
+	c.Assert(state.GetLeader("a"), DeepEquals, first)
+
+	// oldest instance becomes leader when the leader goes away
+	third := fakeInstance()
+	third.Index = 1
+	state.AddInstance("a", third)
+	state.RemoveInstance("a", first.ID)
+	assertEvent(c, events, "a", discoverd.EventKindLeader, third)
+}
+
+func (StateSuite) TestManualLeader(c *C) {
+	state := NewState()
+	events := make(chan *discoverd.Event, 1)
+	state.Subscribe("a", false, discoverd.EventKindLeader, events)
+	state.AddService("a")
+	state.SetServiceConfig("a", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual})
+
+	// no leader until one is set
+	first := fakeInstance()
+	first.Index = 1
+	second := fakeInstance()
+	second.Index = 2
+	state.AddInstance("a", first)
+	state.AddInstance("a", second)
+	assertNoEvent(c, events)
+	c.Assert(state.GetLeader("a"), IsNil)
+
+	state.SetManualLeader("a", second.ID)
+	assertEvent(c, events, "a", discoverd.EventKindLeader, second)
+	c.Assert(state.GetLeader("a"), DeepEquals, second)
+
+	// no leader while the leader is not registered
+	state.RemoveInstance("a", second.ID)
+	assertNoEvent(c, events)
+	c.Assert(state.GetLeader("a"), IsNil)
+
+	// the leader regains leadership when it registers again
+	state.AddInstance("a", second)
+	assertEvent(c, events, "a", discoverd.EventKindLeader, second)
+
+	// the oldest instance is elected when switching back to oldest
+	state.SetServiceConfig("a", &discoverd.ServiceConfig{})
+	assertEvent(c, events, "a", discoverd.EventKindLeader, first)
+}
+
+func (StateSuite) TestNoLeader(c *C) {
+	state := NewState()
+	events := make(chan *discoverd.Event, 1)
+	state.Subscribe("a", false, discoverd.EventKindLeader, events)
+	state.AddService("a")
+
+	inst := fakeInstance()
+	state.AddInstance("a", inst)
+	assertEvent(c, events, "a", discoverd.EventKindLeader, inst)
+
+	state.SetServiceConfig("a", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeNone})
+	c.Assert(state.GetLeader("a"), IsNil)
+	state.AddInstance("a", fakeInstance())
+	assertNoEvent(c, events)
+	c.Assert(state.GetLeader("a"), IsNil)
+}
+
+func (StateSuite) TestServiceConfigValid(c *C) {
+	for _, t := range []struct {
+		config *discoverd.ServiceConfig
+		err    error
+	}{
+		{config: &discoverd.ServiceConfig{}},
+		{config: &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual}},
+		{config: &discoverd.ServiceConfig{LeaderType: "foo"}, err: discoverd.ErrInvalidLeaderType},
+		{config: &discoverd.ServiceConfig{TTL: -1}, err: discoverd.ErrInvalidTTL},
+	} {
+		c.Assert(t.config.Valid(), Equals, t.err)
+	}
+}
+
 func (StateSuite) TestInstanceValid(c *C) {
 	for _, t := range []struct {
 		name string
@@ -573,6 +704,46 @@ func (StateSuite) TestInstanceValid(c *C) {
 			},
 			err: "discoverd: instance id is incorrect, expected 35ee81ee2b44f7521139b75e865e3c98",
 		},
+		{
+			name: "negative weight",
+			inst: &discoverd.Instance{
+				ID:     md5sum("tcp-127.0.0.1:2"),
+				Proto:  "tcp",
+				Addr:   "127.0.0.1:2",
+				Weight: -1,
+			},
+			err: discoverd.ErrInvalidWeight.Error(),
+		},
+		{
+			name: "priority too large",
+			inst: &discoverd.Instance{
+				ID:       md5sum("tcp-127.0.0.1:2"),
+				Proto:    "tcp",
+				Addr:     "127.0.0.1:2",
+				Priority: 65536,
+			},
+			err: discoverd.ErrInvalidPriority.Error(),
+		},
+		{
+			name: "negative ttl",
+			inst: &discoverd.Instance{
+				ID:    md5sum("tcp-127.0.0.1:2"),
+				Proto: "tcp",
+				Addr:  "127.0.0.1:2",
+				TTL:   -1,
+			},
+			err: discoverd.ErrInvalidTTL.Error(),
+		},
+		{
+			name: "valid weight and priority",
+			inst: &discoverd.Instance{
+				ID:       md5sum("tcp-127.0.0.1:2"),
+				Proto:    "tcp",
+				Addr:     "127.0.0.1:2",
+				Weight:   65535,
+				Priority: 2,
+			},
+		},
 		{
 			name: "valid",
 			inst: &discoverd.Instance{
@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -136,6 +137,17 @@ func (c *Client) GetStdin() (*os.File, error) {
 	return os.NewFile(uintptr(fd.FD), "stdin"), nil
 }
 
+// Exec runs args inside the container, returning the exit status and the
+// combined stdout and stderr of the command. The command is killed if it
+// runs for longer than timeout.
+func (c *Client) Exec(args []string, timeout time.Duration) (int, []byte, error) {
+	var res ExecResult
+	if err := c.c.Call("ContainerInit.Exec", &ExecRequest{Args: args, Timeout: timeout}, &res); err != nil {
+		return -1, nil, err
+	}
+	return res.ExitStatus, res.Output, nil
+}
+
 func (c *Client) Signal(signal int) error {
 	err := c.c.Call("ContainerInit.Signal", signal, &struct{}{})
 	if err != nil {
@@ -146,8 +158,11 @@ func (c *Client) Signal(signal int) error {
 
 func newContainerInit(c *Config) *ContainerInit {
 	return &ContainerInit{
+		config:    c,
 		resume:    make(chan struct{}),
 		streams:   make(map[chan StateChange]struct{}),
+		execs:     make(map[int]chan syscall.WaitStatus),
+		exited:    make(chan struct{}),
 		openStdin: c.OpenStdin,
 	}
 }
@@ -164,9 +179,19 @@ type ContainerInit struct {
 	stderr     *os.File
 	ptyMaster  *os.File
 	openStdin  bool
+	config     *Config
 
 	streams    map[chan StateChange]struct{}
 	streamsMtx sync.RWMutex
+
+	// execs maps the pids of commands started by Exec to channels that
+	// babySit sends their exit status to, as it reaps all children.
+	execs   map[int]chan syscall.WaitStatus
+	execMtx sync.Mutex
+
+	// exited is closed once babySit returns, after which no more children
+	// are reaped so Exec must not wait for an exit status.
+	exited chan struct{}
 }
 
 func (c *ContainerInit) GetState(arg *struct{}, status *State) error {
@@ -198,6 +223,133 @@ func (c *ContainerInit) Signal(sig int, res *struct{}) error {
 	return nil
 }
 
+type ExecRequest struct {
+	Args    []string
+	Timeout time.Duration
+}
+
+type ExecResult struct {
+	ExitStatus int
+	Output     []byte
+}
+
+// maxExecOutput is the maximum number of bytes of output returned by Exec
+const maxExecOutput = 4096
+
+const defaultExecTimeout = 10 * time.Second
+
+var errExecExited = errors.New("containerinit: container exited while running command")
+
+func (c *ContainerInit) Exec(req *ExecRequest, res *ExecResult) error {
+	if len(req.Args) == 0 {
+		return errors.New("containerinit: missing command")
+	}
+	c.mtx.Lock()
+	state := c.state
+	c.mtx.Unlock()
+	if state != StateRunning {
+		return fmt.Errorf("containerinit: cannot exec in %s container", state)
+	}
+
+	cmdPath, err := exec.LookPath(req.Args[0])
+	if err != nil {
+		return err
+	}
+	cred, err := getCredential(c.config)
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	cmd := exec.Command(cmdPath, req.Args[1:]...)
+	cmd.Dir = c.config.WorkDir
+	cmd.Stdout = w
+	cmd.Stderr = w
+	cmd.Env = make([]string, 0, len(c.config.Env))
+	for k, v := range c.config.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Credential: cred}
+
+	// babySit reaps every child, so register the pid before it can possibly
+	// be reaped, and wait for the status to be passed back.
+	status := make(chan syscall.WaitStatus, 1)
+	c.execMtx.Lock()
+	select {
+	case <-c.exited:
+		c.execMtx.Unlock()
+		w.Close()
+		return errExecExited
+	default:
+	}
+	if err := cmd.Start(); err != nil {
+		c.execMtx.Unlock()
+		w.Close()
+		return err
+	}
+	c.execs[cmd.Process.Pid] = status
+	c.execMtx.Unlock()
+	w.Close()
+
+	output := make(chan []byte, 1)
+	go func() {
+		data, _ := ioutil.ReadAll(io.LimitReader(r, maxExecOutput))
+		// drain any remaining output so the command doesn't block
+		io.Copy(ioutil.Discard, r)
+		output <- data
+	}()
+
+	timeout := req.Timeout
+	if timeout == 0 {
+		timeout = defaultExecTimeout
+	}
+	var wstatus syscall.WaitStatus
+	select {
+	case wstatus = <-status:
+	case <-c.exited:
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		return errExecExited
+	case <-time.After(timeout):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		select {
+		case wstatus = <-status:
+		case <-c.exited:
+			return errExecExited
+		}
+	}
+	res.Output = <-output
+	res.ExitStatus = wstatus.ExitStatus()
+	if wstatus.Signaled() {
+		res.ExitStatus = 128 + int(wstatus.Signal())
+	}
+	return nil
+}
+
+// execExited passes the exit status of pid to Exec, returning false if pid
+// was not started by Exec.
+func (c *ContainerInit) execExited(pid int, wstatus syscall.WaitStatus) bool {
+	c.execMtx.Lock()
+	defer c.execMtx.Unlock()
+	ch, ok := c.execs[pid]
+	if ok {
+		delete(c.execs, pid)
+		ch <- wstatus
+	}
+	return ok
+}
+
+// execsExited is called once babySit stops reaping children, and causes any
+// pending or future calls to Exec to return an error.
+func (c *ContainerInit) execsExited() {
+	c.execMtx.Lock()
+	defer c.execMtx.Unlock()
+	close(c.exited)
+	c.execs = make(map[int]chan syscall.WaitStatus)
+}
+
 func (c *ContainerInit) GetPtyMaster(arg struct{}, fd *fdrpc.FD) error {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
@@ -395,7 +547,7 @@ func getCmdPath(c *Config) (string, error) {
 	return cmdPath, nil
 }
 
-func babySit(process *os.Process) int {
+func babySit(init *ContainerInit, process *os.Process) int {
 	// Forward all signals to the app
 	sigchan := make(chan os.Signal, 1)
 	sigutil.CatchAll(sigchan)
@@ -416,6 +568,9 @@ func babySit(process *os.Process) int {
 		if err == nil && pid == process.Pid {
 			break
 		}
+		if err == nil {
+			init.execExited(pid, wstatus)
+		}
 	}
 
 	if wstatus.Signaled() {
@@ -513,7 +668,8 @@ func containerInitApp(c *Config) error {
 	init.changeState(StateRunning, "", -1)
 
 	init.mtx.Unlock() // Allow calls
-	exitCode := babySit(init.process)
+	exitCode := babySit(init, init.process)
+	init.execsExited()
 	init.mtx.Lock()
 	init.changeState(StateExited, "", exitCode)
 
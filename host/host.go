@@ -235,7 +235,7 @@ func runDaemon(args *docopt.Args) {
 
 		if d, ok := services["discoverd"]; ok {
 			discURL = fmt.Sprintf("http://%s:%d", d.ExternalIP, d.TCPPorts[0])
-			disc = discoverd.NewClientWithURL(discURL)
+			disc = discoverd.NewClientWithKey(discURL, os.Getenv("DISCOVERD_KEY"))
 			if err := discoverdAttempts.Run(disc.Ping); err != nil {
 				shutdown.Fatal(err)
 			}
@@ -248,7 +248,7 @@ func runDaemon(args *docopt.Args) {
 	// HACK: use env as global for discoverd connection in sampic
 	os.Setenv("DISCOVERD", discURL)
 	if disc == nil {
-		disc = discoverd.NewClientWithURL(discURL)
+		disc = discoverd.NewClientWithKey(discURL, os.Getenv("DISCOVERD_KEY"))
 		if err := disc.Ping(); err != nil {
 			shutdown.Fatal(err)
 		}
@@ -18,6 +18,10 @@ type Params struct {
 	Hosts []string
 	IsCA  bool
 	CA    *Certificate
+
+	// ClientAuth allows the certificate to be used for TLS client
+	// authentication as well as by servers.
+	ClientAuth bool
 }
 
 type Certificate struct {
@@ -62,6 +66,9 @@ func Generate(p Params) (*Certificate, error) {
 		template.Subject.CommonName = p.Hosts[0]
 		template.KeyUsage = x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
 		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		if p.ClientAuth {
+			template.ExtKeyUsage = append(template.ExtKeyUsage, x509.ExtKeyUsageClientAuth)
+		}
 	}
 
 	for _, host := range p.Hosts {
@@ -23,6 +23,7 @@ const (
 	ObjectExistsError   ErrorCode = "object_exists"
 	SyntaxError         ErrorCode = "syntax_error"
 	ValidationError     ErrorCode = "validation_error"
+	UnauthorizedError   ErrorCode = "unauthorized"
 	UnknownError        ErrorCode = "unknown_error"
 )
 
@@ -32,6 +33,7 @@ var errorResponseCodes = map[ErrorCode]int{
 	ObjectExistsError:   409,
 	SyntaxError:         400,
 	ValidationError:     400,
+	UnauthorizedError:   401,
 	UnknownError:        500,
 }
 
@@ -12,6 +12,9 @@ import (
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/martini-contrib/binding"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/martini-contrib/render"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/sse"
+	"github.com/flynn/flynn/router/proxy"
 	"github.com/flynn/flynn/router/types"
 )
 
@@ -30,6 +33,8 @@ func apiHandler(rtr *Router) http.Handler {
 	r.Get("/routes", getRoutes)
 	r.Get("/routes/:route_type/:route_id", getRoute)
 	r.Delete("/routes/:route_type/:route_id", deleteRoute)
+	r.Get("/events", streamEvents)
+	r.Get("/metrics", getMetrics)
 	return m
 }
 
@@ -45,6 +50,10 @@ func createRoute(req *http.Request, route router.Route, router *Router, r render
 	}
 
 	if err := l.AddRoute(&route); err != nil {
+		if isValidationError(err) {
+			r.JSON(400, err.Error())
+			return
+		}
 		log.Println(err)
 		r.JSON(500, "unknown error")
 		return
@@ -53,6 +62,14 @@ func createRoute(req *http.Request, route router.Route, router *Router, r render
 	r.JSON(200, res)
 }
 
+func isValidationError(err error) bool {
+	switch err {
+	case proxy.ErrUnknownBalancer, proxy.ErrInvalidHeaderRule, ErrInvalidErrorPage, ErrInvalidServiceWeight, ErrInvalidClientCA:
+		return true
+	}
+	return false
+}
+
 func createOrReplaceRoute(req *http.Request, route router.Route, router *Router, r render.Render) {
 	now := time.Now()
 	route.CreatedAt = &now
@@ -65,6 +82,10 @@ func createOrReplaceRoute(req *http.Request, route router.Route, router *Router,
 	}
 
 	if err := l.SetRoute(&route); err != nil {
+		if isValidationError(err) {
+			r.JSON(400, err.Error())
+			return
+		}
 		log.Println(err)
 		r.JSON(500, "unknown error")
 		return
@@ -177,3 +198,66 @@ func deleteRoute(params martini.Params, router *Router, r render.Render) {
 
 	r.JSON(200, "unknown error")
 }
+
+func getMetrics(w http.ResponseWriter, router *Router) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, l := range []Listener{router.HTTP, router.TCP} {
+		if m, ok := l.(metricsWriter); ok {
+			if err := m.WriteMetrics(w); err != nil {
+				log.Println(err)
+				return
+			}
+		}
+	}
+}
+
+// streamEvents streams route events from all listeners to the client as
+// server-sent events until the client disconnects.
+func streamEvents(w http.ResponseWriter, req *http.Request, rtr *Router) {
+	httpEvents := make(chan *router.Event, 64)
+	tcpEvents := make(chan *router.Event, 64)
+	rtr.HTTP.Watch(httpEvents)
+	defer rtr.HTTP.Unwatch(httpEvents)
+	rtr.TCP.Watch(tcpEvents)
+	defer rtr.TCP.Unwatch(tcpEvents)
+
+	sw := sse.NewWriter(w)
+	enc := json.NewEncoder(httphelper.FlushWriter{Writer: sw, Enabled: true})
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.WriteHeader(200)
+	sw.Flush()
+
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	for {
+		var event *router.Event
+		var ok bool
+		// the channels are closed if the client falls too far behind
+		select {
+		case event, ok = <-httpEvents:
+		case event, ok = <-tcpEvents:
+		case <-closed:
+			return
+		}
+		if !ok {
+			return
+		}
+		if err := enc.Encode(formatEvent(event)); err != nil {
+			return
+		}
+	}
+}
+
+// formatEvent returns a copy of e with the route formatted as it is by the
+// other API endpoints, and the ID set to the formatted route ID.
+func formatEvent(e *router.Event) *router.Event {
+	res := &router.Event{Event: e.Event, ID: e.ID}
+	if e.Route != nil {
+		route := *e.Route
+		res.Route = formatRoute(&route)
+		res.ID = res.Route.ID
+	}
+	return res
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
+	"strings"
+	"time"
 
 	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
 	"github.com/flynn/flynn/discoverd/testutil/etcdrunner"
@@ -146,3 +151,139 @@ func (s *S) TestAPIListRoutes(c *C) {
 	c.Assert(routes[1].ID, Equals, r1.ID)
 	c.Assert(routes[0].ID, Equals, r3.ID)
 }
+
+func (s *S) TestAPIMetrics(c *C) {
+	srv := s.newTestAPIServer(c)
+	defer srv.Close()
+
+	backend := httptest.NewServer(httpTestHandler("1"))
+	defer backend.Close()
+
+	l := srv.listeners[0].(*HTTPListener)
+	addHTTPRoute(c, l)
+	discoverdRegisterHTTP(c, l, backend.Listener.Addr().String())
+	assertGet(c, "http://"+l.Addr, "example.com", "1")
+
+	res, err := http.Get(srv.URL + "/metrics")
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	data, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, IsNil)
+
+	metrics := string(data)
+	c.Assert(strings.Contains(metrics, fmt.Sprintf(`router_http_requests_total{route="example.com",backend=%q,status="2xx"} 1`, backend.Listener.Addr().String())), Equals, true)
+	c.Assert(strings.Contains(metrics, fmt.Sprintf(`router_http_request_duration_seconds_count{route="example.com",backend=%q} 1`, backend.Listener.Addr().String())), Equals, true)
+	c.Assert(strings.Contains(metrics, `router_http_active_requests{route="example.com"} 0`), Equals, true)
+}
+
+func (s *S) TestAPIMetricsRemoveRouteInFlight(c *C) {
+	srv := s.newTestAPIServer(c)
+	defer srv.Close()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("1"))
+	}))
+	defer backend.Close()
+
+	l := srv.listeners[0].(*HTTPListener)
+	r := addHTTPRoute(c, l)
+	discoverdRegisterHTTP(c, l, backend.Listener.Addr().String())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := newReq("http://"+l.Addr, "example.com")
+		res, err := newHTTPClient("example.com").Do(req)
+		if err == nil {
+			res.Body.Close()
+		}
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for request")
+	}
+
+	getMetrics := func() string {
+		res, err := http.Get(srv.URL + "/metrics")
+		c.Assert(err, IsNil)
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		c.Assert(err, IsNil)
+		return string(data)
+	}
+	c.Assert(strings.Contains(getMetrics(), `router_http_active_requests{route="example.com"} 1`), Equals, true)
+
+	// removing the route while the request is in flight should not leave a
+	// negative gauge once the request completes
+	c.Assert(l.RemoveRoute(r.ID), IsNil)
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for request to complete")
+	}
+	// the gauge is decremented after the response has been sent, so wait
+	// for it to be deleted
+	for start := time.Now(); strings.Contains(getMetrics(), `router_http_active_requests{route="example.com"}`); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			c.Fatalf("expected active requests gauge to be deleted, got:\n%s", getMetrics())
+		}
+	}
+}
+
+func (s *S) TestAPIStreamEvents(c *C) {
+	srv := s.newTestAPIServer(c)
+	defer srv.Close()
+
+	events := make(chan *router.Event)
+	stream, err := srv.StreamEvents(events)
+	c.Assert(err, IsNil)
+	defer stream.Close()
+
+	nextEvent := func() *router.Event {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				c.Fatalf("event stream closed unexpectedly: %s", stream.Err())
+			}
+			return e
+		case <-time.After(10 * time.Second):
+			c.Fatal("timed out waiting for event")
+		}
+		return nil
+	}
+
+	r := (&router.HTTPRoute{
+		Domain:  "example.com",
+		Service: "test",
+		TLSCert: string(localhostCert),
+		TLSKey:  string(localhostKey),
+	}).ToRoute()
+	c.Assert(srv.CreateRoute(r), IsNil)
+
+	e := nextEvent()
+	c.Assert(e.Event, Equals, "set")
+	c.Assert(e.ID, Equals, r.ID)
+	hr := e.Route.HTTPRoute()
+	c.Assert(hr.Domain, Equals, "example.com")
+	c.Assert(hr.TLSCert, Equals, string(localhostCert))
+	c.Assert(hr.TLSKey, Equals, "")
+
+	c.Assert(srv.DeleteRoute(r.ID), IsNil)
+	e = nextEvent()
+	c.Assert(e.Event, Equals, "remove")
+	c.Assert(e.ID, Equals, r.ID)
+
+	tr := (&router.TCPRoute{Service: "test"}).ToRoute()
+	c.Assert(srv.CreateRoute(tr), IsNil)
+	e = nextEvent()
+	c.Assert(e.Event, Equals, "set")
+	c.Assert(e.ID, Equals, tr.ID)
+	c.Assert(e.Route.TCPRoute().Port, Equals, tr.TCPRoute().Port)
+}
@@ -8,6 +8,7 @@ import (
 	"net/url"
 
 	"github.com/flynn/flynn/pkg/httpclient"
+	"github.com/flynn/flynn/pkg/stream"
 	"github.com/flynn/flynn/router/types"
 )
 
@@ -60,6 +61,9 @@ type Client interface {
 	// ListRoutes returns a list of routes. If parentRef is not empty, routes
 	// are filtered by the reference (ex: "controller/apps/myapp").
 	ListRoutes(parentRef string) ([]*router.Route, error)
+	// StreamEvents streams route set and remove events to output until the
+	// stream is closed.
+	StreamEvents(output chan<- *router.Event) (stream.Stream, error)
 }
 
 func (c *client) CreateRoute(r *router.Route) error {
@@ -91,3 +95,7 @@ func (c *client) ListRoutes(parentRef string) ([]*router.Route, error) {
 	err := c.Get(path, &res)
 	return res, err
 }
+
+func (c *client) StreamEvents(output chan<- *router.Event) (stream.Stream, error) {
+	return c.Stream("GET", "/events", nil, output)
+}
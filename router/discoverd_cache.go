@@ -41,7 +41,12 @@ func (d *discoverdServiceCache) start(s discoverd.Service) (err error) {
 			switch event.Kind {
 			case discoverd.EventKindUp, discoverd.EventKindUpdate:
 				d.Lock()
-				d.addrs[event.Instance.Addr] = struct{}{}
+				if event.Instance.Draining {
+					// stop sending new connections to draining instances
+					delete(d.addrs, event.Instance.Addr)
+				} else {
+					d.addrs[event.Instance.Addr] = struct{}{}
+				}
 				d.Unlock()
 			case discoverd.EventKindDown:
 				d.Lock()
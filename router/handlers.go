@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/x509"
 	"net"
 	"net/http"
 	"strings"
@@ -10,6 +11,8 @@ const (
 	fwdForHeaderName   = "X-Forwarded-For"
 	fwdProtoHeaderName = "X-Forwarded-Proto"
 	fwdPortHeaderName  = "X-Forwarded-Port"
+
+	clientCertSubjectHeaderName = "X-Client-Cert-Subject"
 )
 
 // fwdProtoHandler is an http.Handler that sets the X-Forwarded-For header on
@@ -44,3 +47,71 @@ func (h fwdProtoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	h.Handler.ServeHTTP(w, r)
 }
+
+// isTLSRequest reports whether the client connected over TLS. The
+// X-Forwarded-Proto header is only used for requests from one of the trusted
+// proxies, as any client can set it. The value set by the proxy is the one
+// before the value appended by fwdProtoHandler, earlier values may have been
+// set by the client.
+func isTLSRequest(r *http.Request, trustedProxies []*net.IPNet) bool {
+	if !isTrustedProxy(r.RemoteAddr, trustedProxies) {
+		return r.TLS != nil
+	}
+	values := strings.Split(r.Header.Get(fwdProtoHeaderName), ",")
+	if len(values) < 2 {
+		return r.TLS != nil
+	}
+	return strings.TrimSpace(values[len(values)-2]) == "https"
+}
+
+func isTrustedProxy(remoteAddr string, trustedProxies []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyClientCert verifies the certificate the client presented during the
+// TLS handshake against roots, returning the certificate's subject.
+func verifyClientCert(r *http.Request, roots *x509.CertPool) (string, bool) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", false
+	}
+	cert := r.TLS.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return "", false
+	}
+	return cert.Subject.String(), true
+}
+
+// redirectToTLS sends a permanent redirect to the https URL of the request,
+// preserving the path and query.
+func redirectToTLS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/tls"
+	"net"
 	"net/http"
 	"net/http/httptest"
 
@@ -32,3 +34,40 @@ func (s *S) TestFwdProtoHandler(c *C) {
 	c.Assert(request.Header.Get("X-Forwarded-Proto"), Equals, prevForwardedProto+", https")
 	c.Assert(request.Header.Get("X-Forwarded-Port"), Equals, prevForwardedPort+", 443")
 }
+
+func (s *S) TestIsTLSRequest(c *C) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	for _, t := range []struct {
+		remoteAddr string
+		proto      string
+		tls        bool
+		expected   bool
+	}{
+		// the last value is appended by fwdProtoHandler
+		{"10.0.0.1:1234", "https, http", false, true},
+		{"10.0.0.1:1234", "http, http", false, false},
+		{"10.0.0.1:1234", "https, http, http", false, false},
+		{"10.0.0.1:1234", "http", false, false},
+		{"10.0.0.1:1234", "http, https", true, false},
+		// the header is ignored for clients which aren't trusted proxies
+		{"1.2.3.4:1234", "https, http", false, false},
+		{"1.2.3.4:1234", "https", true, true},
+	} {
+		request, _ := http.NewRequest("GET", "http://test.com", nil)
+		request.RemoteAddr = t.remoteAddr
+		request.Header.Set("X-Forwarded-Proto", t.proto)
+		if t.tls {
+			request.TLS = &tls.ConnectionState{}
+		}
+		c.Assert(isTLSRequest(request, []*net.IPNet{trusted}), Equals, t.expected, Commentf("remote = %q, proto = %q", t.remoteAddr, t.proto))
+	}
+}
+
+func (s *S) TestRedirectToTLS(c *C) {
+	rec := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://test.com:8080/foo%20bar?baz=1", nil)
+	request.Host = "test.com:8080"
+	redirectToTLS(rec, request)
+	c.Assert(rec.Code, Equals, 301)
+	c.Assert(rec.Header().Get("Location"), Equals, "https://test.com/foo%20bar?baz=1")
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"crypto/md5"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"errors"
+	"io"
 	"net"
 	"net/http"
 	"strconv"
@@ -13,10 +16,12 @@ import (
 	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/kavu/go_reuseport"
+	"github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
 	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/pkg/random"
 	"github.com/flynn/flynn/pkg/tlsconfig"
 	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/proxyproto"
 	"github.com/flynn/flynn/router/types"
 )
 
@@ -35,12 +40,31 @@ type HTTPListener struct {
 	discoverd DiscoverdClient
 	ds        DataStore
 	wm        *WatchManager
+	metrics   *httpMetrics
+
+	// conns tracks the active connections to backends of all services so
+	// that routes split between services can balance across all of them
+	conns *proxy.ConnCounter
+
+	// accessLog, if set, receives a log entry for each proxied request
+	accessLog log15.Logger
 
 	listener    net.Listener
 	tlsListener net.Listener
 	closed      bool
 	cookieKey   *[32]byte
 	keypair     tls.Certificate
+
+	// disableHTTP2 stops HTTP/2 from being offered to clients of the TLS
+	// listener
+	disableHTTP2 bool
+	// proxyProtocol requires a PROXY protocol header on inbound connections,
+	// for use behind a load balancer
+	proxyProtocol bool
+	// trustedProxies are the networks of proxies in front of the router
+	// whose X-Forwarded-Proto header is used to decide if force_tls routes
+	// need to be redirected
+	trustedProxies []*net.IPNet
 }
 
 type DiscoverdClient interface {
@@ -78,9 +102,13 @@ func (s *HTTPListener) Start() error {
 	s.domains = make(map[string]*httpRoute)
 	s.services = make(map[string]*httpService)
 
+	if s.metrics == nil {
+		s.metrics = newHTTPMetrics()
+	}
 	if s.cookieKey == nil {
 		s.cookieKey = &[32]byte{}
 	}
+	s.conns = proxy.NewConnCounter()
 
 	started := make(chan error)
 
@@ -115,7 +143,11 @@ func (s *HTTPListener) AddRoute(r *router.Route) error {
 	if s.closed {
 		return ErrClosed
 	}
-	r.ID = md5sum(r.HTTPRoute().Domain)
+	hr := r.HTTPRoute()
+	if err := validateHTTPRoute(hr); err != nil {
+		return err
+	}
+	r.ID = md5sum(hr.Domain)
 	return s.ds.Add(r)
 }
 
@@ -125,7 +157,24 @@ func (s *HTTPListener) SetRoute(r *router.Route) error {
 	if s.closed {
 		return ErrClosed
 	}
-	r.ID = md5sum(r.HTTPRoute().Domain)
+	hr := r.HTTPRoute()
+	if err := validateHTTPRoute(hr); err != nil {
+		return err
+	}
+	r.ID = md5sum(hr.Domain)
+
+	// The API never returns TLS keys, so keep the existing key if the
+	// certificate is unchanged and no key was given, allowing routes read
+	// from the API to be updated.
+	if hr.TLSCert != "" && hr.TLSKey == "" {
+		if existing, err := s.ds.Get(r.ID); err == nil {
+			if er := existing.HTTPRoute(); er.TLSCert == hr.TLSCert {
+				hr.TLSKey = er.TLSKey
+				hr.Route = r
+				*r = *hr.ToRoute()
+			}
+		}
+	}
 	return s.ds.Set(r)
 }
 
@@ -134,6 +183,60 @@ func md5sum(data string) string {
 	return hex.EncodeToString(digest[:])
 }
 
+func validateBalancer(name string) error {
+	_, err := proxy.NewBalancer(name, nil, "")
+	return err
+}
+
+var ErrInvalidErrorPage = errors.New("router: error pages may only be given for 502, 503, 504 and maintenance")
+
+var ErrInvalidClientCA = errors.New("router: client_ca does not contain any PEM encoded certificates")
+
+var ErrInvalidServiceWeight = errors.New("router: weighted services must have a name and non-negative weights with a positive total")
+
+func validateHTTPRoute(r *router.HTTPRoute) error {
+	if err := validateBalancer(r.LoadBalancer); err != nil {
+		return err
+	}
+	for key := range r.ErrorPages {
+		switch key {
+		case "502", "503", "504", "maintenance":
+		default:
+			return ErrInvalidErrorPage
+		}
+	}
+	if r.ClientCA != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(r.ClientCA)) {
+		return ErrInvalidClientCA
+	}
+	if len(r.Services) > 0 {
+		total := 0
+		for _, s := range r.Services {
+			if s.Name == "" || s.Weight < 0 {
+				return ErrInvalidServiceWeight
+			}
+			total += s.Weight
+		}
+		if total == 0 {
+			return ErrInvalidServiceWeight
+		}
+	}
+	if err := headerRules(r.RequestHeaders).Validate(); err != nil {
+		return err
+	}
+	return headerRules(r.ResponseHeaders).Validate()
+}
+
+func headerRules(rules []router.HeaderRule) proxy.HeaderRules {
+	if len(rules) == 0 {
+		return nil
+	}
+	res := make(proxy.HeaderRules, len(rules))
+	for i, r := range rules {
+		res[i] = proxy.HeaderRule{Action: r.Action, Name: r.Name, Value: r.Value}
+	}
+	return res
+}
+
 func (s *HTTPListener) RemoveRoute(id string) error {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
@@ -143,6 +246,32 @@ func (s *HTTPListener) RemoveRoute(id string) error {
 	return s.ds.Remove(id)
 }
 
+// acquireService returns the named service, creating it if it doesn't exist,
+// and increments its reference count. The caller must hold s.mtx.
+func (s *HTTPListener) acquireService(name string) (*httpService, error) {
+	service, ok := s.services[name]
+	if !ok {
+		sc, err := NewDiscoverdServiceCache(s.discoverd.Service(name))
+		if err != nil {
+			return nil, err
+		}
+		service = &httpService{name: name, sc: sc}
+		s.services[name] = service
+	}
+	service.refs++
+	return service, nil
+}
+
+// releaseService decrements the reference count of service, closing it when
+// no routes refer to it. The caller must hold s.mtx.
+func (s *HTTPListener) releaseService(service *httpService) {
+	service.refs--
+	if service.refs <= 0 {
+		service.sc.Close()
+		delete(s.services, service.name)
+	}
+}
+
 type httpSyncHandler struct {
 	l *HTTPListener
 }
@@ -160,6 +289,12 @@ func (h *httpSyncHandler) Set(data *router.Route) error {
 		r.TLSCert = ""
 		r.TLSKey = ""
 	}
+	if r.ClientCA != "" {
+		r.clientCAs = x509.NewCertPool()
+		if !r.clientCAs.AppendCertsFromPEM([]byte(r.ClientCA)) {
+			return ErrInvalidClientCA
+		}
+	}
 
 	h.l.mtx.Lock()
 	defer h.l.mtx.Unlock()
@@ -167,33 +302,65 @@ func (h *httpSyncHandler) Set(data *router.Route) error {
 		return nil
 	}
 
-	service := h.l.services[r.Service]
-	if service != nil && service.name != r.Service {
-		service.refs--
-		if service.refs <= 0 {
-			service.sc.Close()
-			delete(h.l.services, service.name)
+	var names []string
+	var weights []int
+	if len(r.Services) > 0 {
+		for _, ws := range r.Services {
+			names = append(names, ws.Name)
+			weights = append(weights, ws.Weight)
 		}
-		service = nil
+	} else {
+		names, weights = []string{r.Service}, []int{1}
 	}
-	if service == nil {
-		sc, err := NewDiscoverdServiceCache(h.l.discoverd.Service(r.Service))
+
+	groups := make([]proxy.BackendGroup, 0, len(names))
+	for i, name := range names {
+		// each group has its own balancer so that round-robin rotates
+		// through the backends of every group
+		lb, err := proxy.NewBalancer(r.LoadBalancer, h.l.conns, r.HashHeader)
+		if err != nil {
+			return err
+		}
+		service, err := h.l.acquireService(name)
 		if err != nil {
+			for _, service := range r.services {
+				h.l.releaseService(service)
+			}
 			return err
 		}
-		service = &httpService{
-			name: r.Service,
-			sc:   sc,
-			rp:   proxy.NewReverseProxy(sc.Addrs, h.l.cookieKey, r.Sticky),
+		r.services = append(r.services, service)
+		groups = append(groups, proxy.BackendGroup{Backends: service.sc.Addrs, Weight: weights[i], Balancer: lb})
+	}
+	r.service = r.services[0]
+	r.rp = proxy.NewWeightedReverseProxy(groups, h.l.cookieKey, r.Sticky, nil, h.l.conns)
+	for key, page := range r.ErrorPages {
+		if code, err := strconv.Atoi(key); err == nil {
+			if r.rp.ErrorPages == nil {
+				r.rp.ErrorPages = make(map[int][]byte)
+			}
+			r.rp.ErrorPages[code] = []byte(page)
 		}
-		h.l.services[r.Service] = service
 	}
-	service.refs++
-	r.service = service
+	r.rp.CompressTypes = r.CompressTypes
+	r.rp.RequestBufferSize = r.RequestBufferSize
+	r.rp.RequestHeaders = headerRules(r.RequestHeaders)
+	r.rp.ResponseHeaders = headerRules(r.ResponseHeaders)
+	if r.RateLimit > 0 {
+		r.rateLimiter = newRateLimiter(r.RateLimit, r.RateLimitBurst)
+	}
+	if r.MaxConns > 0 {
+		r.connLimiter = newConcurrencyLimiter(r.MaxConns)
+	}
+	if old, ok := h.l.routes[data.ID]; ok {
+		for _, service := range old.services {
+			h.l.releaseService(service)
+		}
+		delete(h.l.domains, strings.ToLower(old.Domain))
+	}
 	h.l.routes[data.ID] = r
 	h.l.domains[strings.ToLower(r.Domain)] = r
 
-	go h.l.wm.Send(&router.Event{Event: "set", ID: r.Domain})
+	h.l.wm.Send(&router.Event{Event: "set", ID: r.Domain, Route: data})
 	return nil
 }
 
@@ -208,21 +375,23 @@ func (h *httpSyncHandler) Remove(id string) error {
 		return ErrNotFound
 	}
 
-	r.service.refs--
-	if r.service.refs <= 0 {
-		r.service.sc.Close()
-		delete(h.l.services, r.service.name)
+	for _, service := range r.services {
+		h.l.releaseService(service)
 	}
 
 	delete(h.l.routes, id)
 	delete(h.l.domains, r.Domain)
-	go h.l.wm.Send(&router.Event{Event: "remove", ID: id})
+	h.l.metrics.removeRoute(r.Domain)
+	h.l.wm.Send(&router.Event{Event: "remove", ID: id, Route: r.ToRoute()})
 	return nil
 }
 
 func (s *HTTPListener) listenAndServe(started chan<- error) {
 	var err error
 	s.listener, err = reuseport.NewReusablePortListener("tcp4", s.Addr)
+	if err == nil && s.proxyProtocol {
+		s.listener = &proxyproto.Listener{Listener: s.listener}
+	}
 	started <- err
 	if err != nil {
 		return
@@ -250,13 +419,37 @@ func (s *HTTPListener) listenAndServeTLS(started chan<- error) {
 		}
 		return r.keypair, nil
 	}
-	tlsConfig := tlsconfig.SecureCiphers(&tls.Config{
-		GetCertificate: certForHandshake,
-		Certificates:   []tls.Certificate{s.keypair},
+	var tlsConfig *tls.Config
+	// request a client certificate during the handshake for routes with
+	// a client CA, it is verified again when serving requests as clients
+	// may send requests for other domains over the connection
+	configForHandshake := func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		r := s.findRouteForHost(hello.ServerName)
+		if r == nil || r.clientCAs == nil {
+			return nil, nil
+		}
+		config := tlsConfig.Clone()
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = r.clientCAs
+		return config, nil
+	}
+	tlsConfig = tlsconfig.SecureCiphers(&tls.Config{
+		GetCertificate:     certForHandshake,
+		GetConfigForClient: configForHandshake,
+		Certificates:       []tls.Certificate{s.keypair},
 	})
+	// Offer HTTP/2 via ALPN. http.Server serves connections which negotiate
+	// h2 with its built-in HTTP/2 support, requests are still proxied to
+	// backends over HTTP/1.1.
+	if !s.disableHTTP2 {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
 
 	l, err := reuseport.NewReusablePortListener("tcp4", s.TLSAddr)
 	if err == nil {
+		if s.proxyProtocol {
+			l = &proxyproto.Listener{Listener: l}
+		}
 		s.tlsListener = tls.NewListener(l, tlsConfig)
 	}
 	started <- err
@@ -317,32 +510,167 @@ func (s *HTTPListener) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	r.service.ServeHTTP(w, req)
+	start := time.Now()
+	rw := &responseRecorder{ResponseWriter: w}
+	s.metrics.active.Inc(r.Domain)
+	defer s.metrics.active.Dec(r.Domain)
+	if r.ForceTLS && !isTLSRequest(req, s.trustedProxies) {
+		redirectToTLS(rw, req)
+	} else {
+		r.service.ServeHTTP(rw, req, r)
+	}
+	duration := time.Since(start)
+
+	status := rw.Status()
+	s.metrics.requests.Inc(r.Domain, rw.backend, statusClass(status))
+	s.metrics.latency.Observe(duration, r.Domain, rw.backend)
+
+	if s.accessLog != nil {
+		s.accessLog.Info(
+			"request",
+			"route", r.ID,
+			"domain", r.Domain,
+			"request_id", req.Header.Get("X-Request-Id"),
+			"client_addr", req.RemoteAddr,
+			"method", req.Method,
+			"path", req.URL.Path,
+			"backend", rw.backend,
+			"status", status,
+			"bytes", rw.bytes,
+			"duration", duration,
+		)
+	}
+}
+
+// WriteMetrics writes the request metrics of the listener along with the
+// active connections to each backend.
+func (s *HTTPListener) WriteMetrics(w io.Writer) error {
+	s.mtx.RLock()
+	services := make([]backendConns, 0, len(s.services))
+	for _, service := range s.services {
+		services = append(services, backendConns{service.name, service.sc.Addrs(), s.conns})
+	}
+	s.mtx.RUnlock()
+	return writeMetrics(w, s.metrics, backendConnsGauge("router_http_backend_active_connections", services))
+}
+
+// responseRecorder wraps an http.ResponseWriter to record the status code,
+// number of body bytes written and the backend used for a request.
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	bytes   int64
+	backend string
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *responseRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// SetBackend implements proxy.BackendRecorder.
+func (r *responseRecorder) SetBackend(addr string) {
+	r.backend = addr
+}
+
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("router: response does not implement http.Hijacker")
+	}
+	return h.Hijack()
 }
 
 // A domain served by a listener, associated TLS certs,
-// and link to backend service set.
+// link to backend service set, and the proxy and limits configured for the
+// route.
 type httpRoute struct {
 	*router.HTTPRoute
 
-	keypair *tls.Certificate
-	service *httpService
+	keypair   *tls.Certificate
+	clientCAs *x509.CertPool
+	rp        *proxy.ReverseProxy
+
+	// service is the first of services, which has more than one entry if
+	// requests are split between weighted services
+	service  *httpService
+	services []*httpService
+
+	rateLimiter *rateLimiter
+	connLimiter concurrencyLimiter
 }
 
-// A service definition: name, and set of backends.
+// A service definition: name, set of backends, and the number of routes
+// referring to it.
 type httpService struct {
 	name string
 	sc   DiscoverdServiceCache
 	refs int
-
-	rp *proxy.ReverseProxy
 }
 
-func (s *httpService) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+func (s *httpService) ServeHTTP(w http.ResponseWriter, req *http.Request, r *httpRoute) {
+	// the subject header is only trusted if it was set by the router
+	req.Header.Del(clientCertSubjectHeaderName)
+	if r.clientCAs != nil {
+		subject, ok := verifyClientCert(req, r.clientCAs)
+		if !ok {
+			fail(w, 403)
+			return
+		}
+		req.Header.Set(clientCertSubjectHeaderName, subject)
+	}
+	if r.Maintenance {
+		if page, ok := r.ErrorPages["maintenance"]; ok {
+			proxy.ServeErrorPage(w, 503, []byte(page))
+		} else {
+			fail(w, 503)
+		}
+		return
+	}
+	if r.rateLimiter != nil {
+		clientIP, _, _ := net.SplitHostPort(req.RemoteAddr)
+		if !r.rateLimiter.Allow(clientIP) {
+			w.Header().Set("Retry-After", "1")
+			fail(w, 429)
+			return
+		}
+	}
+	if r.connLimiter != nil {
+		if !r.connLimiter.Acquire() {
+			fail(w, 429)
+			return
+		}
+		defer r.connLimiter.Release()
+	}
+
 	req.Header.Set("X-Request-Start", strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10))
 	req.Header.Set("X-Request-Id", random.UUID())
 
-	s.rp.ServeHTTP(w, req)
+	r.rp.ServeHTTP(w, req)
 }
 
 func mustPortFromAddr(addr string) string {
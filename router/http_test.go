@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
@@ -10,14 +11,17 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"time"
 
 	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
 	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/websocket"
 	"github.com/flynn/flynn/discoverd/testutil/etcdrunner"
+	"github.com/flynn/flynn/pkg/certgen"
 	"github.com/flynn/flynn/pkg/httpclient"
 	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/router/proxy"
 	"github.com/flynn/flynn/router/types"
 )
 
@@ -354,6 +358,173 @@ func (s *S) TestHTTPProxyHeadersFromClient(c *C) {
 	}
 }
 
+func (s *S) TestHTTPHeaderRules(c *C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.Header.Get("X-Internal"), Equals, "")
+		c.Check(req.Header["X-Tag"], DeepEquals, []string{"a", "b"})
+		c.Check(req.Header.Get("X-Env"), Equals, "production")
+		w.Header().Set("Server", "app/1.0")
+		w.Header().Set("X-Powered-By", "test")
+	}))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, (&router.HTTPRoute{
+		Domain:  "example.com",
+		Service: "test",
+		RequestHeaders: []router.HeaderRule{
+			{Action: "remove", Name: "X-Internal"},
+			{Action: "add", Name: "X-Tag", Value: "b"},
+			{Action: "set", Name: "X-Env", Value: "production"},
+		},
+		ResponseHeaders: []router.HeaderRule{
+			{Action: "set", Name: "Strict-Transport-Security", Value: "max-age=31536000"},
+			{Action: "add", Name: "Access-Control-Allow-Origin", Value: "*"},
+			{Action: "remove", Name: "X-Powered-By"},
+		},
+	}).ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	req := newReq("http://"+l.Addr, "example.com")
+	req.Header.Set("X-Internal", "secret")
+	req.Header.Set("X-Tag", "a")
+	req.Header.Set("X-Env", "staging")
+	res, err := httpClient.Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(res.Header.Get("Strict-Transport-Security"), Equals, "max-age=31536000")
+	c.Assert(res.Header.Get("Access-Control-Allow-Origin"), Equals, "*")
+	c.Assert(res.Header.Get("Server"), Equals, "app/1.0")
+	c.Assert(res.Header.Get("X-Powered-By"), Equals, "")
+}
+
+func (s *S) TestInvalidHeaderRule(c *C) {
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	err := l.AddRoute((&router.HTTPRoute{
+		Domain:          "example.com",
+		Service:         "test",
+		ResponseHeaders: []router.HeaderRule{{Action: "replace", Name: "Server"}},
+	}).ToRoute())
+	c.Assert(err, Equals, proxy.ErrInvalidHeaderRule)
+}
+
+func (s *S) TestHTTPCompression(c *C) {
+	body := strings.Repeat("compress me ", 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", req.URL.Query().Get("type"))
+		w.Header().Set("ETag", `"1"`)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, (&router.HTTPRoute{
+		Domain:        "example.com",
+		Service:       "test",
+		CompressTypes: []string{"application/json", "text/*"},
+	}).ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	get := func(contentType, acceptEncoding string) (*http.Response, string) {
+		req := newReq("http://"+l.Addr+"/?type="+url.QueryEscape(contentType), "example.com")
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		res, err := httpClient.Do(req)
+		c.Assert(err, IsNil)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, Equals, 200)
+		var r io.Reader = res.Body
+		if res.Header.Get("Content-Encoding") == "gzip" {
+			r, err = gzip.NewReader(res.Body)
+			c.Assert(err, IsNil)
+		}
+		data, err := ioutil.ReadAll(r)
+		c.Assert(err, IsNil)
+		return res, string(data)
+	}
+
+	for _, t := range []struct {
+		contentType    string
+		acceptEncoding string
+		compressed     bool
+	}{
+		{"text/html; charset=utf-8", "gzip, deflate", true},
+		{"application/json", "gzip", true},
+		{"image/png", "gzip", false},
+		{"text/plain", "identity", false},
+		{"text/plain", "gzip;q=0", false},
+	} {
+		res, data := get(t.contentType, t.acceptEncoding)
+		comment := Commentf("content type = %q, accept encoding = %q", t.contentType, t.acceptEncoding)
+		c.Assert(res.Header.Get("Content-Encoding") == "gzip", Equals, t.compressed, comment)
+		c.Assert(data, Equals, body, comment)
+		// gzipped responses only have a weak ETag
+		if t.compressed {
+			c.Assert(res.Header.Get("ETag"), Equals, `W/"1"`, comment)
+		} else {
+			c.Assert(res.Header.Get("ETag"), Equals, `"1"`, comment)
+		}
+	}
+}
+
+func (s *S) TestHTTPRequestBuffering(c *C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.TransferEncoding, HasLen, 0)
+		n, _ := io.Copy(w, req.Body)
+		c.Check(req.ContentLength, Equals, n)
+	}))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, (&router.HTTPRoute{
+		Domain:            "example.com",
+		Service:           "test",
+		RequestBufferSize: 10,
+	}).ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	post := func(body io.Reader) (int, string) {
+		req, _ := http.NewRequest("POST", "http://"+l.Addr, body)
+		req.Host = "example.com"
+		res, err := httpClient.Do(req)
+		c.Assert(err, IsNil)
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		c.Assert(err, IsNil)
+		return res.StatusCode, string(data)
+	}
+
+	status, data := post(strings.NewReader("0123456789"))
+	c.Assert(status, Equals, 200)
+	c.Assert(data, Equals, "0123456789")
+
+	// a chunked body is forwarded with a Content-Length
+	status, data = post(ioutil.NopCloser(strings.NewReader("chunked")))
+	c.Assert(status, Equals, 200)
+	c.Assert(data, Equals, "chunked")
+
+	// empty bodies are forwarded with a zero Content-Length
+	status, data = post(strings.NewReader(""))
+	c.Assert(status, Equals, 200)
+	c.Assert(data, Equals, "")
+	status, data = post(ioutil.NopCloser(strings.NewReader("")))
+	c.Assert(status, Equals, 200)
+	c.Assert(data, Equals, "")
+
+	status, _ = post(strings.NewReader("0123456789a"))
+	c.Assert(status, Equals, 413)
+	status, _ = post(ioutil.NopCloser(strings.NewReader("0123456789a")))
+	c.Assert(status, Equals, 413)
+}
+
 func (s *S) TestConnectionCloseHeaderFromClient(c *C) {
 	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		// Connection: close header should be stripped by the reverse proxy so it
@@ -592,6 +763,455 @@ func (s *S) TestStickyHTTPRoute(c *C) {
 	}
 }
 
+func (s *S) TestForceTLS(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, (&router.HTTPRoute{
+		Domain:   "example.com",
+		Service:  "test",
+		TLSCert:  string(localhostCert),
+		TLSKey:   string(localhostKey),
+		ForceTLS: true,
+	}).ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	tr := &http.Transport{}
+	req := newReq("http://"+l.Addr+"/foo?bar=baz", "example.com")
+	res, err := tr.RoundTrip(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 301)
+	c.Assert(res.Header.Get("Location"), Equals, "https://example.com/foo?bar=baz")
+
+	// X-Forwarded-Proto is ignored for clients which aren't trusted proxies
+	req = newReq("http://"+l.Addr, "example.com")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	res, err = tr.RoundTrip(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 301)
+
+	// requests forwarded by a trusted proxy which terminated TLS are not
+	// redirected
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	l.trustedProxies = []*net.IPNet{loopback}
+	req = newReq("http://"+l.Addr, "example.com")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	res, err = tr.RoundTrip(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+
+	assertGet(c, "https://"+l.TLSAddr, "example.com", "1")
+}
+
+func (s *S) TestWeightedServicesHTTPRoute(c *C) {
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	defer srv1.Close()
+	defer srv2.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, (&router.HTTPRoute{
+		Domain: "example.com",
+		Services: []router.WeightedService{
+			{Name: "test", Weight: 90},
+			{Name: "test-canary", Weight: 10},
+		},
+	}).ToRoute())
+	discoverdRegisterHTTPService(c, l, "test", srv1.Listener.Addr().String())
+	discoverdRegisterHTTPService(c, l, "test-canary", srv2.Listener.Addr().String())
+
+	counts := make(map[string]int)
+	for i := 0; i < 200; i++ {
+		res, err := httpClient.Do(newReq("http://"+l.Addr, "example.com"))
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, IsNil)
+		counts[string(data)]++
+	}
+	c.Assert(counts["1"] > counts["2"], Equals, true, Commentf("counts = %v", counts))
+	c.Assert(counts["2"] > 0, Equals, true, Commentf("counts = %v", counts))
+}
+
+func (s *S) TestWeightedServicesStickyHTTPRoute(c *C) {
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	defer srv1.Close()
+	defer srv2.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, (&router.HTTPRoute{
+		Domain: "example.com",
+		Sticky: true,
+		Services: []router.WeightedService{
+			{Name: "test", Weight: 1},
+			{Name: "test-canary", Weight: 1},
+		},
+	}).ToRoute())
+	discoverdRegisterHTTPService(c, l, "test", srv1.Listener.Addr().String())
+	discoverdRegisterHTTPService(c, l, "test-canary", srv2.Listener.Addr().String())
+
+	// requests with a sticky cookie go to the same service every time
+	res, err := httpClient.Do(newReq("http://"+l.Addr, "example.com"))
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, IsNil)
+	cookies := res.Cookies()
+	for i := 0; i < 10; i++ {
+		assertGetCookies(c, "http://"+l.Addr, "example.com", string(data), cookies)
+	}
+}
+
+func (s *S) TestInvalidServiceWeights(c *C) {
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	for _, services := range [][]router.WeightedService{
+		{{Name: "test", Weight: 0}},
+		{{Name: "test", Weight: 1}, {Name: "", Weight: 1}},
+		{{Name: "test", Weight: -1}, {Name: "test-canary", Weight: 2}},
+	} {
+		err := l.AddRoute((&router.HTTPRoute{Domain: "example.com", Services: services}).ToRoute())
+		c.Assert(err, Equals, ErrInvalidServiceWeight)
+	}
+}
+
+func (s *S) TestHTTPClientCertAuth(c *C) {
+	ca, err := certgen.Generate(certgen.Params{IsCA: true})
+	c.Assert(err, IsNil)
+	clientCert, err := certgen.Generate(certgen.Params{Hosts: []string{"admin"}, CA: ca, ClientAuth: true})
+	c.Assert(err, IsNil)
+	otherCA, err := certgen.Generate(certgen.Params{IsCA: true})
+	c.Assert(err, IsNil)
+	otherCert, err := certgen.Generate(certgen.Params{Hosts: []string{"admin"}, CA: otherCA, ClientAuth: true})
+	c.Assert(err, IsNil)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Header.Get("X-Client-Cert-Subject")))
+	}))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, (&router.HTTPRoute{
+		Domain:   "example.com",
+		Service:  "test",
+		TLSCert:  string(localhostCert),
+		TLSKey:   string(localhostKey),
+		ClientCA: ca.PEM,
+	}).ToRoute())
+	addRoute(c, l, (&router.HTTPRoute{
+		Domain:  "www.example.com",
+		Service: "test",
+		TLSCert: string(localhostCert),
+		TLSKey:  string(localhostKey),
+	}).ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	get := func(serverName, host string, cert *certgen.Certificate) (int, string, error) {
+		client := newHTTPClient(serverName)
+		if cert != nil {
+			pair, err := tls.X509KeyPair([]byte(cert.PEM), []byte(cert.KeyPEM))
+			c.Assert(err, IsNil)
+			client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{pair}
+		}
+		req := newReq("https://"+l.TLSAddr, host)
+		// clients can't set the subject themselves
+		req.Header.Set("X-Client-Cert-Subject", "CN=spoofed")
+		res, err := client.Do(req)
+		if err != nil {
+			return 0, "", err
+		}
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(data), err
+	}
+
+	// a certificate signed by the CA is accepted and its subject passed on
+	status, data, err := get("example.com", "example.com", clientCert)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 200)
+	c.Assert(data, Equals, "CN=admin,O=Flynn")
+
+	// the subject header is removed on routes without a client CA
+	status, data, err = get("www.example.com", "www.example.com", nil)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 200)
+	c.Assert(data, Equals, "")
+
+	// the handshake fails without a valid certificate
+	_, _, err = get("example.com", "example.com", nil)
+	c.Assert(err, NotNil)
+	_, _, err = get("example.com", "example.com", otherCert)
+	c.Assert(err, NotNil)
+
+	// requests for the route over a connection for another domain are
+	// rejected
+	status, _, err = get("www.example.com", "example.com", nil)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 403)
+
+	// as are plain HTTP requests
+	res, err := httpClient.Do(newReq("http://"+l.Addr, "example.com"))
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 403)
+}
+
+func (s *S) TestInvalidClientCA(c *C) {
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	err := l.AddRoute((&router.HTTPRoute{
+		Domain:   "example.com",
+		Service:  "test",
+		ClientCA: "not a certificate",
+	}).ToRoute())
+	c.Assert(err, Equals, ErrInvalidClientCA)
+}
+
+func (s *S) TestRoundRobinHTTPRoute(c *C) {
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	defer srv1.Close()
+	defer srv2.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, (&router.HTTPRoute{
+		Domain:       "example.com",
+		Service:      "test",
+		LoadBalancer: "round-robin",
+	}).ToRoute())
+
+	discoverdRegisterHTTP(c, l, srv1.Listener.Addr().String())
+	discoverdRegisterHTTP(c, l, srv2.Listener.Addr().String())
+
+	var prev string
+	for i := 0; i < 10; i++ {
+		res, err := httpClient.Do(newReq("http://"+l.Addr, "example.com"))
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Not(Equals), prev)
+		prev = string(data)
+	}
+}
+
+func (s *S) TestWeightedRoundRobinHTTPRoute(c *C) {
+	srvs := make([]*httptest.Server, 4)
+	for i := range srvs {
+		srvs[i] = httptest.NewServer(httpTestHandler(fmt.Sprint(i)))
+		defer srvs[i].Close()
+	}
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, (&router.HTTPRoute{
+		Domain:       "example.com",
+		LoadBalancer: "round-robin",
+		Services: []router.WeightedService{
+			{Name: "test", Weight: 1},
+			{Name: "test-canary", Weight: 1},
+		},
+	}).ToRoute())
+	discoverdRegisterHTTPService(c, l, "test", srvs[0].Listener.Addr().String())
+	discoverdRegisterHTTPService(c, l, "test", srvs[1].Listener.Addr().String())
+	discoverdRegisterHTTPService(c, l, "test-canary", srvs[2].Listener.Addr().String())
+	discoverdRegisterHTTPService(c, l, "test-canary", srvs[3].Listener.Addr().String())
+
+	// requests rotate through the backends of both services
+	counts := make(map[string]int)
+	for i := 0; i < 40; i++ {
+		res, err := httpClient.Do(newReq("http://"+l.Addr, "example.com"))
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, IsNil)
+		counts[string(data)]++
+	}
+	c.Assert(counts, HasLen, 4, Commentf("counts = %v", counts))
+}
+
+func (s *S) TestLeastConnHTTPRoute(c *C) {
+	release := make(chan struct{})
+	handler := func(id string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(id))
+			if req.URL.Path == "/hold" {
+				w.(http.Flusher).Flush()
+				<-release
+			}
+		})
+	}
+	srv1 := httptest.NewServer(handler("1"))
+	srv2 := httptest.NewServer(handler("2"))
+	defer srv1.Close()
+	defer srv2.Close()
+	// release the held request before closing the servers
+	defer close(release)
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, (&router.HTTPRoute{
+		Domain:       "example.com",
+		Service:      "test",
+		LoadBalancer: "least-conn",
+	}).ToRoute())
+
+	discoverdRegisterHTTP(c, l, srv1.Listener.Addr().String())
+	discoverdRegisterHTTP(c, l, srv2.Listener.Addr().String())
+
+	// hold a connection open on one of the backends
+	res, err := httpClient.Do(newReq("http://"+l.Addr+"/hold", "example.com"))
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	held := make([]byte, 1)
+	_, err = io.ReadFull(res.Body, held)
+	c.Assert(err, IsNil)
+
+	// new requests go to the other backend while the connection is open
+	other := "1"
+	if string(held) == "1" {
+		other = "2"
+	}
+	for i := 0; i < 5; i++ {
+		assertGet(c, "http://"+l.Addr, "example.com", other)
+	}
+}
+
+func (s *S) TestHashHTTPRoute(c *C) {
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	defer srv1.Close()
+	defer srv2.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, (&router.HTTPRoute{
+		Domain:       "example.com",
+		Service:      "test",
+		LoadBalancer: "hash",
+		HashHeader:   "X-User",
+	}).ToRoute())
+
+	discoverdRegisterHTTP(c, l, srv1.Listener.Addr().String())
+	discoverdRegisterHTTP(c, l, srv2.Listener.Addr().String())
+
+	for _, user := range []string{"a", "b", "c", "d"} {
+		var backend string
+		for i := 0; i < 5; i++ {
+			req := newReq("http://"+l.Addr, "example.com")
+			req.Header.Set("X-User", user)
+			res, err := httpClient.Do(req)
+			c.Assert(err, IsNil)
+			data, err := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			c.Assert(err, IsNil)
+			if backend == "" {
+				backend = string(data)
+			}
+			c.Assert(string(data), Equals, backend)
+		}
+	}
+}
+
+func (s *S) TestHTTPRateLimit(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, (&router.HTTPRoute{
+		Domain:         "example.com",
+		Service:        "test",
+		RateLimit:      0.1,
+		RateLimitBurst: 2,
+	}).ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	assertGet(c, "http://"+l.Addr, "example.com", "1")
+	assertGet(c, "http://"+l.Addr, "example.com", "1")
+
+	res, err := httpClient.Do(newReq("http://"+l.Addr, "example.com"))
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 429)
+	c.Assert(res.Header.Get("Retry-After"), Equals, "1")
+}
+
+func (s *S) TestHTTPMaxConns(c *C) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-block
+	}))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, (&router.HTTPRoute{
+		Domain:   "example.com",
+		Service:  "test",
+		MaxConns: 1,
+	}).ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		res, err := newHTTPClient("example.com").Do(newReq("http://"+l.Addr, "example.com"))
+		if err == nil {
+			res.Body.Close()
+		}
+	}()
+	// wait for the first request to reach the backend
+	for i := 0; l.conns.Count(srv.Listener.Addr().String()) == 0; i++ {
+		if i > 100 {
+			c.Fatal("timed out waiting for request to reach backend")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	res, err := httpClient.Do(newReq("http://"+l.Addr, "example.com"))
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 429)
+
+	close(block)
+	<-done
+}
+
+func (s *S) TestInvalidLoadBalancer(c *C) {
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	err := l.AddRoute((&router.HTTPRoute{
+		Domain:       "example.com",
+		Service:      "test",
+		LoadBalancer: "fastest",
+	}).ToRoute())
+	c.Assert(err, Equals, proxy.ErrUnknownBalancer)
+}
+
 func wsHandshakeTestHandler(id string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		if strings.ToLower(req.Header.Get("Connection")) == "upgrade" {
@@ -677,6 +1297,72 @@ func (s *S) TestStickyHTTPRouteWebsocket(c *C) {
 	}
 }
 
+func (s *S) TestHTTP2(c *C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Proto))
+	}))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addHTTPRoute(c, l)
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	client := newHTTPClient("example.com")
+	client.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+	res, err := client.Do(newReq("https://"+l.TLSAddr, "example.com"))
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(res.ProtoMajor, Equals, 2)
+
+	// the backend is still spoken to over HTTP/1.1
+	data, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "HTTP/1.1")
+}
+
+func (s *S) TestHTTPProxyProtocol(c *C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Header.Get("X-Forwarded-For")))
+	}))
+	defer srv.Close()
+
+	l := &HTTPListener{
+		Addr:          "127.0.0.1:0",
+		TLSAddr:       "127.0.0.1:0",
+		ds:            NewEtcdDataStore(s.etcd, fmt.Sprintf("/router/http/%s/", random.String(8))),
+		discoverd:     s.discoverd,
+		proxyProtocol: true,
+	}
+	c.Assert(l.Start(), IsNil)
+	defer l.Close()
+
+	addHTTPRoute(c, l)
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	conn, err := net.Dial("tcp", l.Addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	fmt.Fprint(conn, "PROXY TCP4 192.168.0.1 10.0.0.1 56324 80\r\n")
+	req := newReq("http://"+l.Addr, "example.com")
+	c.Assert(req.Write(conn), IsNil)
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "192.168.0.1")
+
+	// connections without a header are refused
+	res, err = httpClient.Do(newReq("http://"+l.Addr, "example.com"))
+	if err == nil {
+		res.Body.Close()
+	}
+	c.Assert(err, Not(IsNil))
+}
+
 func (s *S) TestNoBackends(c *C) {
 	l := s.newHTTPListener(c)
 	defer l.Close()
@@ -697,6 +1383,108 @@ func (s *S) TestNoBackends(c *C) {
 	c.Assert(string(data), Equals, "Service Unavailable\n")
 }
 
+func (s *S) TestCustomErrorPage(c *C) {
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	page := "<html><body>Please try again later</body></html>"
+	addRoute(c, l, (&router.HTTPRoute{
+		Domain:     "example.com",
+		Service:    "example-com",
+		ErrorPages: map[string]string{"503": page},
+	}).ToRoute())
+
+	res, err := newHTTPClient("example.com").Do(newReq("http://"+l.Addr, "example.com"))
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+
+	c.Assert(res.StatusCode, Equals, 503)
+	c.Assert(res.Header.Get("Content-Type"), Equals, "text/html; charset=utf-8")
+	data, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, page)
+}
+
+func (s *S) TestBadGatewayErrorPage(c *C) {
+	// the backend closes connections without responding
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	page := "<html><body>Bad gateway</body></html>"
+	addRoute(c, l, (&router.HTTPRoute{
+		Domain:     "example.com",
+		Service:    "test",
+		ErrorPages: map[string]string{"502": page},
+	}).ToRoute())
+	discoverdRegisterHTTP(c, l, ln.Addr().String())
+
+	res, err := newHTTPClient("example.com").Do(newReq("http://"+l.Addr, "example.com"))
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 502)
+	data, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, page)
+}
+
+func (s *S) TestInvalidErrorPage(c *C) {
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	err := l.AddRoute((&router.HTTPRoute{
+		Domain:     "example.com",
+		Service:    "test",
+		ErrorPages: map[string]string{"404": "not found"},
+	}).ToRoute())
+	c.Assert(err, Equals, ErrInvalidErrorPage)
+}
+
+func (s *S) TestMaintenanceMode(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	route := (&router.HTTPRoute{
+		Domain:      "example.com",
+		Service:     "test",
+		Maintenance: true,
+		ErrorPages:  map[string]string{"maintenance": "down for maintenance"},
+	}).ToRoute()
+	addRoute(c, l, route)
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	res, err := newHTTPClient("example.com").Do(newReq("http://"+l.Addr, "example.com"))
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 503)
+	c.Assert(string(data), Equals, "down for maintenance")
+
+	// disabling maintenance mode proxies requests again
+	hr := route.HTTPRoute()
+	hr.Maintenance = false
+	wait := waitForEvent(c, l, "set", "example.com")
+	c.Assert(l.SetRoute(hr.ToRoute()), IsNil)
+	wait()
+	assertGet(c, "http://"+l.Addr, "example.com", "1")
+}
+
 func (s *S) TestNoResponsiveBackends(c *C) {
 	l := s.newHTTPListener(c)
 	defer l.Close()
@@ -863,10 +1651,11 @@ func (s *S) runTestErrorAfterConnOnlyHitsOneBackend(c *C, upgrade bool) {
 	c.Assert(err, IsNil)
 	defer res.Body.Close()
 
-	c.Assert(res.StatusCode, Equals, 503)
+	// the backend failed after the connection was made
+	c.Assert(res.StatusCode, Equals, 502)
 	data, err := ioutil.ReadAll(res.Body)
 	c.Assert(err, IsNil)
-	c.Assert(string(data), Equals, "Service Unavailable\n")
+	c.Assert(string(data), Equals, "Bad Gateway\n")
 }
 
 // issue #152
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimiter limits the rate of requests from each client using a token
+// bucket per client.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mtx       sync.Mutex
+	clients   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiterSweepInterval is how often buckets which have refilled are
+// removed so that the client map doesn't grow without bound.
+const rateLimiterSweepInterval = time.Minute
+
+// newRateLimiter returns a rateLimiter allowing rate requests per second per
+// client with bursts of up to burst requests. If burst is zero, it defaults to
+// the rate rounded up.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	b := float64(burst)
+	if b <= 0 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &rateLimiter{
+		rate:      rate,
+		burst:     b,
+		clients:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow reports whether a request from client is allowed, consuming a token
+// if it is.
+func (l *rateLimiter) Allow(client string) bool {
+	now := time.Now()
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if now.Sub(l.lastSweep) > rateLimiterSweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.clients[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.clients[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep removes buckets which would be full by now, the caller must hold l.mtx.
+func (l *rateLimiter) sweep(now time.Time) {
+	for client, b := range l.clients {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.clients, client)
+		}
+	}
+	l.lastSweep = now
+}
+
+// concurrencyLimiter limits the number of concurrent requests or connections.
+type concurrencyLimiter chan struct{}
+
+func newConcurrencyLimiter(max int) concurrencyLimiter {
+	return make(concurrencyLimiter, max)
+}
+
+// Acquire reserves a slot without blocking, returning false if the limit has
+// been reached.
+func (l concurrencyLimiter) Acquire() bool {
+	select {
+	case l <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l concurrencyLimiter) Release() {
+	<-l
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/router/proxy"
+)
+
+// A metricsWriter writes its metrics in the Prometheus text exposition format.
+type metricsWriter interface {
+	WriteMetrics(w io.Writer) error
+}
+
+// writeMetrics writes all of the given metrics to w.
+func writeMetrics(w io.Writer, metrics ...metricsWriter) error {
+	for _, m := range metrics {
+		if err := m.WriteMetrics(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defaultLatencyBuckets are the upper bounds in seconds of the request
+// latency histogram buckets.
+var defaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricVec is a set of values for a metric, keyed by label values.
+type metricVec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mtx    sync.Mutex
+	values map[string]*metricValue
+}
+
+type metricValue struct {
+	labels []string
+	value  float64
+
+	// removed is set on gauges which were deleted while non-zero, the value
+	// is deleted once it drops back to zero
+	removed bool
+
+	// only used by histograms
+	buckets []uint64
+	count   uint64
+}
+
+func newCounterVec(name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, typ: "counter", labels: labels, values: make(map[string]*metricValue)}
+}
+
+func newGaugeVec(name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, typ: "gauge", labels: labels, values: make(map[string]*metricValue)}
+}
+
+func newHistogramVec(name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, typ: "histogram", labels: labels, values: make(map[string]*metricValue)}
+}
+
+// get returns the value for the label values, creating it if necessary. The
+// caller must hold v.mtx.
+func (v *metricVec) get(labels []string) *metricValue {
+	key := strings.Join(labels, "\xff")
+	val, ok := v.values[key]
+	if !ok {
+		val = &metricValue{labels: labels}
+		if v.typ == "histogram" {
+			val.buckets = make([]uint64, len(defaultLatencyBuckets))
+		}
+		v.values[key] = val
+	}
+	return val
+}
+
+func (v *metricVec) Add(delta float64, labels ...string) {
+	v.mtx.Lock()
+	val := v.get(labels)
+	val.value += delta
+	if val.removed && val.value == 0 {
+		delete(v.values, strings.Join(labels, "\xff"))
+	}
+	v.mtx.Unlock()
+}
+
+func (v *metricVec) Inc(labels ...string) { v.Add(1, labels...) }
+func (v *metricVec) Dec(labels ...string) { v.Add(-1, labels...) }
+
+func (v *metricVec) Observe(d time.Duration, labels ...string) {
+	s := d.Seconds()
+	v.mtx.Lock()
+	val := v.get(labels)
+	for i, le := range defaultLatencyBuckets {
+		if s <= le {
+			val.buckets[i]++
+		}
+	}
+	val.count++
+	val.value += s
+	v.mtx.Unlock()
+}
+
+// Delete removes the values for all label sets where the first label value
+// is first, used when a route is removed. Non-zero gauges are kept until they
+// drop back to zero so that in-flight requests and connections which
+// decrement them later do not recreate them with a negative value.
+func (v *metricVec) Delete(first string) {
+	v.mtx.Lock()
+	for k, val := range v.values {
+		if len(val.labels) == 0 || val.labels[0] != first {
+			continue
+		}
+		if v.typ == "gauge" && val.value != 0 {
+			val.removed = true
+			continue
+		}
+		delete(v.values, k)
+	}
+	v.mtx.Unlock()
+}
+
+func (v *metricVec) WriteMetrics(w io.Writer) error {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(b, "# TYPE %s %s\n", v.name, v.typ)
+	for _, k := range keys {
+		val := v.values[k]
+		if v.typ != "histogram" {
+			fmt.Fprintf(b, "%s%s %s\n", v.name, v.formatLabels(val.labels, ""), formatFloat(val.value))
+			continue
+		}
+		for i, le := range defaultLatencyBuckets {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", v.name, v.formatLabels(val.labels, formatFloat(le)), val.buckets[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", v.name, v.formatLabels(val.labels, "+Inf"), val.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", v.name, v.formatLabels(val.labels, ""), formatFloat(val.value))
+		fmt.Fprintf(b, "%s_count%s %d\n", v.name, v.formatLabels(val.labels, ""), val.count)
+	}
+	return b.Flush()
+}
+
+func (v *metricVec) formatLabels(values []string, le string) string {
+	pairs := make([]string, 0, len(values)+1)
+	for i, name := range v.labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", name, strconv.Quote(values[i])))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=%q", le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// statusClass returns the class of an HTTP status code, such as "2xx".
+func statusClass(code int) string {
+	return strconv.Itoa(code/100) + "xx"
+}
+
+type httpMetrics struct {
+	requests *metricVec
+	latency  *metricVec
+	active   *metricVec
+}
+
+func newHTTPMetrics() *httpMetrics {
+	return &httpMetrics{
+		requests: newCounterVec("router_http_requests_total", "Total HTTP requests by route, backend and status class.", "route", "backend", "status"),
+		latency:  newHistogramVec("router_http_request_duration_seconds", "HTTP request latency by route and backend.", "route", "backend"),
+		active:   newGaugeVec("router_http_active_requests", "In-flight HTTP requests by route.", "route"),
+	}
+}
+
+func (m *httpMetrics) WriteMetrics(w io.Writer) error {
+	return writeMetrics(w, m.requests, m.latency, m.active)
+}
+
+// removeRoute removes all metrics for the route with the given domain.
+func (m *httpMetrics) removeRoute(domain string) {
+	m.requests.Delete(domain)
+	m.latency.Delete(domain)
+	m.active.Delete(domain)
+}
+
+type tcpMetrics struct {
+	conns  *metricVec
+	active *metricVec
+}
+
+func newTCPMetrics() *tcpMetrics {
+	return &tcpMetrics{
+		conns:  newCounterVec("router_tcp_connections_total", "Total TCP connections by route.", "route"),
+		active: newGaugeVec("router_tcp_active_connections", "Open TCP connections by route.", "route"),
+	}
+}
+
+func (m *tcpMetrics) WriteMetrics(w io.Writer) error {
+	return writeMetrics(w, m.conns, m.active)
+}
+
+// removeRoute removes all metrics for the route with the given port.
+func (m *tcpMetrics) removeRoute(port string) {
+	m.conns.Delete(port)
+	m.active.Delete(port)
+}
+
+// backendConns is a snapshot of the active connections to the backends of a
+// service.
+type backendConns struct {
+	service string
+	addrs   []string
+	conns   *proxy.ConnCounter
+}
+
+// backendConnsGauge returns a gauge of the active connections to each backend
+// of the given services.
+func backendConnsGauge(name string, services []backendConns) *metricVec {
+	g := newGaugeVec(name, "Active connections by service and backend.", "service", "backend")
+	for _, s := range services {
+		for _, addr := range s.addrs {
+			g.Add(float64(s.conns.Count(addr)), s.service, addr)
+		}
+	}
+	return g
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/router/types"
+)
+
+// postgresSchema creates the routes table along with a trigger which notifies
+// listeners of the "routes" channel of changes with a payload of
+// "<set|remove>:<type>:<id>". The statements are idempotent rather than
+// migrations so that the table can live in a database shared with other
+// components.
+var postgresSchema = []string{
+	`SELECT pg_advisory_xact_lock(hashtext('router_routes'))`,
+	`CREATE TABLE IF NOT EXISTS routes (
+    type text NOT NULL,
+    id text NOT NULL,
+    parent_ref text NOT NULL DEFAULT '',
+    config text NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    updated_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (type, id)
+)`,
+	`CREATE OR REPLACE FUNCTION notify_route_update() RETURNS TRIGGER AS $$
+    BEGIN
+    IF (TG_OP = 'DELETE') THEN
+        PERFORM pg_notify('routes', 'remove:' || OLD.type || ':' || OLD.id);
+        RETURN OLD;
+    END IF;
+    PERFORM pg_notify('routes', 'set:' || NEW.type || ':' || NEW.id);
+    RETURN NEW;
+    END;
+$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS notify_route_update ON routes`,
+	`CREATE TRIGGER notify_route_update
+    AFTER INSERT OR UPDATE OR DELETE ON routes
+    FOR EACH ROW EXECUTE PROCEDURE notify_route_update()`,
+}
+
+// migratePostgresDataStore creates the schema used by postgresDataStore if it
+// doesn't exist.
+func migratePostgresDataStore(db *postgres.DB) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	for _, stmt := range postgresSchema {
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// NewPostgresDataStore returns a DataStore for routes of routeType stored in
+// Postgres. Changes are synced using LISTEN/NOTIFY.
+func NewPostgresDataStore(routeType string, db *postgres.DB) DataStore {
+	return &postgresDataStore{
+		routeType: routeType,
+		db:        db,
+		stopSync:  make(chan struct{}),
+	}
+}
+
+type postgresDataStore struct {
+	routeType string
+	db        *postgres.DB
+	stopSync  chan struct{}
+}
+
+func (s *postgresDataStore) Add(r *router.Route) error {
+	config, err := routeConfig(r)
+	if err != nil {
+		return err
+	}
+	err = s.db.Exec("INSERT INTO routes (type, id, parent_ref, config, created_at, updated_at) VALUES ($1, $2, $3, $4, COALESCE($5, now()), COALESCE($6, now()))",
+		s.routeType, r.ID, r.ParentRef, config, r.CreatedAt, r.UpdatedAt)
+	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+		err = ErrExists
+	}
+	return err
+}
+
+func (s *postgresDataStore) Set(r *router.Route) error {
+	config, err := routeConfig(r)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	// FOR UPDATE doesn't lock a row which doesn't exist yet, so lock the
+	// route ID to stop concurrent calls from both inserting it
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('router_route'), hashtext($1::text || ':' || $2::text))", s.routeType, r.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	var exists bool
+	if err := tx.QueryRow("SELECT true FROM routes WHERE type = $1 AND id = $2 FOR UPDATE", s.routeType, r.ID).Scan(&exists); err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return err
+	}
+	if exists {
+		_, err = tx.Exec("UPDATE routes SET parent_ref = $3, config = $4, updated_at = COALESCE($5, now()) WHERE type = $1 AND id = $2",
+			s.routeType, r.ID, r.ParentRef, config, r.UpdatedAt)
+	} else {
+		_, err = tx.Exec("INSERT INTO routes (type, id, parent_ref, config, created_at, updated_at) VALUES ($1, $2, $3, $4, COALESCE($5, now()), COALESCE($6, now()))",
+			s.routeType, r.ID, r.ParentRef, config, r.CreatedAt, r.UpdatedAt)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *postgresDataStore) Remove(id string) error {
+	var removed string
+	err := s.db.QueryRow("DELETE FROM routes WHERE type = $1 AND id = $2 RETURNING id", s.routeType, id).Scan(&removed)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return err
+}
+
+func (s *postgresDataStore) Get(id string) (*router.Route, error) {
+	return scanRoute(s.db.QueryRow("SELECT type, id, parent_ref, config, created_at, updated_at FROM routes WHERE type = $1 AND id = $2", s.routeType, id))
+}
+
+func (s *postgresDataStore) List() ([]*router.Route, error) {
+	rows, err := s.db.Query("SELECT type, id, parent_ref, config, created_at, updated_at FROM routes WHERE type = $1 ORDER BY created_at", s.routeType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var routes []*router.Route
+	for rows.Next() {
+		r, err := scanRoute(rows)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, r)
+	}
+	return routes, rows.Err()
+}
+
+func routeConfig(r *router.Route) (string, error) {
+	if r.Config == nil {
+		return "", router.ErrNoConfig
+	}
+	return string(*r.Config), nil
+}
+
+func scanRoute(s postgres.Scanner) (*router.Route, error) {
+	r := &router.Route{}
+	var config string
+	var createdAt, updatedAt time.Time
+	err := s.Scan(&r.Type, &r.ID, &r.ParentRef, &config, &createdAt, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	raw := json.RawMessage(config)
+	r.Config = &raw
+	r.CreatedAt = &createdAt
+	r.UpdatedAt = &updatedAt
+	return r, nil
+}
+
+// Sync calls h with all routes and then with each change notified by
+// Postgres. The listener is started before the routes are read so that no
+// changes are missed, and all routes are read again whenever it reconnects.
+func (s *postgresDataStore) Sync(h SyncHandler, started chan<- error) {
+	// check that the database is reachable before listening, as Listen
+	// blocks until it connects
+	if _, err := s.List(); err != nil {
+		started <- err
+		return
+	}
+
+	listenerEvent := func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Postgres route listener error: %s", err)
+		}
+	}
+	listener := pq.NewListener(s.db.DSN(), 10*time.Second, time.Minute, listenerEvent)
+	defer listener.Close()
+	if err := listener.Listen("routes"); err != nil {
+		started <- err
+		return
+	}
+
+	ids := make(map[string]struct{})
+	fullSync := func() error {
+		routes, err := s.List()
+		if err != nil {
+			return err
+		}
+		newIDs := make(map[string]struct{}, len(routes))
+		for _, r := range routes {
+			if err := h.Set(r); err != nil {
+				return err
+			}
+			newIDs[r.ID] = struct{}{}
+		}
+		for id := range ids {
+			if _, ok := newIDs[id]; ok {
+				continue
+			}
+			if err := h.Remove(id); err != nil {
+				log.Printf("Error while processing delete from postgres fullsync: %s, %s", id, err)
+			}
+		}
+		ids = newIDs
+		return nil
+	}
+	if err := fullSync(); err != nil {
+		started <- err
+		return
+	}
+	started <- nil
+
+	for {
+		select {
+		case n := <-listener.Notify:
+			if n == nil {
+				// the listener reconnected and may have missed notifications
+				for {
+					err := fullSync()
+					if err == nil {
+						break
+					}
+					log.Printf("Error while doing fullsync from postgres: %s", err)
+					select {
+					case <-s.stopSync:
+						return
+					case <-time.After(time.Second):
+					}
+				}
+				continue
+			}
+			s.handleNotification(h, n.Extra, ids)
+		case <-s.stopSync:
+			return
+		}
+	}
+}
+
+func (s *postgresDataStore) handleNotification(h SyncHandler, payload string, ids map[string]struct{}) {
+	parts := strings.SplitN(payload, ":", 3)
+	if len(parts) != 3 || parts[1] != s.routeType {
+		return
+	}
+	op, id := parts[0], parts[2]
+	if op == "remove" {
+		if _, ok := ids[id]; !ok {
+			return
+		}
+		delete(ids, id)
+		if err := h.Remove(id); err != nil {
+			log.Printf("Error while processing delete from postgres: %s, %s", id, err)
+		}
+		return
+	}
+	r, err := s.Get(id)
+	if err == ErrNotFound {
+		// removed since the notification was sent
+		return
+	} else if err != nil {
+		log.Printf("Error while fetching route from postgres: %s, %s", id, err)
+		return
+	}
+	ids[id] = struct{}{}
+	if err := h.Set(r); err != nil {
+		log.Printf("Error while processing update from postgres: %s, %#v", err, r)
+	}
+}
+
+func (s *postgresDataStore) StopSync() {
+	close(s.stopSync)
+}
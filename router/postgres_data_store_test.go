@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/pkg/testutils"
+	"github.com/flynn/flynn/router/types"
+)
+
+type PostgresSuite struct {
+	db *postgres.DB
+}
+
+var _ = Suite(&PostgresSuite{})
+
+func (s *PostgresSuite) SetUpSuite(c *C) {
+	dbname := "routertest"
+	if err := testutils.SetupPostgres(dbname); err != nil {
+		c.Fatal(err)
+	}
+	dsn := fmt.Sprintf("dbname=%s", dbname)
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		c.Fatal(err)
+	}
+	s.db = postgres.New(db, dsn)
+	if err := migratePostgresDataStore(s.db); err != nil {
+		c.Fatal(err)
+	}
+}
+
+func (s *PostgresSuite) TearDownSuite(c *C) {
+	if s.db != nil {
+		s.db.Close()
+	}
+}
+
+// newDataStore returns a data store for a unique route type so that tests
+// don't see each other's routes.
+func (s *PostgresSuite) newDataStore() DataStore {
+	return NewPostgresDataStore("test-"+random.String(8), s.db)
+}
+
+type syncEvent struct {
+	op    string
+	id    string
+	route *router.Route
+}
+
+// fakeSyncHandler sends the calls it receives to a channel.
+type fakeSyncHandler chan *syncEvent
+
+func (h fakeSyncHandler) Set(r *router.Route) error {
+	h <- &syncEvent{op: "set", id: r.ID, route: r}
+	return nil
+}
+
+func (h fakeSyncHandler) Remove(id string) error {
+	h <- &syncEvent{op: "remove", id: id}
+	return nil
+}
+
+func (h fakeSyncHandler) expect(c *C, op, id string) *syncEvent {
+	select {
+	case e := <-h:
+		c.Assert(e.op, Equals, op)
+		c.Assert(e.id, Equals, id)
+		return e
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for %s %s", op, id)
+	}
+	return nil
+}
+
+func newTestRoute(id, domain string) *router.Route {
+	r := (&router.HTTPRoute{Domain: domain, Service: "test"}).ToRoute()
+	r.ID = id
+	r.ParentRef = "test/" + id
+	return r
+}
+
+func (s *PostgresSuite) TestAddGetRemove(c *C) {
+	ds := s.newDataStore()
+
+	r := newTestRoute("foo", "example.com")
+	c.Assert(ds.Add(r), IsNil)
+	c.Assert(ds.Add(r), Equals, ErrExists)
+
+	got, err := ds.Get("foo")
+	c.Assert(err, IsNil)
+	c.Assert(got.ID, Equals, "foo")
+	c.Assert(got.ParentRef, Equals, "test/foo")
+	c.Assert(got.HTTPRoute().Domain, Equals, "example.com")
+	c.Assert(got.CreatedAt, NotNil)
+
+	routes, err := ds.List()
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 1)
+
+	// Set replaces existing routes and creates missing ones
+	c.Assert(ds.Set(newTestRoute("foo", "example.net")), IsNil)
+	c.Assert(ds.Set(newTestRoute("bar", "example.org")), IsNil)
+	got, err = ds.Get("foo")
+	c.Assert(err, IsNil)
+	c.Assert(got.HTTPRoute().Domain, Equals, "example.net")
+	routes, err = ds.List()
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 2)
+
+	c.Assert(ds.Remove("foo"), IsNil)
+	c.Assert(ds.Remove("foo"), Equals, ErrNotFound)
+	_, err = ds.Get("foo")
+	c.Assert(err, Equals, ErrNotFound)
+}
+
+func (s *PostgresSuite) TestConcurrentSet(c *C) {
+	ds := s.newDataStore()
+
+	// concurrent calls for a new route all succeed, the route is only
+	// inserted once
+	errs := make(chan error)
+	for i := 0; i < 5; i++ {
+		go func(i int) {
+			errs <- ds.Set(newTestRoute("foo", fmt.Sprintf("%d.example.com", i)))
+		}(i)
+	}
+	for i := 0; i < 5; i++ {
+		c.Assert(<-errs, IsNil)
+	}
+	routes, err := ds.List()
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 1)
+}
+
+func (s *PostgresSuite) TestSync(c *C) {
+	ds := s.newDataStore()
+	c.Assert(ds.Add(newTestRoute("initial", "initial.example.com")), IsNil)
+
+	h := make(fakeSyncHandler, 10)
+	started := make(chan error)
+	go ds.Sync(h, started)
+	c.Assert(<-started, IsNil)
+	defer ds.StopSync()
+
+	// existing routes are synced before Sync starts
+	e := h.expect(c, "set", "initial")
+	c.Assert(e.route.HTTPRoute().Domain, Equals, "initial.example.com")
+
+	c.Assert(ds.Add(newTestRoute("added", "added.example.com")), IsNil)
+	h.expect(c, "set", "added")
+
+	c.Assert(ds.Set(newTestRoute("added", "updated.example.com")), IsNil)
+	e = h.expect(c, "set", "added")
+	c.Assert(e.route.HTTPRoute().Domain, Equals, "updated.example.com")
+
+	c.Assert(ds.Remove("initial"), IsNil)
+	h.expect(c, "remove", "initial")
+
+	// changes to routes of other types are ignored
+	other := s.newDataStore()
+	c.Assert(other.Add(newTestRoute("other", "other.example.com")), IsNil)
+	c.Assert(ds.Remove("added"), IsNil)
+	h.expect(c, "remove", "added")
+}
@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"errors"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Load balancing algorithms understood by NewBalancer.
+const (
+	BalancerRandom     = "random"
+	BalancerRoundRobin = "round-robin"
+	BalancerLeastConn  = "least-conn"
+	BalancerHash       = "hash"
+)
+
+var ErrUnknownBalancer = errors.New("router: unknown load balancing algorithm")
+
+// A Balancer orders backends by preference for an inbound request or
+// connection. The first backend is tried first, and the rest are used in order
+// if dialing fails. req is nil for TCP connections, clientAddr is the remote
+// address of the client.
+type Balancer interface {
+	Order(backends []string, req *http.Request, clientAddr string)
+}
+
+// NewBalancer returns a Balancer implementing the named algorithm. An empty
+// name selects the random balancer. conns is used by the least-connections
+// balancer, and hashHeader names the request header used as the hash key by
+// the hash balancer (the client IP is used if it is empty or not present).
+func NewBalancer(name string, conns *ConnCounter, hashHeader string) (Balancer, error) {
+	switch name {
+	case "", BalancerRandom:
+		return randomBalancer{}, nil
+	case BalancerRoundRobin:
+		return &roundRobinBalancer{}, nil
+	case BalancerLeastConn:
+		return &leastConnBalancer{conns: conns}, nil
+	case BalancerHash:
+		return &hashBalancer{header: hashHeader}, nil
+	default:
+		return nil, ErrUnknownBalancer
+	}
+}
+
+type randomBalancer struct{}
+
+func (randomBalancer) Order(backends []string, req *http.Request, clientAddr string) {
+	shuffle(backends)
+}
+
+type roundRobinBalancer struct {
+	next uint64
+}
+
+func (b *roundRobinBalancer) Order(backends []string, req *http.Request, clientAddr string) {
+	if len(backends) == 0 {
+		return
+	}
+	// backends come from an unordered set, so sort them to get a stable
+	// rotation
+	sort.Strings(backends)
+	n := int(atomic.AddUint64(&b.next, 1) % uint64(len(backends)))
+	rotated := make([]string, 0, len(backends))
+	rotated = append(rotated, backends[n:]...)
+	rotated = append(rotated, backends[:n]...)
+	copy(backends, rotated)
+}
+
+type leastConnBalancer struct {
+	conns *ConnCounter
+}
+
+func (b *leastConnBalancer) Order(backends []string, req *http.Request, clientAddr string) {
+	// shuffle first so that ties are broken randomly
+	shuffle(backends)
+	counts := b.conns.counts(backends)
+	sort.Stable(byConns{backends, counts})
+}
+
+type byConns struct {
+	backends []string
+	counts   map[string]int
+}
+
+func (s byConns) Len() int           { return len(s.backends) }
+func (s byConns) Less(i, j int) bool { return s.counts[s.backends[i]] < s.counts[s.backends[j]] }
+func (s byConns) Swap(i, j int)      { s.backends[i], s.backends[j] = s.backends[j], s.backends[i] }
+
+// hashBalancer uses rendezvous hashing so that a key maps to the same backend
+// as long as it is available, and only keys belonging to a removed backend are
+// moved when the backend set changes.
+type hashBalancer struct {
+	header string
+}
+
+func (b *hashBalancer) Order(backends []string, req *http.Request, clientAddr string) {
+	key := ""
+	if req != nil && b.header != "" {
+		key = req.Header.Get(b.header)
+	}
+	if key == "" {
+		key = clientAddr
+		if host, _, err := net.SplitHostPort(clientAddr); err == nil {
+			key = host
+		}
+	}
+
+	scores := make(map[string]uint64, len(backends))
+	for _, backend := range backends {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(backend))
+		scores[backend] = h.Sum64()
+	}
+	sort.Sort(byScore{backends, scores})
+}
+
+type byScore struct {
+	backends []string
+	scores   map[string]uint64
+}
+
+func (s byScore) Len() int           { return len(s.backends) }
+func (s byScore) Less(i, j int) bool { return s.scores[s.backends[i]] > s.scores[s.backends[j]] }
+func (s byScore) Swap(i, j int)      { s.backends[i], s.backends[j] = s.backends[j], s.backends[i] }
+
+// ConnCounter tracks the number of active connections to each backend of a
+// service. It is shared by all of the proxies for a service.
+type ConnCounter struct {
+	mtx   sync.Mutex
+	conns map[string]int
+}
+
+func NewConnCounter() *ConnCounter {
+	return &ConnCounter{conns: make(map[string]int)}
+}
+
+// Count returns the number of active connections to backend.
+func (c *ConnCounter) Count(backend string) int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.conns[backend]
+}
+
+func (c *ConnCounter) counts(backends []string) map[string]int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	res := make(map[string]int, len(backends))
+	for _, b := range backends {
+		res[b] = c.conns[b]
+	}
+	return res
+}
+
+func (c *ConnCounter) inc(backend string) {
+	c.mtx.Lock()
+	c.conns[backend]++
+	c.mtx.Unlock()
+}
+
+func (c *ConnCounter) dec(backend string) {
+	c.mtx.Lock()
+	if c.conns[backend]--; c.conns[backend] <= 0 {
+		delete(c.conns, backend)
+	}
+	c.mtx.Unlock()
+}
+
+// trackedConn decrements the connection count for a backend when closed.
+type trackedConn struct {
+	net.Conn
+	done func()
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.done)
+	return c.Conn.Close()
+}
+
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+// trackedBody decrements the connection count for a backend when the response
+// body is closed.
+type trackedBody struct {
+	io.ReadCloser
+	done func()
+	once sync.Once
+}
+
+func (b *trackedBody) Close() error {
+	b.once.Do(b.done)
+	return b.ReadCloser.Close()
+}
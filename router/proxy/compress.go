@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// compressMinLength is the smallest response body with a known length which
+// is compressed, smaller bodies are not worth the overhead.
+const compressMinLength = 256
+
+// shouldCompress reports whether the response should be gzipped, which is
+// the case if the client accepts gzip, the backend didn't encode the body and
+// the content type is one of types. Types may include wildcards for subtypes
+// such as "text/*".
+func shouldCompress(res *http.Response, types []string) bool {
+	if len(types) == 0 || res.Request == nil || res.Request.Method == "HEAD" {
+		return false
+	}
+	switch res.StatusCode {
+	case http.StatusSwitchingProtocols, http.StatusNoContent, http.StatusNotModified:
+		return false
+	}
+	if res.Header.Get("Content-Encoding") != "" || res.Header.Get("Content-Range") != "" {
+		return false
+	}
+	if res.ContentLength >= 0 && res.ContentLength < compressMinLength {
+		return false
+	}
+	if !acceptsGzip(res.Request.Header) {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		if t == mediaType || strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func acceptsGzip(h http.Header) bool {
+	for _, v := range h["Accept-Encoding"] {
+		for _, enc := range strings.Split(v, ",") {
+			enc = strings.TrimSpace(enc)
+			if i := strings.Index(enc, ";"); i >= 0 {
+				// ignore gzip if it has a quality value of zero
+				if q := strings.Replace(enc[i+1:], " ", "", -1); q == "q=0" || q == "q=0.0" {
+					continue
+				}
+				enc = strings.TrimSpace(enc[:i])
+			}
+			if enc == "gzip" || enc == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// weakenETag makes a strong ETag weak, as the gzipped response is not byte for
+// byte the same as the representation the backend tagged.
+func weakenETag(h http.Header) {
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+}
+
+// gzipWriter compresses writes to the client, flushing the compressed data
+// when the response is flushed.
+type gzipWriter struct {
+	gz *gzip.Writer
+	rw http.ResponseWriter
+}
+
+func (w *gzipWriter) Write(p []byte) (int, error) {
+	return w.gz.Write(p)
+}
+
+func (w *gzipWriter) Flush() {
+	w.gz.Flush()
+	if f, ok := w.rw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+var errRequestTooLarge = errors.New("router: request body too large")
+
+// bufferRequestBody reads the body of req into memory so that the request can
+// be sent to the backend without waiting on the client. It returns
+// errRequestTooLarge if the body is bigger than max bytes.
+func bufferRequestBody(req *http.Request, max int64) error {
+	if req.Body == nil {
+		return nil
+	}
+	if req.ContentLength > max {
+		return errRequestTooLarge
+	}
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(req.Body, max+1))
+	if err != nil {
+		return err
+	}
+	if n > max {
+		return errRequestTooLarge
+	}
+	req.Body.Close()
+	req.ContentLength = n
+	req.TransferEncoding = nil
+	if n == 0 {
+		// an empty body is sent with a zero Content-Length
+		req.Body = nil
+		return nil
+	}
+	req.Body = ioutil.NopCloser(&buf)
+	return nil
+}
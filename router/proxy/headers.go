@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Header rule actions.
+const (
+	HeaderAdd    = "add"
+	HeaderSet    = "set"
+	HeaderRemove = "remove"
+)
+
+var ErrInvalidHeaderRule = errors.New("router: header rules must have an action of add, set or remove and a name")
+
+// A HeaderRule modifies a single header of a request or response.
+type HeaderRule struct {
+	Action string
+	Name   string
+	Value  string
+}
+
+// HeaderRules is an ordered list of header modifications.
+type HeaderRules []HeaderRule
+
+// Validate returns ErrInvalidHeaderRule if any of the rules is invalid.
+func (rules HeaderRules) Validate() error {
+	for _, r := range rules {
+		if r.Name == "" {
+			return ErrInvalidHeaderRule
+		}
+		switch r.Action {
+		case HeaderAdd, HeaderSet, HeaderRemove:
+		default:
+			return ErrInvalidHeaderRule
+		}
+	}
+	return nil
+}
+
+// Apply applies the rules to h in order.
+func (rules HeaderRules) Apply(h http.Header) {
+	for _, r := range rules {
+		switch r.Action {
+		case HeaderAdd:
+			h.Add(r.Name, r.Value)
+		case HeaderSet:
+			h.Set(r.Name, r.Value)
+		case HeaderRemove:
+			h.Del(r.Name)
+		}
+	}
+}
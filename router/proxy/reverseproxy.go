@@ -7,13 +7,17 @@
 package proxy
 
 import (
+	"compress/gzip"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/flynn/flynn/router/proxyproto"
 )
 
 const (
@@ -36,6 +40,12 @@ var (
 	serviceUnavailable = []byte("Service Unavailable\n")
 )
 
+// BackendRecorder may be implemented by the http.ResponseWriter passed to
+// ReverseProxy.ServeHTTP to be told which backend served the request.
+type BackendRecorder interface {
+	SetBackend(addr string)
+}
+
 // ReverseProxy is an HTTP Handler that takes an incoming request and
 // sends it to another server, proxying the response back to the
 // client.
@@ -49,6 +59,30 @@ type ReverseProxy struct {
 	// If zero, no periodic flushing is done.
 	FlushInterval time.Duration
 
+	// ErrorPages maps HTTP status codes to response bodies served for errors
+	// generated by the proxy.
+	ErrorPages map[int][]byte
+
+	// RequestHeaders are applied to requests before they are sent to the
+	// backend, and ResponseHeaders to responses before they are sent to the
+	// client.
+	RequestHeaders  HeaderRules
+	ResponseHeaders HeaderRules
+
+	// CompressTypes lists the content types of responses which are gzipped
+	// for clients which accept it if the backend didn't compress them.
+	CompressTypes []string
+
+	// RequestBufferSize, if non-zero, causes request bodies to be read into
+	// memory before the request is sent to the backend, so that slow clients
+	// don't hold backend connections open. Bodies larger than the size are
+	// rejected.
+	RequestBufferSize int64
+
+	// ProxyProtocol enables sending a PROXY protocol header with the
+	// client's address to backends of TCP connections.
+	ProxyProtocol bool
+
 	// ErrorLog specifies an optional logger for errors
 	// that occur when attempting to proxy the request.
 	// If nil, logging goes to os.Stderr via the log package's
@@ -57,12 +91,28 @@ type ReverseProxy struct {
 }
 
 // NewReverseProxy initializes a new ReverseProxy with a callback to get
-// backends, a stickyKey for encrypting sticky session cookies, and a flag
-// sticky to enable sticky sessions.
-func NewReverseProxy(bf BackendListFunc, stickyKey *[32]byte, sticky bool) *ReverseProxy {
+// backends, a stickyKey for encrypting sticky session cookies, a flag sticky
+// to enable sticky sessions, a balancer to order backends and a counter to
+// track active backend connections with. If lb is nil, backends are chosen
+// randomly.
+func NewReverseProxy(bf BackendListFunc, stickyKey *[32]byte, sticky bool, lb Balancer, conns *ConnCounter) *ReverseProxy {
+	return NewWeightedReverseProxy([]BackendGroup{{Backends: bf, Weight: 1}}, stickyKey, sticky, lb, conns)
+}
+
+// NewWeightedReverseProxy is like NewReverseProxy, but splits requests
+// between groups of backends in proportion to their weights.
+func NewWeightedReverseProxy(groups []BackendGroup, stickyKey *[32]byte, sticky bool, lb Balancer, conns *ConnCounter) *ReverseProxy {
+	if lb == nil {
+		lb = randomBalancer{}
+	}
+	if conns == nil {
+		conns = NewConnCounter()
+	}
 	return &ReverseProxy{
 		transport: &transport{
-			getBackends:       bf,
+			groups:            groups,
+			balancer:          lb,
+			conns:             conns,
 			stickyCookieKey:   stickyKey,
 			useStickySessions: sticky,
 		},
@@ -78,17 +128,28 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	outreq := prepareRequest(req)
+	p.RequestHeaders.Apply(outreq.Header)
 
 	if isConnectionUpgrade(req.Header) {
 		p.serveUpgrade(rw, outreq)
 		return
 	}
 
+	if p.RequestBufferSize > 0 {
+		if err := bufferRequestBody(outreq, p.RequestBufferSize); err == errRequestTooLarge {
+			p.serveError(rw, http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			p.logf("router: error reading request body: %v", err)
+			p.serveError(rw, http.StatusBadRequest)
+			return
+		}
+	}
+
 	res, err := transport.RoundTrip(outreq)
 	if err != nil {
 		p.logf("router: proxy error: %v", err)
-		rw.WriteHeader(http.StatusServiceUnavailable)
-		rw.Write(serviceUnavailable)
+		p.serveError(rw, errorStatus(err))
 		return
 	}
 	defer res.Body.Close()
@@ -109,6 +170,14 @@ func (p *ReverseProxy) ServeConn(conn net.Conn) {
 		p.logf("router: proxy error: %v", err)
 		return
 	}
+	defer dconn.Close()
+
+	if p.ProxyProtocol {
+		if err := proxyproto.WriteHeader(dconn, conn.RemoteAddr(), conn.LocalAddr()); err != nil {
+			p.logf("router: proxy error: %v", err)
+			return
+		}
+	}
 
 	joinConns(conn, dconn)
 }
@@ -122,8 +191,7 @@ func (p *ReverseProxy) serveUpgrade(rw http.ResponseWriter, req *http.Request) {
 	res, uconn, err := transport.UpgradeHTTP(req)
 	if err != nil {
 		p.logf("router: proxy error: %v", err)
-		rw.WriteHeader(http.StatusServiceUnavailable)
-		rw.Write(serviceUnavailable)
+		p.serveError(rw, errorStatus(err))
 		return
 	}
 	defer uconn.Close()
@@ -168,12 +236,67 @@ func (p *ReverseProxy) writeResponse(rw http.ResponseWriter, res *http.Response)
 		res.Header.Del("Connection")
 	}
 
+	p.ResponseHeaders.Apply(res.Header)
+
+	compress := shouldCompress(res, p.CompressTypes)
+	if compress {
+		res.Header.Del("Content-Length")
+		res.Header.Set("Content-Encoding", "gzip")
+		res.Header.Add("Vary", "Accept-Encoding")
+		weakenETag(res.Header)
+	}
 	copyHeader(rw.Header(), res.Header)
 
+	if br, ok := rw.(BackendRecorder); ok {
+		br.SetBackend(res.Request.URL.Host)
+	}
+
 	rw.WriteHeader(res.StatusCode)
+	if compress {
+		gz := gzip.NewWriter(rw)
+		p.copyResponse(&gzipWriter{gz: gz, rw: rw}, res.Body)
+		gz.Close()
+		return
+	}
 	p.copyResponse(rw, res.Body)
 }
 
+// errorStatus returns the status code of the response to a request which
+// failed to be proxied with err. It is 503 if no backend could be connected
+// to, 504 if the backend timed out and 502 for other errors from the backend.
+func errorStatus(err error) int {
+	if err == errNoBackends {
+		return http.StatusServiceUnavailable
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// serveError writes an error response with the configured error page for
+// code, or the status text if there isn't one.
+func (p *ReverseProxy) serveError(rw http.ResponseWriter, code int) {
+	if page, ok := p.ErrorPages[code]; ok {
+		ServeErrorPage(rw, code, page)
+		return
+	}
+	rw.WriteHeader(code)
+	if code == http.StatusServiceUnavailable {
+		rw.Write(serviceUnavailable)
+	} else {
+		rw.Write([]byte(http.StatusText(code) + "\n"))
+	}
+}
+
+// ServeErrorPage writes a response with the status code and page as the body.
+func ServeErrorPage(rw http.ResponseWriter, code int, page []byte) {
+	rw.Header().Set("Content-Type", http.DetectContentType(page))
+	rw.Header().Set("Content-Length", strconv.Itoa(len(page)))
+	rw.WriteHeader(code)
+	rw.Write(page)
+}
+
 func isConnectionUpgrade(h http.Header) bool {
 	for _, token := range strings.Split(h.Get("Connection"), ",") {
 		if v := strings.ToLower(strings.TrimSpace(token)); v == "upgrade" {
@@ -31,16 +31,42 @@ var (
 // BackendListFunc returns a slice of backend hosts (hostname:port).
 type BackendListFunc func() []string
 
+// A BackendGroup is a set of backends which receives a share of requests
+// proportional to its weight. Groups with a weight of zero only receive
+// requests when no other backends are available.
+type BackendGroup struct {
+	Backends BackendListFunc
+	Weight   int
+
+	// Balancer orders the backends of the group, it defaults to the
+	// balancer of the proxy. Balancers with state, like round-robin, should
+	// not be shared between groups as each one is called for every request.
+	Balancer Balancer
+}
+
 type transport struct {
-	getBackends BackendListFunc
+	groups   []BackendGroup
+	balancer Balancer
+	conns    *ConnCounter
 
 	stickyCookieKey   *[32]byte
 	useStickySessions bool
 }
 
-func (t *transport) getOrderedBackends(stickyBackend string) []string {
-	backends := t.getBackends()
-	shuffle(backends)
+func (t *transport) getOrderedBackends(stickyBackend string, req *http.Request, clientAddr string) []string {
+	var backends []string
+	if len(t.groups) == 1 {
+		backends = t.groups[0].Backends()
+		t.groupBalancer(t.groups[0]).Order(backends, req, clientAddr)
+	} else {
+		// the backends of the chosen group are tried first, followed by the
+		// others so that requests fail over to them
+		for _, g := range weightedOrder(t.groups) {
+			b := g.Backends()
+			t.groupBalancer(g).Order(b, req, clientAddr)
+			backends = append(backends, b...)
+		}
+	}
 
 	if stickyBackend != "" {
 		swapToFront(backends, stickyBackend)
@@ -48,6 +74,20 @@ func (t *transport) getOrderedBackends(stickyBackend string) []string {
 	return backends
 }
 
+func (t *transport) groupBalancer(g BackendGroup) Balancer {
+	if g.Balancer != nil {
+		return g.Balancer
+	}
+	return t.balancer
+}
+
+// track increments the active connection count for backend, and returns
+// a function that decrements it.
+func (t *transport) track(backend string) func() {
+	t.conns.inc(backend)
+	return func() { t.conns.dec(backend) }
+}
+
 func (t *transport) getStickyBackend(req *http.Request) string {
 	if t.useStickySessions {
 		return getStickyCookieBackend(req, *t.stickyCookieKey)
@@ -68,18 +108,24 @@ func (t *transport) setStickyBackend(res *http.Response, originalStickyBackend s
 // connected to.
 func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	// http.Transport closes the request body on a failed dial, issue #875
-	req.Body = &fakeCloseReadCloser{req.Body}
-	defer req.Body.(*fakeCloseReadCloser).RealClose()
+	if req.Body != nil {
+		body := &fakeCloseReadCloser{req.Body}
+		req.Body = body
+		defer body.RealClose()
+	}
 
 	stickyBackend := t.getStickyBackend(req)
-	backends := t.getOrderedBackends(stickyBackend)
+	backends := t.getOrderedBackends(stickyBackend, req, req.RemoteAddr)
 	for _, backend := range backends {
 		req.URL.Host = backend
+		done := t.track(backend)
 		res, err := httpTransport.RoundTrip(req)
 		if err == nil {
+			res.Body = &trackedBody{ReadCloser: res.Body, done: done}
 			t.setStickyBackend(res, stickyBackend)
 			return res, nil
 		}
+		done()
 		if _, ok := err.(dialErr); !ok {
 			return nil, err
 		}
@@ -89,15 +135,15 @@ func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
 }
 
 func (t *transport) Connect(remoteAddr net.Addr) (net.Conn, error) {
-	backends := t.getOrderedBackends("")
-	conn, _, err := dialTCP(backends)
+	backends := t.getOrderedBackends("", nil, remoteAddr.String())
+	conn, _, err := t.dialTCP(backends)
 	return conn, err
 }
 
 func (t *transport) UpgradeHTTP(req *http.Request) (*http.Response, net.Conn, error) {
 	stickyBackend := t.getStickyBackend(req)
-	backends := t.getOrderedBackends(stickyBackend)
-	upconn, addr, err := dialTCP(backends)
+	backends := t.getOrderedBackends(stickyBackend, req, req.RemoteAddr)
+	upconn, addr, err := t.dialTCP(backends)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -117,11 +163,15 @@ func (t *transport) UpgradeHTTP(req *http.Request) (*http.Response, net.Conn, er
 	return res, conn, nil
 }
 
-func dialTCP(addrs []string) (net.Conn, string, error) {
+// dialTCP connects to the first available backend in addrs, returning a conn
+// which is tracked as active until it is closed.
+func (t *transport) dialTCP(addrs []string) (net.Conn, string, error) {
 	for _, addr := range addrs {
+		done := t.track(addr)
 		if conn, err := dialer.Dial("tcp", addr); err == nil {
-			return conn, addr, nil
+			return &trackedConn{Conn: conn, done: done}, addr, nil
 		}
+		done()
 	}
 	return nil, "", errNoBackends
 }
@@ -160,6 +210,30 @@ func shuffle(s []string) {
 	}
 }
 
+// weightedOrder returns the groups in a random order where the chance of a
+// group being before the remaining ones is proportional to its weight.
+func weightedOrder(groups []BackendGroup) []BackendGroup {
+	remaining := make([]BackendGroup, len(groups))
+	copy(remaining, groups)
+	ordered := make([]BackendGroup, 0, len(groups))
+	for len(remaining) > 0 {
+		total := 0
+		for _, g := range remaining {
+			total += g.Weight
+		}
+		i := 0
+		if total > 0 {
+			n := random.Math.Intn(total)
+			for ; n >= remaining[i].Weight; i++ {
+				n -= remaining[i].Weight
+			}
+		}
+		ordered = append(ordered, remaining[i])
+		remaining = append(remaining[:i], remaining[i+1:]...)
+	}
+	return ordered
+}
+
 func swapToFront(ss []string, s string) {
 	for i := range ss {
 		if ss[i] == s {
@@ -0,0 +1,233 @@
+// Package proxyproto implements reading and writing of PROXY protocol headers,
+// which are used by load balancers to pass the original client address to the
+// server they connect to.
+//
+// See http://www.haproxy.org/download/1.5/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	ErrNoHeader      = errors.New("proxyproto: connection did not start with a PROXY protocol header")
+	ErrInvalidHeader = errors.New("proxyproto: invalid PROXY protocol header")
+)
+
+// v1MaxLen is the maximum length of a v1 header including the CRLF.
+const v1MaxLen = 107
+
+// DefaultHeaderTimeout is the time a client has to send the header after
+// connecting.
+const DefaultHeaderTimeout = 10 * time.Second
+
+// Listener wraps a net.Listener, reading a PROXY protocol header from each
+// accepted connection.
+type Listener struct {
+	net.Listener
+
+	// HeaderTimeout is the time allowed for reading the header, if zero
+	// DefaultHeaderTimeout is used.
+	HeaderTimeout time.Duration
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn, l.HeaderTimeout), nil
+}
+
+// NewConn wraps conn so that a PROXY protocol header is read from it before
+// any data. The header is read on the first call to Read, RemoteAddr or
+// LocalAddr, and those return the addresses from the header. Connections
+// which don't start with a valid header fail all reads.
+func NewConn(conn net.Conn, timeout time.Duration) *Conn {
+	if timeout == 0 {
+		timeout = DefaultHeaderTimeout
+	}
+	return &Conn{Conn: conn, r: bufio.NewReader(conn), timeout: timeout}
+}
+
+// Conn is a net.Conn which reads a PROXY protocol header.
+type Conn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once     sync.Once
+	err      error
+	src, dst net.Addr
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the source address from the header, or the address of
+// the peer if the header was a LOCAL command or did not include addresses.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address from the header, or the local
+// address if the header did not include addresses.
+func (c *Conn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+func (c *Conn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	start, err := c.r.Peek(len(v1Prefix))
+	if err != nil {
+		c.err = err
+		return
+	}
+	if bytes.Equal(start, v1Prefix) {
+		c.src, c.dst, c.err = readV1(c.r)
+		return
+	}
+	if start, err = c.r.Peek(len(v2Signature)); err == nil && bytes.Equal(start, v2Signature) {
+		c.src, c.dst, c.err = readV2(c.r)
+		return
+	}
+	c.err = ErrNoHeader
+}
+
+func readV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < v1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, ErrInvalidHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, ErrInvalidHeader
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return nil, nil, ErrInvalidHeader
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+func readV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	// 12 byte signature, version and command, family and protocol, 2 byte
+	// address length
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, ErrInvalidHeader
+	}
+	cmd := header[12] & 0xf
+	fam := header[13]
+	data := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, nil, err
+	}
+
+	switch cmd {
+	case 0x0: // LOCAL, use the real connection addresses
+		return nil, nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, ErrInvalidHeader
+	}
+
+	var ipLen int
+	switch fam {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		// unsupported family, ignore the addresses
+		return nil, nil, nil
+	}
+	if len(data) < 2*ipLen+4 {
+		return nil, nil, ErrInvalidHeader
+	}
+	src = &net.TCPAddr{
+		IP:   net.IP(data[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(data[2*ipLen:])),
+	}
+	dst = &net.TCPAddr{
+		IP:   net.IP(data[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(data[2*ipLen+2:])),
+	}
+	return src, dst, nil
+}
+
+// WriteHeader writes a v1 PROXY protocol header to w for a connection from
+// src to dst. If the addresses are not TCP addresses of the same family an
+// UNKNOWN header is written.
+func WriteHeader(w io.Writer, src, dst net.Addr) error {
+	s, ok1 := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 || (s.IP.To4() == nil) != (d.IP.To4() == nil) {
+		_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+		return err
+	}
+	proto := "TCP4"
+	if s.IP.To4() == nil {
+		proto = "TCP6"
+	}
+	_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", proto, s.IP, d.IP, s.Port, d.Port)
+	return err
+}
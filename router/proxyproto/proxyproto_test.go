@@ -0,0 +1,95 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type S struct{}
+
+var _ = Suite(&S{})
+
+// pipeConn returns a Conn reading from a connection which has had data
+// written to it.
+func pipeConn(data []byte) *Conn {
+	client, server := net.Pipe()
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	return NewConn(server, time.Second)
+}
+
+func (S) TestV1(c *C) {
+	conn := pipeConn([]byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\nhello"))
+	c.Assert(conn.RemoteAddr().String(), Equals, "192.168.0.1:56324")
+	c.Assert(conn.LocalAddr().String(), Equals, "10.0.0.1:443")
+	data, err := ioutil.ReadAll(conn)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "hello")
+}
+
+func (S) TestV1IPv6(c *C) {
+	conn := pipeConn([]byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"))
+	c.Assert(conn.RemoteAddr().String(), Equals, "[2001:db8::1]:56324")
+	c.Assert(conn.LocalAddr().String(), Equals, "[2001:db8::2]:443")
+}
+
+func (S) TestV1Unknown(c *C) {
+	conn := pipeConn([]byte("PROXY UNKNOWN\r\nhello"))
+	c.Assert(conn.RemoteAddr(), Equals, conn.Conn.RemoteAddr())
+	data, err := ioutil.ReadAll(conn)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "hello")
+}
+
+func (S) TestV1Invalid(c *C) {
+	conn := pipeConn([]byte("PROXY TCP4 192.168.0.1\r\nhello"))
+	_, err := ioutil.ReadAll(conn)
+	c.Assert(err, Equals, ErrInvalidHeader)
+}
+
+func (S) TestV2(c *C) {
+	var buf bytes.Buffer
+	buf.Write(v2Signature)
+	buf.Write([]byte{0x21, 0x11})
+	binary.Write(&buf, binary.BigEndian, uint16(12))
+	buf.Write(net.IPv4(192, 168, 0, 1).To4())
+	buf.Write(net.IPv4(10, 0, 0, 1).To4())
+	binary.Write(&buf, binary.BigEndian, uint16(56324))
+	binary.Write(&buf, binary.BigEndian, uint16(443))
+	buf.WriteString("hello")
+
+	conn := pipeConn(buf.Bytes())
+	c.Assert(conn.RemoteAddr().String(), Equals, "192.168.0.1:56324")
+	c.Assert(conn.LocalAddr().String(), Equals, "10.0.0.1:443")
+	data, err := ioutil.ReadAll(conn)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "hello")
+}
+
+func (S) TestNoHeader(c *C) {
+	conn := pipeConn([]byte("GET / HTTP/1.1\r\n\r\n"))
+	_, err := ioutil.ReadAll(conn)
+	c.Assert(err, Equals, ErrNoHeader)
+}
+
+func (S) TestWriteHeader(c *C) {
+	var buf bytes.Buffer
+	src := &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}
+	c.Assert(WriteHeader(&buf, src, dst), IsNil)
+	c.Assert(buf.String(), Equals, "PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\n")
+
+	conn := pipeConn(buf.Bytes())
+	c.Assert(conn.RemoteAddr().String(), Equals, src.String())
+	c.Assert(conn.LocalAddr().String(), Equals, dst.String())
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"path"
@@ -12,7 +13,9 @@ import (
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/coreos/go-etcd/etcd"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/kavu/go_reuseport"
+	"github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
 	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/postgres"
 	"github.com/flynn/flynn/pkg/shutdown"
 	"github.com/flynn/flynn/router/types"
 )
@@ -72,10 +75,19 @@ func main() {
 	certFile := flag.String("tlscert", "", "TLS (SSL) cert file in pem format")
 	keyFile := flag.String("tlskey", "", "TLS (SSL) key file in pem format")
 	apiAddr := flag.String("apiaddr", ":"+apiPort, "api listen address")
+	accessLog := flag.Bool("access-log", true, "log proxied HTTP requests to stdout")
+	disableHTTP2 := flag.Bool("disable-http2", false, "don't offer HTTP/2 on the https listener")
+	proxyProtocol := flag.Bool("proxy-protocol", false, "require PROXY protocol headers on inbound connections")
+	dataStore := flag.String("datastore", "etcd", "route data store, etcd or postgres")
+	trustedProxies := flag.String("trusted-proxies", "", "comma separated CIDRs of proxies whose X-Forwarded-Proto header is trusted, required for force_tls routes behind a load balancer which terminates TLS")
 	flag.Parse()
 
+	trustedNets, err := parseCIDRs(*trustedProxies)
+	if err != nil {
+		shutdown.Fatal(err)
+	}
+
 	keypair := tls.Certificate{}
-	var err error
 	if *certFile != "" {
 		if keypair, err = tls.LoadX509KeyPair(*certFile, *keyFile); err != nil {
 			shutdown.Fatal(err)
@@ -101,36 +113,69 @@ func main() {
 		shutdown.BeforeExit(func() { hb.Close() })
 	}
 
-	// Read etcd addresses from ETCD
-	etcdAddrs := strings.Split(os.Getenv("ETCD"), ",")
-	if len(etcdAddrs) == 1 && etcdAddrs[0] == "" {
-		if externalIP := os.Getenv("EXTERNAL_IP"); externalIP != "" {
-			etcdAddrs = []string{fmt.Sprintf("http://%s:2379", externalIP)}
-		} else {
-			etcdAddrs = nil
+	var httpDS, tcpDS DataStore
+	switch *dataStore {
+	case "etcd":
+		// Read etcd addresses from ETCD
+		etcdAddrs := strings.Split(os.Getenv("ETCD"), ",")
+		if len(etcdAddrs) == 1 && etcdAddrs[0] == "" {
+			if externalIP := os.Getenv("EXTERNAL_IP"); externalIP != "" {
+				etcdAddrs = []string{fmt.Sprintf("http://%s:2379", externalIP)}
+			} else {
+				etcdAddrs = nil
+			}
+		}
+		etcdc := etcd.NewClient(etcdAddrs)
+
+		prefix := os.Getenv("ETCD_PREFIX")
+		if prefix == "" {
+			prefix = "/router"
+		}
+		httpDS = NewEtcdDataStore(etcdc, path.Join(prefix, "http/"))
+		tcpDS = NewEtcdDataStore(etcdc, path.Join(prefix, "tcp/"))
+	case "postgres":
+		// connection parameters are read from the FLYNN_POSTGRES and PG*
+		// environment variables
+		postgres.Wait("")
+		db, err := postgres.Open("", "")
+		if err != nil {
+			shutdown.Fatal(err)
 		}
+		if err := migratePostgresDataStore(db); err != nil {
+			shutdown.Fatal(err)
+		}
+		httpDS = NewPostgresDataStore("http", db)
+		tcpDS = NewPostgresDataStore("tcp", db)
+	default:
+		shutdown.Fatal(fmt.Errorf("router: unknown datastore %q", *dataStore))
 	}
-	etcdc := etcd.NewClient(etcdAddrs)
 
-	prefix := os.Getenv("ETCD_PREFIX")
-	if prefix == "" {
-		prefix = "/router"
+	var httpAccessLog log15.Logger
+	if *accessLog {
+		httpAccessLog = log15.New("app", "router", "log", "access")
 	}
 	r := Router{
 		TCP: &TCPListener{
 			IP:        *tcpIP,
 			startPort: *tcpRangeStart,
 			endPort:   *tcpRangeEnd,
-			ds:        NewEtcdDataStore(etcdc, path.Join(prefix, "tcp/")),
+			ds:        tcpDS,
 			discoverd: discoverd.DefaultClient,
+
+			proxyProtocol: *proxyProtocol,
 		},
 		HTTP: &HTTPListener{
 			Addr:      *httpAddr,
 			TLSAddr:   *httpsAddr,
 			cookieKey: cookieKey,
 			keypair:   keypair,
-			ds:        NewEtcdDataStore(etcdc, path.Join(prefix, "http/")),
+			ds:        httpDS,
 			discoverd: discoverd.DefaultClient,
+			accessLog: httpAccessLog,
+
+			disableHTTP2:   *disableHTTP2,
+			proxyProtocol:  *proxyProtocol,
+			trustedProxies: trustedNets,
 		},
 	}
 
@@ -141,3 +186,19 @@ func main() {
 	}
 	shutdown.Fatal(http.Serve(listener, apiHandler(&r)))
 }
+
+// parseCIDRs parses a comma separated list of CIDRs.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"strconv"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/kavu/go_reuseport"
 	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/proxyproto"
 	"github.com/flynn/flynn/router/types"
 )
 
@@ -22,11 +24,16 @@ type TCPListener struct {
 	discoverd DiscoverdClient
 	ds        DataStore
 	wm        *WatchManager
+	metrics   *tcpMetrics
 
 	startPort int
 	endPort   int
 	listeners map[int]net.Listener
 
+	// proxyProtocol requires a PROXY protocol header on inbound connections,
+	// for use behind a load balancer
+	proxyProtocol bool
+
 	mtx      sync.RWMutex
 	services map[string]*tcpService
 	routes   map[string]*tcpRoute
@@ -41,6 +48,9 @@ func (l *TCPListener) AddRoute(route *router.Route) error {
 	if l.closed {
 		return ErrClosed
 	}
+	if err := validateBalancer(r.LoadBalancer); err != nil {
+		return err
+	}
 	if r.Port == 0 {
 		return l.addWithAllocatedPort(route)
 	}
@@ -58,6 +68,9 @@ func (l *TCPListener) SetRoute(route *router.Route) error {
 	if r.Port == 0 {
 		return errors.New("router: a port number needs to be specified")
 	}
+	if err := validateBalancer(r.LoadBalancer); err != nil {
+		return err
+	}
 	route.ID = md5sum(strconv.Itoa(r.Port))
 	return l.ds.Set(route)
 }
@@ -107,6 +120,10 @@ func (l *TCPListener) Start() error {
 	l.ports = make(map[int]*tcpRoute)
 	l.listeners = make(map[int]net.Listener)
 
+	if l.metrics == nil {
+		l.metrics = newTCPMetrics()
+	}
+
 	started := make(chan error)
 
 	if l.startPort != 0 && l.endPort != 0 {
@@ -138,6 +155,18 @@ func (l *TCPListener) Close() error {
 	return nil
 }
 
+// WriteMetrics writes the connection metrics of the listener along with the
+// active connections to each backend.
+func (l *TCPListener) WriteMetrics(w io.Writer) error {
+	l.mtx.RLock()
+	services := make([]backendConns, 0, len(l.services))
+	for _, service := range l.services {
+		services = append(services, backendConns{service.name, service.sc.Addrs(), service.conns})
+	}
+	l.mtx.RUnlock()
+	return writeMetrics(w, l.metrics, backendConnsGauge("router_tcp_backend_active_connections", services))
+}
+
 type tcpSyncHandler struct {
 	l *TCPListener
 }
@@ -171,13 +200,26 @@ func (h *tcpSyncHandler) Set(data *router.Route) error {
 			return err
 		}
 		service = &tcpService{
-			name: r.Service,
-			sc:   sc,
-			rp:   proxy.NewReverseProxy(sc.Addrs, nil, false),
+			name:  r.Service,
+			sc:    sc,
+			conns: proxy.NewConnCounter(),
 		}
 		h.l.services[r.Service] = service
 	}
+	lb, err := proxy.NewBalancer(r.LoadBalancer, service.conns, "")
+	if err != nil {
+		if service.refs <= 0 {
+			service.sc.Close()
+			delete(h.l.services, service.name)
+		}
+		return err
+	}
 	r.service = service
+	r.rp = proxy.NewReverseProxy(service.sc.Addrs, nil, false, lb, service.conns)
+	r.rp.ProxyProtocol = r.ProxyProtocol
+	if r.MaxConns > 0 {
+		r.connLimiter = newConcurrencyLimiter(r.MaxConns)
+	}
 	if listener, ok := h.l.listeners[r.Port]; ok {
 		r.l = listener
 		delete(h.l.listeners, r.Port)
@@ -194,7 +236,7 @@ func (h *tcpSyncHandler) Set(data *router.Route) error {
 	h.l.routes[data.ID] = r
 	h.l.ports[r.Port] = r
 
-	go h.l.wm.Send(&router.Event{Event: "set", ID: data.ID})
+	h.l.wm.Send(&router.Event{Event: "set", ID: data.ID, Route: data})
 	return nil
 }
 
@@ -218,7 +260,8 @@ func (h *tcpSyncHandler) Remove(id string) error {
 
 	delete(h.l.routes, id)
 	delete(h.l.ports, r.Port)
-	go h.l.wm.Send(&router.Event{Event: "remove", ID: id})
+	h.l.metrics.removeRoute(strconv.Itoa(r.Port))
+	h.l.wm.Send(&router.Event{Event: "remove", ID: id, Route: r.ToRoute()})
 	return nil
 }
 
@@ -228,7 +271,10 @@ type tcpRoute struct {
 	l       net.Listener
 	addr    string
 	service *tcpService
+	rp      *proxy.ReverseProxy
 	mtx     sync.RWMutex
+
+	connLimiter concurrencyLimiter
 }
 
 func (r *tcpRoute) Serve(started chan<- error) {
@@ -246,12 +292,23 @@ func (r *tcpRoute) Serve(started chan<- error) {
 		if err != nil {
 			break
 		}
+		if r.parent.proxyProtocol {
+			conn = proxyproto.NewConn(conn, 0)
+		}
 		r.mtx.RLock()
-		go r.service.ServeConn(conn)
+		go r.serveConn(conn)
 		r.mtx.RUnlock()
 	}
 }
 
+func (r *tcpRoute) serveConn(conn net.Conn) {
+	port := strconv.Itoa(r.Port)
+	r.parent.metrics.conns.Inc(port)
+	r.parent.metrics.active.Inc(port)
+	defer r.parent.metrics.active.Dec(port)
+	r.service.ServeConn(conn, r)
+}
+
 func (r *tcpRoute) Close() {
 	if r.Port >= r.parent.startPort && r.Port <= r.parent.endPort {
 		// make a copy of the fd and create a new listener with it
@@ -271,13 +328,19 @@ func (r *tcpRoute) Close() {
 }
 
 type tcpService struct {
-	name string
-	sc   DiscoverdServiceCache
-	refs int
-
-	rp *proxy.ReverseProxy
+	name  string
+	sc    DiscoverdServiceCache
+	refs  int
+	conns *proxy.ConnCounter
 }
 
-func (s *tcpService) ServeConn(conn net.Conn) {
-	s.rp.ServeConn(conn)
+func (s *tcpService) ServeConn(conn net.Conn, r *tcpRoute) {
+	if r.connLimiter != nil {
+		if !r.connLimiter.Acquire() {
+			conn.Close()
+			return
+		}
+		defer r.connLimiter.Release()
+	}
+	r.rp.ServeConn(conn)
 }
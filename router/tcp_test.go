@@ -121,6 +121,39 @@ func addTCPRoute(c *C, l *TCPListener, port int) *router.TCPRoute {
 	return r.TCPRoute()
 }
 
+func (s *S) TestTCPMaxConns(c *C) {
+	const addr, port = "127.0.0.1:45000", 45000
+	srv := NewTCPTestServer("1")
+	defer srv.Close()
+
+	l := s.newTCPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, (&router.TCPRoute{
+		Service:  "test",
+		Port:     port,
+		MaxConns: 1,
+	}).ToRoute())
+	discoverdRegisterTCP(c, l, srv.Addr)
+
+	// hold the only allowed connection open
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	prefix := make([]byte, 1)
+	_, err = io.ReadFull(conn, prefix)
+	c.Assert(err, IsNil)
+
+	// a second connection should be closed without reaching the backend
+	conn2, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	res, _ := ioutil.ReadAll(conn2)
+	conn2.Close()
+	c.Assert(res, HasLen, 0)
+
+	conn.Close()
+	assertTCPConn(c, addr, "1")
+}
+
 func (s *S) TestInitialTCPSync(c *C) {
 	const addr, port = "127.0.0.1:45000", 45000
 	l := s.newTCPListenerPrefix(c, "initial")
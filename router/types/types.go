@@ -51,6 +51,82 @@ type HTTPRoute struct {
 	TLSCert string `json:"tls_cert,omitempty"`
 	TLSKey  string `json:"tls_key,omitempty"`
 	Sticky  bool   `json:"sticky,omitempty"`
+
+	// Services splits requests between several services in proportion to
+	// their weights, for example to send a share of traffic to a canary. If
+	// it is set, Service is ignored.
+	Services []WeightedService `json:"services,omitempty"`
+
+	// ClientCA is a PEM encoded bundle of CA certificates. If set, clients
+	// must present a certificate signed by one of them, and the subject of
+	// the verified certificate is passed to the service in the
+	// X-Client-Cert-Subject header.
+	ClientCA string `json:"client_ca,omitempty"`
+
+	// ForceTLS causes plain HTTP requests to be redirected to HTTPS with a
+	// 301 response. Requests from the router's trusted proxies are not
+	// redirected if their X-Forwarded-Proto is https. When the router is
+	// behind a load balancer which terminates TLS, the load balancer must be
+	// included in the router's -trusted-proxies flag, otherwise every request
+	// it forwards is redirected, causing a redirect loop.
+	ForceTLS bool `json:"force_tls,omitempty"`
+
+	// LoadBalancer is the algorithm used to pick a backend, one of "random"
+	// (the default), "round-robin", "least-conn" or "hash".
+	LoadBalancer string `json:"load_balancer,omitempty"`
+	// HashHeader is the request header used as the key for the "hash" load
+	// balancer. The client IP is used if it is empty.
+	HashHeader string `json:"hash_header,omitempty"`
+
+	// RateLimit is the maximum number of requests per second allowed from a
+	// single client IP, zero means unlimited. RateLimitBurst is the number of
+	// requests a client may make in a burst, defaulting to RateLimit.
+	RateLimit      float64 `json:"rate_limit,omitempty"`
+	RateLimitBurst int     `json:"rate_limit_burst,omitempty"`
+	// MaxConns is the maximum number of concurrent requests proxied to the
+	// service, zero means unlimited.
+	MaxConns int `json:"max_conns,omitempty"`
+
+	// CompressTypes lists content types, such as "text/html" or "text/*",
+	// of responses to gzip for clients which accept it when the service
+	// didn't compress them.
+	CompressTypes []string `json:"compress_types,omitempty"`
+	// RequestBufferSize, if set, is the maximum size in bytes of request
+	// bodies, which are read in full before the request is forwarded so that
+	// slow uploads don't hold connections to the service open.
+	RequestBufferSize int64 `json:"request_buffer_size,omitempty"`
+
+	// ErrorPages maps the status codes "502", "503" and "504" to response
+	// bodies served instead of the default when the router fails to proxy a
+	// request. The "maintenance" page is served when Maintenance is set.
+	ErrorPages map[string]string `json:"error_pages,omitempty"`
+	// Maintenance causes all requests to be answered with a 503 and the
+	// maintenance page instead of being proxied.
+	Maintenance bool `json:"maintenance,omitempty"`
+
+	// RequestHeaders are applied in order to requests before they are
+	// forwarded to the service, and ResponseHeaders to responses before they
+	// are returned to the client.
+	RequestHeaders  []HeaderRule `json:"request_headers,omitempty"`
+	ResponseHeaders []HeaderRule `json:"response_headers,omitempty"`
+}
+
+// WeightedService is a service which receives a share of a route's requests.
+type WeightedService struct {
+	Name string `json:"name"`
+	// Weight is the relative share of requests sent to the service. Services
+	// with a weight of zero only receive requests when no other service has
+	// backends available.
+	Weight int `json:"weight"`
+}
+
+// HeaderRule adds, sets or removes a header.
+type HeaderRule struct {
+	// Action is one of "add", "set" or "remove".
+	Action string `json:"action"`
+	Name   string `json:"name"`
+	// Value is the header value, it is ignored when removing headers.
+	Value string `json:"value,omitempty"`
 }
 
 func (r *HTTPRoute) ToRoute() *Route {
@@ -70,6 +146,16 @@ type TCPRoute struct {
 	*Route  `json:"-"`
 	Port    int    `json:"port"`
 	Service string `json:"service"`
+
+	// LoadBalancer is the algorithm used to pick a backend, one of "random"
+	// (the default), "round-robin", "least-conn" or "hash" (on the client IP).
+	LoadBalancer string `json:"load_balancer,omitempty"`
+	// MaxConns is the maximum number of concurrent connections proxied to
+	// the service, zero means unlimited.
+	MaxConns int `json:"max_conns,omitempty"`
+	// ProxyProtocol enables sending a PROXY protocol v1 header to backends
+	// so that they can learn the client's address.
+	ProxyProtocol bool `json:"proxy_protocol,omitempty"`
 }
 
 func (r *TCPRoute) ToRoute() *Route {
@@ -85,8 +171,12 @@ func (r *TCPRoute) ToRoute() *Route {
 	return &route
 }
 
+// Event is sent to route watchers when a route is set or removed.
 type Event struct {
-	Event string
-	ID    string
-	Error error
+	// Event is either "set" or "remove".
+	Event string `json:"event"`
+	ID    string `json:"id"`
+	// Route is the route which was set or removed.
+	Route *Route `json:"route,omitempty"`
+	Error error  `json:"-"`
 }
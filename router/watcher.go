@@ -12,36 +12,87 @@ type Watcher interface {
 }
 
 func NewWatchManager() *WatchManager {
-	return &WatchManager{watchers: make(map[chan *router.Event]struct{})}
+	return &WatchManager{watchers: make(map[chan *router.Event]*watcher)}
 }
 
+// WatchManager sends events to watchers. Each watcher has a buffer of events
+// so that Send doesn't block, and a watcher which falls too far behind is
+// closed rather than blocking the others.
 type WatchManager struct {
-	mtx      sync.RWMutex
-	watchers map[chan *router.Event]struct{}
+	mtx      sync.Mutex
+	watchers map[chan *router.Event]*watcher
+}
+
+// watcherBufferSize is the number of events which can be queued for a watcher
+// before it is closed.
+const watcherBufferSize = 1024
+
+type watcher struct {
+	ch    chan *router.Event
+	queue chan *router.Event
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// run sends queued events to the watcher in order, and closes the watcher
+// channel once stopped.
+func (w *watcher) run() {
+	defer close(w.done)
+	defer close(w.ch)
+	for {
+		select {
+		case event := <-w.queue:
+			select {
+			case w.ch <- event:
+			case <-w.stop:
+				return
+			}
+		case <-w.stop:
+			return
+		}
+	}
 }
 
 func (m *WatchManager) Watch(ch chan *router.Event) {
+	w := &watcher{
+		ch:    ch,
+		queue: make(chan *router.Event, watcherBufferSize),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
 	m.mtx.Lock()
-	m.watchers[ch] = struct{}{}
+	m.watchers[ch] = w
 	m.mtx.Unlock()
+	go w.run()
 }
 
+// Unwatch stops sending events to ch and closes it. It does nothing if ch has
+// already been closed because it fell behind.
 func (m *WatchManager) Unwatch(ch chan *router.Event) {
-	go func() {
-		// drain channel so that we don't deadlock
-		for range ch {
-		}
-	}()
 	m.mtx.Lock()
+	w, ok := m.watchers[ch]
 	delete(m.watchers, ch)
 	m.mtx.Unlock()
-	close(ch)
+	if !ok {
+		return
+	}
+	close(w.stop)
+	<-w.done
 }
 
+// Send queues event for each watcher without blocking. Events are delivered
+// to each watcher in the order they are sent.
 func (m *WatchManager) Send(event *router.Event) {
-	m.mtx.RLock()
-	defer m.mtx.RUnlock()
-	for ch := range m.watchers {
-		ch <- event
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for ch, w := range m.watchers {
+		select {
+		case w.queue <- event:
+		default:
+			// the watcher isn't keeping up, close it so that it can
+			// reconnect and get the current state
+			delete(m.watchers, ch)
+			close(w.stop)
+		}
 	}
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/router/types"
+)
+
+type WatcherSuite struct{}
+
+var _ = Suite(&WatcherSuite{})
+
+func (WatcherSuite) TestSendOrder(c *C) {
+	m := NewWatchManager()
+	ch := make(chan *router.Event)
+	m.Watch(ch)
+	defer m.Unwatch(ch)
+
+	// Send doesn't wait for the watcher to receive the events
+	for i := 0; i < 10; i++ {
+		m.Send(&router.Event{Event: "set", ID: fmt.Sprint(i)})
+	}
+	for i := 0; i < 10; i++ {
+		select {
+		case e := <-ch:
+			c.Assert(e.ID, Equals, fmt.Sprint(i))
+		case <-time.After(time.Second):
+			c.Fatal("timed out waiting for event")
+		}
+	}
+}
+
+func (WatcherSuite) TestSlowWatcher(c *C) {
+	m := NewWatchManager()
+	slow := make(chan *router.Event)
+	m.Watch(slow)
+	defer m.Unwatch(slow)
+	fast := make(chan *router.Event)
+	m.Watch(fast)
+	defer m.Unwatch(fast)
+
+	// the slow watcher is closed once its buffer is full, without blocking
+	// the other watcher
+	for i := 0; i < 2*watcherBufferSize; i++ {
+		m.Send(&router.Event{Event: "set", ID: fmt.Sprint(i)})
+		select {
+		case e := <-fast:
+			c.Assert(e.ID, Equals, fmt.Sprint(i))
+		case <-time.After(time.Second):
+			c.Fatal("timed out waiting for event")
+		}
+	}
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-slow:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			c.Fatal("timed out waiting for the slow watcher to be closed")
+		}
+	}
+}
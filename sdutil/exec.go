@@ -30,6 +30,7 @@ func (s *regSlice) Set(value string) error {
 type execCmd struct {
 	register
 	services *regSlice
+	check    checkFlags
 }
 
 func (cmd *execCmd) Name() string {
@@ -41,12 +42,19 @@ func (cmd *execCmd) DefineFlags(fs *flag.FlagSet) {
 	t := make(regSlice)
 	cmd.services = &t
 	fs.Var(cmd.services, "s", "services to register")
+	cmd.check.Define(fs)
 }
 
 func (cmd *execCmd) Run(fs *flag.FlagSet) {
 	cmd.exitStatus = 0
 
 	cmd.ValidateFlags()
+	if cmd.check.Enabled() {
+		if err := cmd.check.Validate(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
 
 	args := fs.Args()
 	if len(args) < 1 {
@@ -66,7 +74,11 @@ func (cmd *execCmd) Run(fs *flag.FlagSet) {
 		panic(err)
 	}
 
-	cmd.RegisterWithExitHook(map[string]string(*cmd.services), false)
+	if cmd.check.Enabled() {
+		cmd.RegisterWithHealthCheck(map[string]string(*cmd.services), &cmd.check, false)
+	} else {
+		cmd.RegisterWithExitHook(map[string]string(*cmd.services), false)
+	}
 
 	exitCh := exitStatusCh(c)
 	cmd.exitStatus = int(<-exitCh)
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/discoverd/health"
+	"github.com/flynn/flynn/pkg/stream"
+)
+
+// checkFlags configure a health check that gates service registration. The
+// defaults are read from the SD_CHECK_* environment variables which are set
+// by the controller for process types with a health check.
+type checkFlags struct {
+	typ       *string
+	port      *string
+	path      *string
+	interval  *time.Duration
+	threshold *int
+}
+
+func (f *checkFlags) Define(fs *flag.FlagSet) {
+	interval, _ := time.ParseDuration(os.Getenv("SD_CHECK_INTERVAL"))
+	threshold, _ := strconv.Atoi(os.Getenv("SD_CHECK_THRESHOLD"))
+
+	f.typ = fs.String("check-type", os.Getenv("SD_CHECK_TYPE"), "health check type (tcp or http)")
+	f.port = fs.String("check-port", os.Getenv("SD_CHECK_PORT"), "port to health check, defaults to the service port")
+	f.path = fs.String("check-path", os.Getenv("SD_CHECK_PATH"), "path to request for http health checks")
+	f.interval = fs.Duration("check-interval", interval, "interval between health checks")
+	f.threshold = fs.Int("check-threshold", threshold, "consecutive health checks needed to change status")
+}
+
+func (f *checkFlags) Enabled() bool {
+	return *f.typ != ""
+}
+
+func (f *checkFlags) Validate() error {
+	if *f.typ != "tcp" && *f.typ != "http" {
+		return fmt.Errorf("unknown health check type: %s", *f.typ)
+	}
+	if *f.port != "" {
+		if port, err := strconv.Atoi(*f.port); err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid health check port: %s", *f.port)
+		}
+	}
+	if *f.interval < 0 {
+		return fmt.Errorf("invalid health check interval: %s", *f.interval)
+	}
+	if *f.threshold < 0 {
+		return fmt.Errorf("invalid health check threshold: %d", *f.threshold)
+	}
+	return nil
+}
+
+func (f *checkFlags) Check(host, port string) health.Check {
+	if *f.port != "" {
+		port = *f.port
+	}
+	addr := net.JoinHostPort(strings.Trim(host, "[]"), port)
+	if *f.typ == "http" {
+		path := *f.path
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		return &health.HTTPCheck{URL: "http://" + addr + path}
+	}
+	return &health.TCPCheck{Addr: addr}
+}
+
+func (f *checkFlags) MonitorConfig() health.MonitorConfig {
+	return health.MonitorConfig{
+		Interval:  *f.interval,
+		Threshold: *f.threshold,
+	}
+}
+
+// RegisterWithHealthCheck registers services in discoverd while their health
+// check is passing, and unregisters them while it is failing.
+func (cmd *register) RegisterWithHealthCheck(services map[string]string, check *checkFlags, verbose bool) {
+	cmd.exitSignalCh = make(chan os.Signal, 1)
+	signal.Notify(cmd.exitSignalCh, os.Interrupt, syscall.SIGTERM)
+
+	checkHost := *cmd.host
+	if checkHost == "" {
+		checkHost = os.Getenv("EXTERNAL_IP")
+	}
+	if checkHost == "" {
+		checkHost = "127.0.0.1"
+	}
+
+	monitors := make([]*serviceMonitor, 0, len(services))
+	for name, port := range services {
+		m := &serviceMonitor{
+			name:    name,
+			addr:    *cmd.host + ":" + port,
+			verbose: verbose,
+		}
+		m.Start(check.MonitorConfig(), check.Check(checkHost, port))
+		monitors = append(monitors, m)
+	}
+	go func() {
+		<-cmd.exitSignalCh
+		if verbose {
+			log.Println("Unregistering service...")
+		}
+		for _, m := range monitors {
+			m.Close()
+		}
+		os.Exit(cmd.exitStatus)
+	}()
+}
+
+// The backoff between attempts to register a service which is up doubles
+// from registerMinBackoff after each failure, up to registerMaxBackoff.
+const (
+	registerMinBackoff = 100 * time.Millisecond
+	registerMaxBackoff = 10 * time.Second
+)
+
+type serviceMonitor struct {
+	name    string
+	addr    string
+	verbose bool
+
+	// register registers the service in discoverd, it defaults to
+	// discoverd.DefaultClient.AddServiceAndRegister.
+	register func(name, addr string) (discoverd.Heartbeater, error)
+
+	stream stream.Stream
+	done   chan struct{}
+}
+
+func (m *serviceMonitor) Start(cfg health.MonitorConfig, check health.Check) {
+	if m.register == nil {
+		m.register = discoverd.DefaultClient.AddServiceAndRegister
+	}
+	events := make(chan health.MonitorEvent)
+	m.stream = health.Monitor(cfg, check, events)
+	m.done = make(chan struct{})
+	go func() {
+		defer close(m.done)
+		var hb discoverd.Heartbeater
+		var retry <-chan time.Time
+		backoff := registerMinBackoff
+
+		// register tries to register the service, retrying with backoff
+		// until it succeeds or the status changes.
+		register := func() {
+			var err error
+			hb, err = m.register(m.name, m.addr)
+			if err != nil {
+				log.Printf("Error registering service '%s', retrying in %s: %s", m.name, backoff, err)
+				retry = time.After(backoff)
+				if backoff *= 2; backoff > registerMaxBackoff {
+					backoff = registerMaxBackoff
+				}
+				return
+			}
+			retry = nil
+			backoff = registerMinBackoff
+			if m.verbose {
+				log.Printf("Health check passed, registered service '%s'.", m.name)
+			}
+		}
+
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					if hb != nil {
+						hb.Close()
+					}
+					return
+				}
+				switch e.Status {
+				case health.MonitorStatusUp:
+					register()
+				case health.MonitorStatusDown:
+					log.Printf("Health check failed, unregistering service '%s': %s", m.name, e.Err)
+					retry = nil
+					backoff = registerMinBackoff
+					if hb != nil {
+						hb.Close()
+						hb = nil
+					}
+				}
+			case <-retry:
+				register()
+			}
+		}
+	}()
+}
+
+// Close stops the health check and unregisters the service.
+func (m *serviceMonitor) Close() {
+	m.stream.Close()
+	<-m.done
+}
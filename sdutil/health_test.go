@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/discoverd/health"
+)
+
+// Hook gocheck up to the "go test" runner
+func Test(t *testing.T) { TestingT(t) }
+
+type HealthSuite struct{}
+
+var _ = Suite(&HealthSuite{})
+
+func parseCheckFlags(c *C, args ...string) *checkFlags {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	f := &checkFlags{}
+	f.Define(fs)
+	c.Assert(fs.Parse(args), IsNil)
+	return f
+}
+
+func (HealthSuite) TestValidate(c *C) {
+	for _, t := range []struct {
+		args []string
+		err  string
+	}{
+		{args: []string{"-check-type", "tcp"}},
+		{args: []string{"-check-type", "http", "-check-port", "8080", "-check-interval", "5s", "-check-threshold", "3"}},
+		{args: []string{"-check-type", "udp"}, err: "unknown health check type: udp"},
+		{args: []string{"-check-type", "tcp", "-check-port", "http"}, err: "invalid health check port: http"},
+		{args: []string{"-check-type", "tcp", "-check-port", "70000"}, err: "invalid health check port: 70000"},
+		{args: []string{"-check-type", "tcp", "-check-interval", "-1s"}, err: "invalid health check interval: -1s"},
+		{args: []string{"-check-type", "tcp", "-check-threshold", "-1"}, err: "invalid health check threshold: -1"},
+	} {
+		err := parseCheckFlags(c, t.args...).Validate()
+		if t.err == "" {
+			c.Assert(err, IsNil, Commentf("args = %v", t.args))
+		} else {
+			c.Assert(err, ErrorMatches, t.err, Commentf("args = %v", t.args))
+		}
+	}
+}
+
+func (HealthSuite) TestCheck(c *C) {
+	f := parseCheckFlags(c)
+	c.Assert(f.Enabled(), Equals, false)
+
+	f = parseCheckFlags(c, "-check-type", "tcp")
+	c.Assert(f.Enabled(), Equals, true)
+	c.Assert(f.Check("10.0.0.1", "5000"), DeepEquals, &health.TCPCheck{Addr: "10.0.0.1:5000"})
+
+	f = parseCheckFlags(c, "-check-type", "tcp", "-check-port", "6000")
+	c.Assert(f.Check("[::1]", "5000"), DeepEquals, &health.TCPCheck{Addr: "[::1]:6000"})
+
+	f = parseCheckFlags(c, "-check-type", "http", "-check-path", "status")
+	c.Assert(f.Check("10.0.0.1", "5000"), DeepEquals, &health.HTTPCheck{URL: "http://10.0.0.1:5000/status"})
+
+	f = parseCheckFlags(c, "-check-type", "http", "-check-interval", "5s", "-check-threshold", "3")
+	c.Assert(f.Check("10.0.0.1", "5000"), DeepEquals, &health.HTTPCheck{URL: "http://10.0.0.1:5000/"})
+	c.Assert(f.MonitorConfig(), DeepEquals, health.MonitorConfig{Interval: 5 * time.Second, Threshold: 3})
+}
+
+func (HealthSuite) TestCheckEnv(c *C) {
+	env := map[string]string{
+		"SD_CHECK_TYPE":      "http",
+		"SD_CHECK_PORT":      "6000",
+		"SD_CHECK_PATH":      "/ping",
+		"SD_CHECK_INTERVAL":  "5s",
+		"SD_CHECK_THRESHOLD": "3",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	f := parseCheckFlags(c)
+	c.Assert(f.Enabled(), Equals, true)
+	c.Assert(f.Validate(), IsNil)
+	c.Assert(f.Check("10.0.0.1", "5000"), DeepEquals, &health.HTTPCheck{URL: "http://10.0.0.1:6000/ping"})
+	c.Assert(f.MonitorConfig(), DeepEquals, health.MonitorConfig{Interval: 5 * time.Second, Threshold: 3})
+
+	// flags override the environment
+	f = parseCheckFlags(c, "-check-type", "tcp", "-check-port", "7000")
+	c.Assert(f.Check("10.0.0.1", "5000"), DeepEquals, &health.TCPCheck{Addr: "10.0.0.1:7000"})
+}
+
+type okCheck struct{}
+
+func (okCheck) Check() error { return nil }
+
+type fakeHeartbeater struct {
+	discoverd.Heartbeater
+	closed chan struct{}
+}
+
+func (h *fakeHeartbeater) Close() error {
+	close(h.closed)
+	return nil
+}
+
+func (HealthSuite) TestMonitorRetriesRegistration(c *C) {
+	var mtx sync.Mutex
+	attempts := 0
+	registered := make(chan *fakeHeartbeater, 1)
+	m := &serviceMonitor{
+		name: "test",
+		addr: "127.0.0.1:5000",
+		register: func(name, addr string) (discoverd.Heartbeater, error) {
+			c.Assert(name, Equals, "test")
+			c.Assert(addr, Equals, "127.0.0.1:5000")
+			mtx.Lock()
+			defer mtx.Unlock()
+			attempts++
+			if attempts < 3 {
+				return nil, errors.New("discoverd unavailable")
+			}
+			hb := &fakeHeartbeater{closed: make(chan struct{})}
+			registered <- hb
+			return hb, nil
+		},
+	}
+	m.Start(health.MonitorConfig{StartInterval: 10 * time.Millisecond}, okCheck{})
+
+	var hb *fakeHeartbeater
+	select {
+	case hb = <-registered:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for registration")
+	}
+	mtx.Lock()
+	c.Assert(attempts, Equals, 3)
+	mtx.Unlock()
+
+	m.Close()
+	select {
+	case <-hb.closed:
+	default:
+		c.Fatal("expected heartbeater to be closed")
+	}
+}
@@ -4,6 +4,7 @@ func main() {
 	ParseCommands(
 		new(register),
 		new(instances),
+		new(servicesCmd),
 		new(execCmd),
 	)
 }
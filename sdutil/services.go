@@ -4,6 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/flynn/flynn/discoverd/client"
@@ -39,3 +41,73 @@ func (cmd *instances) Run(fs *flag.FlagSet) {
 		fmt.Println(inst.Addr)
 	}
 }
+
+type servicesCmd struct {
+	watch *bool
+}
+
+func (cmd *servicesCmd) Name() string {
+	return "services"
+}
+
+func (cmd *servicesCmd) DefineFlags(fs *flag.FlagSet) {
+	cmd.watch = fs.Bool("w", false, "watch for changes to all services")
+}
+
+func (cmd *servicesCmd) Run(fs *flag.FlagSet) {
+	if *cmd.watch {
+		cmd.watchAll()
+		return
+	}
+	services, err := discoverd.DefaultClient.Services()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, name := range services {
+		fmt.Println(name)
+		s := discoverd.NewService(name)
+		instances, err := s.Instances()
+		if err != nil {
+			log.Fatal(err)
+		}
+		var leaderID string
+		if leader, err := s.Leader(); err == nil {
+			leaderID = leader.ID
+		}
+		for _, inst := range instances {
+			line := "  " + inst.Addr
+			if inst.ID == leaderID {
+				line += " (leader)"
+			}
+			fmt.Println(line + formatMeta(inst.Meta))
+		}
+	}
+}
+
+func (cmd *servicesCmd) watchAll() {
+	events := make(chan *discoverd.Event)
+	stream, err := discoverd.DefaultClient.WatchAll(events)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for e := range events {
+		if e.Instance == nil {
+			continue
+		}
+		fmt.Println(e.Kind, e.Service, e.Instance.Addr+formatMeta(e.Instance.Meta))
+	}
+	if err := stream.Err(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// formatMeta returns meta as key=value pairs sorted by key, each preceded by
+// a space.
+func formatMeta(meta map[string]string) string {
+	pairs := make([]string, 0, len(meta))
+	for k, v := range meta {
+		pairs = append(pairs, " "+k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "")
+}
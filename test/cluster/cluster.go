@@ -34,6 +34,7 @@ type Cluster struct {
 	ClusterDomain string        `json:"cluster_domain"`
 	ControllerPin string        `json:"controller_pin"`
 	ControllerKey string        `json:"controller_key"`
+	DiscoverdKey  string        `json:"discoverd_key"`
 	RouterIP      string        `json:"router_ip"`
 
 	bc     BootConfig
@@ -210,6 +211,10 @@ func (c *Cluster) startVMs(rootFS string, initial bool, count int) ([]*Instance,
 		return nil, err
 	}
 
+	if c.DiscoverdKey == "" {
+		c.DiscoverdKey = random.String(16)
+	}
+
 	instances := make([]*Instance, count)
 	for i := 0; i < count; i++ {
 		inst, err := c.vm.NewInstance(&VMConfig{
@@ -242,10 +247,11 @@ func (c *Cluster) startVMs(rootFS string, initial bool, count int) ([]*Instance,
 	for _, inst := range instances {
 		var script bytes.Buffer
 		data := hostScriptData{
-			ID:        inst.ID,
-			IP:        inst.IP,
-			Peers:     strings.Join(peers, ","),
-			EtcdProxy: !initial,
+			ID:           inst.ID,
+			IP:           inst.IP,
+			Peers:        strings.Join(peers, ","),
+			EtcdProxy:    !initial,
+			DiscoverdKey: c.DiscoverdKey,
 		}
 		tmpl.Execute(&script, data)
 
@@ -381,10 +387,11 @@ func runUnitTests(inst *Instance, out io.Writer) error {
 }
 
 type hostScriptData struct {
-	ID        string
-	IP        string
-	Peers     string
-	EtcdProxy bool
+	ID           string
+	IP           string
+	Peers        string
+	EtcdProxy    bool
+	DiscoverdKey string
 }
 
 var flynnHostScripts = map[string]*template.Template{
@@ -404,6 +411,7 @@ sudo start-stop-daemon \
   ETCD_NAME={{ .ID }} \
   ETCD_INITIAL_CLUSTER={{ .Peers }} \
   ETCD_INITIAL_CLUSTER_STATE=new \
+  DISCOVERD_KEY={{ .DiscoverdKey }} \
   {{ if .EtcdProxy }} ETCD_PROXY=on {{ end }} \
   flynn-host \
   daemon \
@@ -436,8 +444,8 @@ func (c *Cluster) bootstrapLayer1() error {
 	var cmdErr error
 	go func() {
 		command := fmt.Sprintf(
-			"DISCOVERD=%s:1111 CLUSTER_DOMAIN=%s CONTROLLER_KEY=%s BACKOFF_PERIOD=%fs flynn-host bootstrap --json --min-hosts=%d /etc/flynn-bootstrap.json",
-			inst.IP, c.ClusterDomain, c.ControllerKey, c.BackoffPeriod.Seconds(), len(c.Instances),
+			"DISCOVERD=%s:1111 DISCOVERD_KEY=%s CLUSTER_DOMAIN=%s CONTROLLER_KEY=%s BACKOFF_PERIOD=%fs flynn-host bootstrap --json --min-hosts=%d /etc/flynn-bootstrap.json",
+			inst.IP, c.DiscoverdKey, c.ClusterDomain, c.ControllerKey, c.BackoffPeriod.Seconds(), len(c.Instances),
 		)
 		cmdErr = inst.Run(command, &Streams{Stdout: wr, Stderr: os.Stderr})
 		wr.Close()